@@ -59,7 +59,8 @@ func NewMemorySinkLogger() (*MemorySink, *zap.Logger) {
 	sink := &MemorySink{}
 	config := zap.NewProductionEncoderConfig()
 	config.TimeKey = ""
-	core := zapcore.NewCore(zapcore.NewJSONEncoder(config), sink, zap.DebugLevel)
+	core := zapcore.NewCore(zapcore.NewJSONEncoder(config),
+		zapcore.Lock(sink), zap.DebugLevel)
 	logger := zap.New(core)
 	return sink, logger
 }
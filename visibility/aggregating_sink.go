@@ -0,0 +1,183 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The aggregated values of one metric of one operation with one set of
+// dimensions, in the original units.
+type aggregatedSeries struct {
+	opName string
+	name   string
+	dims   Dimensions
+	unit   cloudwatch.StandardUnit
+
+	// The sum for the counts, the distribution for everything else
+	sum  float64
+	dist *Distribution
+}
+
+// Aggregates the metrics by the operation, the metric name and the
+// dimensions, and sends the aggregates to the harvester once per the flush
+// interval instead of recording every request. The counts are summed, the
+// durations and the gauges become the summaries.
+type AggregatingSink struct {
+	Harvester     *telemetry.Harvester
+	FlushInterval time.Duration
+	// Keep the quantile sketches and report these percentiles (0..1) as the
+	// gauges named <metric>_p<percent>
+	Percentiles []float64
+
+	mtx    sync.Mutex
+	start  time.Time
+	series map[string]*aggregatedSeries
+}
+
+var _ SketchingSink = &AggregatingSink{}
+var _ FlushingSink = &AggregatingSink{}
+
+func NewAggregatingSink(harvester *telemetry.Harvester,
+	flushInterval time.Duration) *AggregatingSink {
+
+	return &AggregatingSink{
+		Harvester:     harvester,
+		FlushInterval: flushInterval,
+		start:         time.Now(),
+		series:        make(map[string]*aggregatedSeries),
+	}
+}
+
+func (a *AggregatingSink) WantsSketches() bool {
+	return len(a.Percentiles) != 0
+}
+
+func (a *AggregatingSink) SubmitSegmentMetrics(met *MetricsContext) {
+	met.Lock.Lock()
+	defer met.Lock.Unlock()
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	aggregateMetrics(a.series, met, a.WantsSketches())
+}
+
+// Add the metrics to the aggregated series, the caller must hold the locks
+func aggregateMetrics(seriesMap map[string]*aggregatedSeries, met *MetricsContext,
+	keepSketches bool) {
+
+	for key, val := range met.Metrics {
+		name, dims := met.exportedMetric(key, val)
+		seriesKey := met.OpName + "_" + MetricKey(name, dims) + "/" + string(val.Unit)
+
+		series := seriesMap[seriesKey]
+		if series == nil {
+			series = &aggregatedSeries{
+				opName: met.OpName,
+				name:   name,
+				dims:   dims,
+				unit:   val.Unit,
+			}
+			if val.Unit != cloudwatch.StandardUnitCount || val.Dist != nil {
+				series.dist = NewDistribution(keepSketches)
+			}
+			seriesMap[seriesKey] = series
+		}
+
+		switch {
+		case series.dist == nil:
+			series.sum += val.Val
+		case val.Dist != nil:
+			series.dist.Merge(val.Dist)
+		default:
+			series.dist.Observe(val.Val)
+		}
+	}
+}
+
+// Send the aggregates accumulated since the last flush to New Relic
+func (a *AggregatingSink) Flush(ctx context.Context) error {
+	a.mtx.Lock()
+	series := a.series
+	start := a.start
+	a.series = make(map[string]*aggregatedSeries)
+	a.start = time.Now()
+	a.mtx.Unlock()
+
+	if len(series) == 0 {
+		return nil
+	}
+
+	interval := time.Since(start)
+	for _, s := range series {
+		a.recordSeries(s, start, interval)
+	}
+	// The harvester reports the errors through its own logger
+	a.Harvester.HarvestNow(ctx)
+	return nil
+}
+
+func (a *AggregatingSink) recordSeries(s *aggregatedSeries, start time.Time,
+	interval time.Duration) {
+
+	entry := MetricEntry{Val: s.sum, Unit: s.unit}
+	normVal, normUnit := entry.Normalize()
+	attrs := makeMetricAttributes(s.dims, &entry, normUnit)
+	name := s.opName + "_" + s.name
+
+	if s.dist == nil {
+		a.Harvester.RecordMetric(telemetry.Count{
+			Name:       name,
+			Attributes: attrs,
+			Value:      normVal,
+			Timestamp:  start,
+			Interval:   interval,
+		})
+		return
+	}
+
+	factor := entry.normalizeFactor()
+	a.Harvester.RecordMetric(telemetry.Summary{
+		Name:       name,
+		Attributes: attrs,
+		Count:      float64(s.dist.Count),
+		Sum:        s.dist.Sum * factor,
+		Min:        s.dist.Min * factor,
+		Max:        s.dist.Max * factor,
+		Timestamp:  start,
+		Interval:   interval,
+	})
+
+	for _, p := range a.Percentiles {
+		val, ok := s.dist.Quantile(p)
+		if !ok {
+			continue
+		}
+		a.Harvester.RecordMetric(telemetry.Gauge{
+			Name:       name + "_p" + strconv.FormatFloat(p*100, 'f', -1, 64),
+			Attributes: attrs,
+			Value:      val * factor,
+			Timestamp:  start,
+		})
+	}
+}
+
+// Flush the aggregates periodically, and once more when the registry closes
+func (a *AggregatingSink) Start(registry *ProcessRegistry) {
+	flushCtx := registry.CreateProcessContext("MetricsFlush")
+	// The series are taken out of the sink before the harvest, so the flush
+	// in progress can't be canceled by the shutdown
+	flushCtx.RunPeriodicProcess(a.FlushInterval, func(ctx context.Context) error {
+		return a.Flush(context.Background())
+	})
+
+	finalCtx := registry.CreateProcessContext("MetricsFinalFlush")
+	finalCtx.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		return a.Flush(context.Background())
+	})
+}
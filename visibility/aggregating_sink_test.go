@@ -0,0 +1,104 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func makeTestHarvester(fc *fakeClient) *telemetry.Harvester {
+	harv, err := telemetry.NewHarvester(telemetry.ConfigAPIKey("lic"),
+		telemetry.ConfigHarvestPeriod(0), func(c *telemetry.Config) {
+			c.Client = &http.Client{Transport: fc}
+		})
+	utils.PanicIfF(err != nil, "failed to create a harvester")
+	return harv
+}
+
+func findMetric(fc *fakeClient, name string,
+	attrs map[string]interface{}) map[string]interface{} {
+
+outer:
+	for _, m := range fc.data["metrics"].([]interface{}) {
+		mObj := m.(map[string]interface{})
+		if mObj["name"] != name {
+			continue
+		}
+		for k, v := range attrs {
+			if mObj["attributes"].(map[string]interface{})[k] != v {
+				continue outer
+			}
+		}
+		return mObj
+	}
+	return nil
+}
+
+func TestAggregatingSink(t *testing.T) {
+	fc := &fakeClient{}
+	sink := NewAggregatingSink(makeTestHarvester(fc), time.Minute)
+	sink.Percentiles = []float64{0.5, 0.99}
+	assert.True(t, wantsSketches(sink))
+
+	// Nothing to send yet
+	assert.NoError(t, sink.Flush(context.Background()))
+	assert.Nil(t, fc.data)
+
+	for i := 1; i <= 100; i++ {
+		ctx := MakeMetricContext(context.Background(), "Op")
+		met := GetMetricsFromContext(ctx)
+		met.KeepSketches = true
+		met.AddCount("calls", 2)
+		met.AddMetricWithDims("calls", Dimensions{"table": "users"}, 1,
+			cloudwatch.StandardUnitCount)
+		met.SetMetric("size", float64(i), cloudwatch.StandardUnitBytes)
+		met.ObserveMetric("latency", float64(i), cloudwatch.StandardUnitMicroseconds)
+		met.ObserveMetric("latency", float64(i), cloudwatch.StandardUnitMicroseconds)
+		sink.SubmitSegmentMetrics(met)
+	}
+	assert.NoError(t, sink.Flush(context.Background()))
+
+	calls := findMetric(fc, "Op_calls", map[string]interface{}{"table": nil})
+	assert.Equal(t, "count", calls["type"])
+	assert.Equal(t, 200.0, calls["value"])
+	assert.True(t, calls["interval.ms"].(float64) >= 0)
+	usersCalls := findMetric(fc, "Op_calls", map[string]interface{}{"table": "users"})
+	assert.Equal(t, 100.0, usersCalls["value"])
+
+	size := findMetric(fc, "Op_size", nil)
+	assert.Equal(t, "summary", size["type"])
+	assert.Equal(t, map[string]interface{}{"count": 100.0, "sum": 5050.0,
+		"min": 1.0, "max": 100.0}, size["value"])
+
+	latency := findMetric(fc, "Op_latency", nil)
+	assert.Equal(t, 200.0, latency["value"].(map[string]interface{})["count"])
+	p50 := findMetric(fc, "Op_latency_p50", nil)
+	assert.Equal(t, "gauge", p50["type"])
+	assert.InDelta(t, 50, p50["value"], 1)
+	assert.InDelta(t, 99, findMetric(fc, "Op_latency_p99", nil)["value"], 2)
+
+	// The aggregates are reset after the flush
+	fc.data = nil
+	assert.NoError(t, sink.Flush(context.Background()))
+	assert.Nil(t, fc.data)
+}
+
+func TestAggregatingSinkFlushOnClose(t *testing.T) {
+	fc := &fakeClient{}
+	sink := NewAggregatingSink(makeTestHarvester(fc), time.Hour)
+	reg := NewProcessRegistry("", zap.NewNop(), makeTestApp(), NullSink)
+	sink.Start(reg)
+
+	met := &MetricsContext{OpName: "Op", Metrics: map[string]*MetricEntry{}}
+	met.AddCount("calls", 3)
+	sink.SubmitSegmentMetrics(met)
+
+	reg.Close()
+	assert.Equal(t, 3.0, findMetric(fc, "Op_calls", nil)["value"])
+}
@@ -0,0 +1,218 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The limits of the PutMetricData requests
+const (
+	MaxPutMetricDataDatums = 20
+	// The distinct values per datum
+	MaxPutMetricDataValues = 150
+)
+
+// The number of the distinct series buffered between the flushes
+const DefaultCloudWatchBufferSize = 10000
+
+type cloudWatchSeries struct {
+	name string
+	dims []cloudwatch.Dimension
+	unit cloudwatch.StandardUnit
+
+	// The value -> count for the scalar metrics, the statistics for the
+	// distributions
+	values map[float64]float64
+	stats  *Distribution
+}
+
+// Buffers the metrics and sends them using the PutMetricData, batching the
+// equal values and the distributions into the statistic sets. The metrics
+// are sent by Flush, so the requests never wait for CloudWatch.
+type CloudWatchSink struct {
+	Client        *cloudwatch.Client
+	Namespace     string
+	FlushInterval time.Duration
+	// The series over this limit are dropped until the next flush
+	MaxBuffered int
+
+	mtx     sync.Mutex
+	series  map[string]*cloudWatchSeries
+	dropped int64
+}
+
+var _ FlushingSink = &CloudWatchSink{}
+
+func NewCloudWatchSink(config aws.Config, flushInterval time.Duration) *CloudWatchSink {
+	return &CloudWatchSink{
+		Client:        cloudwatch.New(config),
+		Namespace:     MetricsNamespaceName,
+		FlushInterval: flushInterval,
+		MaxBuffered:   DefaultCloudWatchBufferSize,
+		series:        make(map[string]*cloudWatchSeries),
+	}
+}
+
+func makeCloudWatchDimensions(opName string, dims Dimensions) []cloudwatch.Dimension {
+	res := []cloudwatch.Dimension{{
+		Name:  aws.String(OperationNameKey),
+		Value: aws.String(opName),
+	}}
+	for _, k := range dims.sortedKeys() {
+		// The empty values are not allowed
+		if len(res) == MaxCloudWatchDimensions || k == OperationNameKey || dims[k] == "" {
+			continue
+		}
+		res = append(res, cloudwatch.Dimension{Name: aws.String(k), Value: aws.String(dims[k])})
+	}
+	return res
+}
+
+func (c *CloudWatchSink) SubmitSegmentMetrics(met *MetricsContext) {
+	met.Lock.Lock()
+	defer met.Lock.Unlock()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for key, val := range met.Metrics {
+		name, dims := met.exportedMetric(key, val)
+		isDist := val.Dist != nil
+		seriesKey := met.OpName + "/" + MetricKey(name, dims) + "/" + string(val.Unit)
+		if isDist {
+			seriesKey += "/dist"
+		}
+
+		series := c.series[seriesKey]
+		if series == nil {
+			if len(c.series) >= c.MaxBuffered {
+				c.dropped++
+				continue
+			}
+			series = &cloudWatchSeries{
+				name: name,
+				dims: makeCloudWatchDimensions(met.OpName, dims),
+				unit: val.Unit,
+			}
+			if isDist {
+				series.stats = NewDistribution(false)
+			} else {
+				series.values = make(map[float64]float64)
+			}
+			c.series[seriesKey] = series
+		}
+
+		if isDist {
+			series.stats.Merge(val.Dist)
+		} else {
+			series.values[val.Val]++
+		}
+	}
+}
+
+// The number of the series dropped because the buffer was full
+func (c *CloudWatchSink) Dropped() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.dropped
+}
+
+func (s *cloudWatchSeries) makeDatums(now time.Time) []cloudwatch.MetricDatum {
+	if s.stats != nil {
+		return []cloudwatch.MetricDatum{{
+			MetricName: aws.String(s.name),
+			Dimensions: s.dims,
+			Unit:       s.unit,
+			Timestamp:  aws.Time(now),
+			StatisticValues: &cloudwatch.StatisticSet{
+				SampleCount: aws.Float64(float64(s.stats.Count)),
+				Sum:         aws.Float64(s.stats.Sum),
+				Minimum:     aws.Float64(s.stats.Min),
+				Maximum:     aws.Float64(s.stats.Max),
+			},
+		}}
+	}
+
+	values := make([]float64, 0, len(s.values))
+	for v := range s.values {
+		values = append(values, v)
+	}
+	sort.Float64s(values)
+
+	var res []cloudwatch.MetricDatum
+	for start := 0; start < len(values); start += MaxPutMetricDataValues {
+		end := start + MaxPutMetricDataValues
+		if end > len(values) {
+			end = len(values)
+		}
+		datum := cloudwatch.MetricDatum{
+			MetricName: aws.String(s.name),
+			Dimensions: s.dims,
+			Unit:       s.unit,
+			Timestamp:  aws.Time(now),
+		}
+		for _, v := range values[start:end] {
+			datum.Values = append(datum.Values, v)
+			datum.Counts = append(datum.Counts, s.values[v])
+		}
+		res = append(res, datum)
+	}
+	return res
+}
+
+// Send the buffered metrics, returns the first error. The metrics from the
+// failed requests are not retried.
+func (c *CloudWatchSink) Flush(ctx context.Context) error {
+	c.mtx.Lock()
+	series := c.series
+	c.series = make(map[string]*cloudWatchSeries)
+	c.mtx.Unlock()
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	var datums []cloudwatch.MetricDatum
+	for _, k := range keys {
+		datums = append(datums, series[k].makeDatums(now)...)
+	}
+
+	var firstErr error
+	for start := 0; start < len(datums); start += MaxPutMetricDataDatums {
+		end := start + MaxPutMetricDataDatums
+		if end > len(datums) {
+			end = len(datums)
+		}
+		_, err := c.Client.PutMetricDataRequest(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(c.Namespace),
+			MetricData: datums[start:end],
+		}).Send(ctx)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Flush the metrics periodically, and once more when the registry closes
+func (c *CloudWatchSink) Start(registry *ProcessRegistry) {
+	flushCtx := registry.CreateProcessContext("CloudWatchFlush")
+	// The buffered metrics are taken out of the sink before they are sent,
+	// so the flush in progress can't be canceled by the shutdown
+	flushCtx.RunPeriodicProcess(c.FlushInterval, func(ctx context.Context) error {
+		return c.Flush(context.Background())
+	})
+
+	finalCtx := registry.CreateProcessContext("CloudWatchFinalFlush")
+	finalCtx.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		return c.Flush(context.Background())
+	})
+}
@@ -0,0 +1,131 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+	"time"
+)
+
+type putMetricDataMock struct {
+	mtx      sync.Mutex
+	requests []*cloudwatch.PutMetricDataInput
+	fail     bool
+}
+
+func (p *putMetricDataMock) PutMetricData(ctx context.Context,
+	input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.fail {
+		return nil, fmt.Errorf("throttled")
+	}
+	p.requests = append(p.requests, input)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+func (p *putMetricDataMock) findDatum(name string) *cloudwatch.MetricDatum {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, req := range p.requests {
+		for i := range req.MetricData {
+			if *req.MetricData[i].MetricName == name {
+				return &req.MetricData[i]
+			}
+		}
+	}
+	return nil
+}
+
+func TestCloudWatchSink(t *testing.T) {
+	mock := &putMetricDataMock{}
+	awsMock := utils.NewAwsMockHandler()
+	awsMock.AddHandler(mock)
+	sink := NewCloudWatchSink(awsMock.AwsConfig(), time.Minute)
+
+	for i := 0; i < 3; i++ {
+		met := &MetricsContext{OpName: "GetUser", Metrics: map[string]*MetricEntry{}}
+		met.SetCount("Fault", 0)
+		met.SetDuration("Time", time.Duration(i+1)*time.Second)
+		met.ObserveMetricWithDims("Size", Dimensions{"table": "users"}, float64(i),
+			cloudwatch.StandardUnitBytes)
+		sink.SubmitSegmentMetrics(met)
+	}
+	// Many series to split the requests
+	met := &MetricsContext{OpName: "Other", Metrics: map[string]*MetricEntry{}}
+	for i := 0; i < 2*MaxPutMetricDataDatums; i++ {
+		met.AddCount(fmt.Sprintf("count%d", i), 1)
+	}
+	sink.SubmitSegmentMetrics(met)
+	assert.NoError(t, sink.Flush(context.Background()))
+
+	assert.Equal(t, 3, len(mock.requests))
+	for _, req := range mock.requests {
+		assert.Equal(t, MetricsNamespaceName, *req.Namespace)
+		assert.True(t, len(req.MetricData) <= MaxPutMetricDataDatums)
+	}
+
+	fault := mock.findDatum("Fault")
+	assert.Equal(t, []float64{0}, fault.Values)
+	assert.Equal(t, []float64{3}, fault.Counts)
+	assert.Equal(t, OperationNameKey, *fault.Dimensions[0].Name)
+	assert.Equal(t, "GetUser", *fault.Dimensions[0].Value)
+
+	duration := mock.findDatum("Time")
+	assert.Equal(t, cloudwatch.StandardUnitSeconds, duration.Unit)
+	assert.Equal(t, []float64{1, 2, 3}, duration.Values)
+
+	size := mock.findDatum("Size")
+	assert.Equal(t, 2, len(size.Dimensions))
+	assert.Equal(t, "users", *size.Dimensions[1].Value)
+	assert.Equal(t, 3.0, *size.StatisticValues.SampleCount)
+	assert.Equal(t, 3.0, *size.StatisticValues.Sum)
+	assert.Equal(t, 2.0, *size.StatisticValues.Maximum)
+
+	// Nothing to send
+	mock.requests = nil
+	assert.NoError(t, sink.Flush(context.Background()))
+	assert.Equal(t, 0, len(mock.requests))
+
+	mock.fail = true
+	sink.SubmitSegmentMetrics(met)
+	assert.Error(t, sink.Flush(context.Background()))
+}
+
+func TestCloudWatchSinkLimits(t *testing.T) {
+	mock := &putMetricDataMock{}
+	awsMock := utils.NewAwsMockHandler()
+	awsMock.AddHandler(mock)
+	sink := NewCloudWatchSink(awsMock.AwsConfig(), time.Hour)
+	sink.MaxBuffered = 2
+
+	met := &MetricsContext{OpName: "Op", Metrics: map[string]*MetricEntry{}}
+	for i := 0; i < MaxPutMetricDataValues+10; i++ {
+		met.SetMetric("val", float64(i), cloudwatch.StandardUnitNone)
+		sink.SubmitSegmentMetrics(met)
+	}
+	met.SetCount("second", 1)
+	met.SetCount("third", 1)
+	sink.SubmitSegmentMetrics(met)
+	assert.Equal(t, int64(1), sink.Dropped())
+
+	// Flushed on close
+	reg := NewProcessRegistry("", zap.NewNop(), makeTestApp(), NullSink)
+	sink.Start(reg)
+	reg.Close()
+
+	var numValues int
+	for _, datum := range mock.requests[0].MetricData {
+		assert.True(t, len(datum.Values) <= MaxPutMetricDataValues)
+		if *datum.MetricName == "val" {
+			numValues += len(datum.Values)
+		}
+	}
+	assert.Equal(t, MaxPutMetricDataValues+10, numValues)
+}
@@ -0,0 +1,119 @@
+package visibility
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The default limit of the distinct values per dimension
+const DefaultMaxDimensionValues = 100
+
+// The value that replaces the dimension values over the limit
+const OverflowDimensionValue = "__other__"
+
+// The metric dimensions, exported as the metric attributes
+type Dimensions map[string]string
+
+// Merge the dimensions into a new map, the later ones take precedence
+func MergeDimensions(dims ...Dimensions) Dimensions {
+	res := make(Dimensions)
+	for _, d := range dims {
+		for k, v := range d {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func (d Dimensions) sortedKeys() []string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The key of the dimensional metric in the MetricsContext.Metrics map:
+// name{key1=val1,key2=val2} with the sorted keys, or just the name if
+// there are no dimensions.
+func MetricKey(name string, dims Dimensions) string {
+	if len(dims) == 0 {
+		return name
+	}
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i, k := range dims.sortedKeys() {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(dims[k])
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// Limits the number of the distinct values for each dimension, so that a
+// dimension like the user ID doesn't blow up the number of the time series.
+// The first MaxValues values of a dimension pass as-is, the rest are
+// replaced by the Overflow value, or dropped if the Overflow is empty.
+type CardinalityGuard struct {
+	MaxValues int
+	Overflow  string
+
+	mtx  sync.Mutex
+	seen map[string]map[string]bool
+}
+
+// Used when the MetricsContext has no guard of its own
+var DefaultCardinalityGuard = NewCardinalityGuard(DefaultMaxDimensionValues,
+	OverflowDimensionValue)
+
+func NewCardinalityGuard(maxValues int, overflow string) *CardinalityGuard {
+	return &CardinalityGuard{
+		MaxValues: maxValues,
+		Overflow:  overflow,
+		seen:      make(map[string]map[string]bool),
+	}
+}
+
+// Get the dimensions with the over-the-limit values bucketed or dropped
+func (g *CardinalityGuard) Apply(dims Dimensions) Dimensions {
+	if len(dims) == 0 {
+		return dims
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	res := make(Dimensions, len(dims))
+	for k, v := range dims {
+		values := g.seen[k]
+		if values == nil {
+			values = make(map[string]bool)
+			g.seen[k] = values
+		}
+
+		switch {
+		case values[v]:
+			res[k] = v
+		case len(values) < g.MaxValues:
+			values[v] = true
+			res[k] = v
+		case g.Overflow != "":
+			res[k] = g.Overflow
+		}
+	}
+	return res
+}
+
+// The number of the distinct values seen for the dimension
+func (g *CardinalityGuard) NumValues(key string) int {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return len(g.seen[key])
+}
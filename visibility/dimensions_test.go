@@ -0,0 +1,38 @@
+package visibility
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestMetricKey(t *testing.T) {
+	assert.Equal(t, "Calls", MetricKey("Calls", nil))
+	assert.Equal(t, "Calls{region=us-east-1,table=users}", MetricKey("Calls",
+		Dimensions{"table": "users", "region": "us-east-1"}))
+}
+
+func TestMergeDimensions(t *testing.T) {
+	assert.Equal(t, Dimensions{"a": "1", "b": "3", "c": "4"}, MergeDimensions(
+		Dimensions{"a": "1", "b": "2"}, nil, Dimensions{"b": "3", "c": "4"}))
+	assert.Equal(t, Dimensions{}, MergeDimensions())
+}
+
+func TestCardinalityGuard(t *testing.T) {
+	guard := NewCardinalityGuard(2, OverflowDimensionValue)
+	assert.Equal(t, Dimensions{"tier": "free", "region": "eu"},
+		guard.Apply(Dimensions{"tier": "free", "region": "eu"}))
+	assert.Equal(t, Dimensions{"tier": "pro"}, guard.Apply(Dimensions{"tier": "pro"}))
+
+	// The known values still pass
+	assert.Equal(t, Dimensions{"tier": OverflowDimensionValue, "region": "eu"},
+		guard.Apply(Dimensions{"tier": "enterprise", "region": "eu"}))
+	assert.Equal(t, Dimensions{"tier": "free"}, guard.Apply(Dimensions{"tier": "free"}))
+	assert.Equal(t, 2, guard.NumValues("tier"))
+	assert.Nil(t, guard.Apply(nil))
+
+	// Drop the dimension instead of bucketing
+	dropping := NewCardinalityGuard(1, "")
+	dropping.Apply(Dimensions{"user": "1"})
+	assert.Equal(t, Dimensions{"op": "get"},
+		dropping.Apply(Dimensions{"user": "2", "op": "get"}))
+}
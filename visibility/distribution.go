@@ -0,0 +1,219 @@
+package visibility
+
+import (
+	"math"
+	"sort"
+)
+
+// The relative accuracy of the quantile sketches
+const DefaultSketchAccuracy = 0.01
+
+// The observations of a distribution metric: the count, sum, min and max, and
+// optionally the sketch for the percentiles.
+type Distribution struct {
+	Count int64
+	Sum   float64
+	Min   float64
+	Max   float64
+	// Nil if the sketch is not kept
+	Sketch *QuantileSketch
+}
+
+func NewDistribution(keepSketch bool) *Distribution {
+	res := &Distribution{}
+	if keepSketch {
+		res.Sketch = NewQuantileSketch(DefaultSketchAccuracy)
+	}
+	return res
+}
+
+func (d *Distribution) Observe(val float64) {
+	if d.Count == 0 || val < d.Min {
+		d.Min = val
+	}
+	if d.Count == 0 || val > d.Max {
+		d.Max = val
+	}
+	d.Count++
+	d.Sum += val
+	if d.Sketch != nil {
+		d.Sketch.Add(val)
+	}
+}
+
+// Merge the other distribution into this one. The sketch is kept only if
+// both distributions have it.
+func (d *Distribution) Merge(other *Distribution) {
+	if other.Count == 0 {
+		return
+	}
+	if d.Count == 0 || other.Min < d.Min {
+		d.Min = other.Min
+	}
+	if d.Count == 0 || other.Max > d.Max {
+		d.Max = other.Max
+	}
+	hadData := d.Count != 0
+	d.Count += other.Count
+	d.Sum += other.Sum
+
+	switch {
+	case other.Sketch == nil:
+		d.Sketch = nil
+	case d.Sketch != nil:
+		d.Sketch.Merge(other.Sketch)
+	case !hadData:
+		d.Sketch = other.Sketch.Copy()
+	}
+}
+
+func (d *Distribution) Mean() float64 {
+	if d.Count == 0 {
+		return 0
+	}
+	return d.Sum / float64(d.Count)
+}
+
+// Get the approximate quantile (0..1), the result is clamped to the min/max.
+// Returns false if there's no sketch.
+func (d *Distribution) Quantile(q float64) (float64, bool) {
+	if d.Sketch == nil || d.Count == 0 {
+		return 0, false
+	}
+	res := d.Sketch.Quantile(q)
+	return math.Max(d.Min, math.Min(d.Max, res)), true
+}
+
+func (d *Distribution) Copy() *Distribution {
+	res := *d
+	if d.Sketch != nil {
+		res.Sketch = d.Sketch.Copy()
+	}
+	return &res
+}
+
+// A DDSketch-style quantile sketch with the logarithmic buckets, the
+// quantiles are within the relative accuracy of the real values.
+type QuantileSketch struct {
+	gamma     float64
+	logGamma  float64
+	positive  map[int]int64
+	negative  map[int]int64
+	zeroCount int64
+	count     int64
+}
+
+func NewQuantileSketch(relativeAccuracy float64) *QuantileSketch {
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return &QuantileSketch{
+		gamma:    gamma,
+		logGamma: math.Log(gamma),
+		positive: make(map[int]int64),
+		negative: make(map[int]int64),
+	}
+}
+
+// The values closer to zero than this are counted as zeroes
+const sketchMinValue = 1e-9
+
+func (s *QuantileSketch) bucket(val float64) int {
+	return int(math.Ceil(math.Log(val) / s.logGamma))
+}
+
+func (s *QuantileSketch) bucketValue(idx int) float64 {
+	return 2 * math.Pow(s.gamma, float64(idx)) / (s.gamma + 1)
+}
+
+func (s *QuantileSketch) Add(val float64) {
+	switch {
+	case val > sketchMinValue:
+		s.positive[s.bucket(val)]++
+	case val < -sketchMinValue:
+		s.negative[s.bucket(-val)]++
+	default:
+		s.zeroCount++
+	}
+	s.count++
+}
+
+func (s *QuantileSketch) Count() int64 {
+	return s.count
+}
+
+// Merge the other sketch, the accuracies must be the same
+func (s *QuantileSketch) Merge(other *QuantileSketch) {
+	for k, v := range other.positive {
+		s.positive[k] += v
+	}
+	for k, v := range other.negative {
+		s.negative[k] += v
+	}
+	s.zeroCount += other.zeroCount
+	s.count += other.count
+}
+
+func (s *QuantileSketch) Copy() *QuantileSketch {
+	res := *s
+	res.positive = make(map[int]int64, len(s.positive))
+	for k, v := range s.positive {
+		res.positive[k] = v
+	}
+	res.negative = make(map[int]int64, len(s.negative))
+	for k, v := range s.negative {
+		res.negative[k] = v
+	}
+	return &res
+}
+
+// Iterate over the sketch buckets in the value order, with the representative
+// values of the buckets and the number of values in them
+func (s *QuantileSketch) ForEach(fn func(val float64, count int64)) {
+	negKeys := sortedKeys(s.negative)
+	for i := len(negKeys) - 1; i >= 0; i-- {
+		fn(-s.bucketValue(negKeys[i]), s.negative[negKeys[i]])
+	}
+	if s.zeroCount != 0 {
+		fn(0, s.zeroCount)
+	}
+	for _, k := range sortedKeys(s.positive) {
+		fn(s.bucketValue(k), s.positive[k])
+	}
+}
+
+// Get the approximate quantile (0..1), 0 for an empty sketch
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	rank := int64(math.Max(0, math.Min(1, q)) * float64(s.count-1))
+
+	// The negative values go from the largest magnitude
+	negKeys := sortedKeys(s.negative)
+	for i := len(negKeys) - 1; i >= 0; i-- {
+		rank -= s.negative[negKeys[i]]
+		if rank < 0 {
+			return -s.bucketValue(negKeys[i])
+		}
+	}
+	rank -= s.zeroCount
+	if rank < 0 {
+		return 0
+	}
+	posKeys := sortedKeys(s.positive)
+	for _, k := range posKeys {
+		rank -= s.positive[k]
+		if rank < 0 {
+			return s.bucketValue(k)
+		}
+	}
+	return s.bucketValue(posKeys[len(posKeys)-1])
+}
+
+func sortedKeys(buckets map[int]int64) []int {
+	res := make([]int, 0, len(buckets))
+	for k := range buckets {
+		res = append(res, k)
+	}
+	sort.Ints(res)
+	return res
+}
@@ -0,0 +1,76 @@
+package visibility
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestDistribution(t *testing.T) {
+	dist := NewDistribution(false)
+	_, ok := dist.Quantile(0.5)
+	assert.False(t, ok)
+	assert.Equal(t, 0.0, dist.Mean())
+
+	for _, v := range []float64{3, 1, 2} {
+		dist.Observe(v)
+	}
+	assert.Equal(t, &Distribution{Count: 3, Sum: 6, Min: 1, Max: 3}, dist)
+	assert.Equal(t, 2.0, dist.Mean())
+	_, ok = dist.Quantile(0.5)
+	assert.False(t, ok)
+
+	other := NewDistribution(false)
+	other.Observe(-5)
+	dist.Merge(other)
+	dist.Merge(NewDistribution(false))
+	assert.Equal(t, &Distribution{Count: 4, Sum: 1, Min: -5, Max: 3}, dist)
+}
+
+func TestDistributionSketch(t *testing.T) {
+	dist := NewDistribution(true)
+	for i := 1; i <= 1000; i++ {
+		dist.Observe(float64(i))
+	}
+
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		val, ok := dist.Quantile(q)
+		assert.True(t, ok)
+		expected := q*999 + 1
+		assert.True(t, math.Abs(val-expected) <= expected*DefaultSketchAccuracy*1.5,
+			"q=%f val=%f", q, val)
+	}
+	val, _ := dist.Quantile(0)
+	assert.Equal(t, 1.0, val)
+	val, _ = dist.Quantile(1)
+	assert.Equal(t, 1000.0, val)
+
+	// Merging into an empty distribution copies the sketch
+	merged := NewDistribution(true)
+	merged.Merge(dist)
+	merged.Merge(dist)
+	assert.Equal(t, int64(2000), merged.Sketch.Count())
+	val, _ = merged.Quantile(0.5)
+	assert.InDelta(t, 500, val, 10)
+	assert.Equal(t, int64(1000), dist.Sketch.Count())
+
+	// The sketch is lost if the other distribution doesn't have it
+	noSketch := NewDistribution(false)
+	noSketch.Observe(1)
+	merged.Merge(noSketch)
+	assert.Nil(t, merged.Sketch)
+}
+
+func TestQuantileSketchSigns(t *testing.T) {
+	sketch := NewQuantileSketch(0.01)
+	assert.Equal(t, 0.0, sketch.Quantile(0.5))
+
+	for _, v := range []float64{-100, -10, 0, 10, 100} {
+		sketch.Add(v)
+	}
+	assert.InDelta(t, -100, sketch.Quantile(0), 1)
+	assert.InDelta(t, -10, sketch.Quantile(0.25), 0.1)
+	assert.Equal(t, 0.0, sketch.Quantile(0.5))
+	assert.InDelta(t, 10, sketch.Quantile(0.75), 0.1)
+	assert.InDelta(t, 100, sketch.Quantile(1), 1)
+}
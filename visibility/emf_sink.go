@@ -0,0 +1,193 @@
+package visibility
+
+import (
+	"go.uber.org/zap"
+	"time"
+)
+
+// The limits of the CloudWatch metrics
+const (
+	MaxCloudWatchDimensions = 30
+	// Per one EMF document
+	maxEmfMetrics = 100
+	// Per one metric in the EMF document
+	maxEmfValues = 100
+)
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit,omitempty"`
+}
+
+// The value of a distribution without a sketch, each value is repeated
+// Counts times
+type emfValues struct {
+	Values []float64 `json:"Values"`
+	Counts []float64 `json:"Counts"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+// Writes the metrics as the CloudWatch Embedded Metric Format documents to
+// the log, the CloudWatch agent (or the Lambda runtime) extracts the metrics
+// from them. The operation name becomes the OperationNameKey dimension.
+// The metrics and the dimensions share the document fields, so the metrics
+// named like a dimension or the "_aws" metadata are dropped with a warning.
+type EmfMetricsSink struct {
+	Logger    *zap.Logger
+	Namespace string
+}
+
+var _ SketchingSink = &EmfMetricsSink{}
+
+func NewEmfMetricsSink(logger *zap.Logger) *EmfMetricsSink {
+	return &EmfMetricsSink{
+		Logger:    logger,
+		Namespace: MetricsNamespaceName,
+	}
+}
+
+// The distribution values are written using their sketches
+func (e *EmfMetricsSink) WantsSketches() bool {
+	return true
+}
+
+type emfGroup struct {
+	dims    Dimensions
+	metrics []emfMetric
+	values  []interface{}
+}
+
+func (e *EmfMetricsSink) SubmitSegmentMetrics(met *MetricsContext) {
+	met.Lock.Lock()
+	defer met.Lock.Unlock()
+
+	// The metrics with the same dimension values share the document
+	groups := make(map[string]*emfGroup)
+	var groupKeys []string
+	for key, val := range met.Metrics {
+		name, dims := met.exportedMetric(key, val)
+		if isEmfFieldTaken(name, dims) {
+			e.Logger.Warn("The metric name collides with an EMF document field",
+				zap.String("metric", name), zap.String("op", met.OpName))
+			continue
+		}
+		groupKey := MetricKey("", dims)
+		group := groups[groupKey]
+		if group == nil {
+			group = &emfGroup{dims: dims}
+			groups[groupKey] = group
+			groupKeys = append(groupKeys, groupKey)
+		}
+
+		group.metrics = append(group.metrics, emfMetric{Name: name, Unit: string(val.Unit)})
+		if val.Dist != nil {
+			group.values = append(group.values, makeEmfDistribution(val.Dist))
+		} else {
+			group.values = append(group.values, val.Val)
+		}
+	}
+
+	for _, k := range groupKeys {
+		group := groups[k]
+		for start := 0; start < len(group.metrics); start += maxEmfMetrics {
+			end := start + maxEmfMetrics
+			if end > len(group.metrics) {
+				end = len(group.metrics)
+			}
+			e.writeDocument(met.OpName, group.dims, group.metrics[start:end],
+				group.values[start:end])
+		}
+	}
+}
+
+func isEmfFieldTaken(name string, dims Dimensions) bool {
+	if name == "_aws" || name == OperationNameKey {
+		return true
+	}
+	_, ok := dims[name]
+	return ok
+}
+
+func (e *EmfMetricsSink) writeDocument(opName string, dims Dimensions,
+	metrics []emfMetric, values []interface{}) {
+
+	dimKeys := []string{OperationNameKey}
+	fields := []zap.Field{zap.String(OperationNameKey, opName)}
+	for _, k := range dims.sortedKeys() {
+		if len(dimKeys) == MaxCloudWatchDimensions || k == OperationNameKey {
+			continue
+		}
+		dimKeys = append(dimKeys, k)
+		fields = append(fields, zap.String(k, dims[k]))
+	}
+
+	for i, m := range metrics {
+		fields = append(fields, zap.Any(m.Name, values[i]))
+	}
+	fields = append(fields, zap.Any("_aws", emfMetadata{
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  e.Namespace,
+			Dimensions: [][]string{dimKeys},
+			Metrics:    metrics,
+		}},
+	}))
+
+	e.Logger.Info("Metrics", fields...)
+}
+
+// The EMF has no summaries. Without a sketch the mean is written with the
+// observation count, so CloudWatch gets the exact count and sum.
+func makeEmfDistribution(dist *Distribution) interface{} {
+	if dist.Sketch == nil || dist.Sketch.Count() == 0 {
+		return emfValues{
+			Values: []float64{dist.Mean()},
+			Counts: []float64{float64(dist.Count)},
+		}
+	}
+	return makeEmfValues(dist)
+}
+
+// The distribution is written as a list of the sketch bucket values. The
+// distributions with more than maxEmfValues observations are downsampled to
+// the values at the evenly spaced ranks, with the exact min and max at the
+// ends, so the percentiles computed by CloudWatch stay unbiased.
+func makeEmfValues(dist *Distribution) []float64 {
+	total := dist.Sketch.Count()
+	num := total
+	if num > maxEmfValues {
+		num = maxEmfValues
+	}
+	// The rank of the i-th value to keep, the first one and the last one
+	// are the smallest and the largest values
+	rank := func(i int64) int64 {
+		if num == 1 {
+			return 0
+		}
+		return i * (total - 1) / (num - 1)
+	}
+
+	res := make([]float64, 0, num)
+	var seen int64
+	dist.Sketch.ForEach(func(val float64, count int64) {
+		for int64(len(res)) < num && rank(int64(len(res))) < seen+count {
+			res = append(res, val)
+		}
+		seen += count
+	})
+
+	if len(res) != 0 && dist.Count == total {
+		res[0], res[len(res)-1] = dist.Min, dist.Max
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package visibility
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func readEmfDocuments(t *testing.T, sink *utils.MemorySink) []map[string]interface{} {
+	var res []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(sink.String()), "\n") {
+		doc := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal([]byte(line), &doc))
+		res = append(res, doc)
+	}
+	return res
+}
+
+func TestEmfMetricsSink(t *testing.T) {
+	logSink, logger := utils.NewMemorySinkLogger()
+	sink := NewEmfMetricsSink(logger)
+	assert.True(t, wantsSketches(sink))
+
+	met := &MetricsContext{OpName: "GetUser", Metrics: map[string]*MetricEntry{}}
+	met.AddCount("Calls", 2)
+	met.AddMetricWithDims("Calls", Dimensions{"table": "users"}, 1,
+		cloudwatch.StandardUnitCount)
+	met.ObserveMetric("Size", 10, cloudwatch.StandardUnitBytes)
+	met.ObserveMetric("Size", 20, cloudwatch.StandardUnitBytes)
+	sink.SubmitSegmentMetrics(met)
+
+	docs := readEmfDocuments(t, logSink)
+	assert.Equal(t, 2, len(docs))
+	for _, doc := range docs {
+		assert.Equal(t, "GetUser", doc[OperationNameKey])
+		meta := doc["_aws"].(map[string]interface{})
+		assert.True(t, meta["Timestamp"].(float64) > 0)
+		directive := meta["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		assert.Equal(t, MetricsNamespaceName, directive["Namespace"])
+
+		if doc["table"] == "users" {
+			assert.Equal(t, 1.0, doc["Calls"])
+			assert.Equal(t, []interface{}{[]interface{}{OperationNameKey, "table"}},
+				directive["Dimensions"])
+			assert.Equal(t, []interface{}{map[string]interface{}{
+				"Name": "Calls", "Unit": "Count"}}, directive["Metrics"])
+		} else {
+			assert.Equal(t, 2.0, doc["Calls"])
+			// No sketch, the mean is used
+			assert.Equal(t, map[string]interface{}{
+				"Values": []interface{}{15.0}, "Counts": []interface{}{2.0}},
+				doc["Size"])
+			assert.Equal(t, 2, len(directive["Metrics"].([]interface{})))
+		}
+	}
+}
+
+func TestEmfMetricsSinkFieldCollisions(t *testing.T) {
+	logSink, logger := utils.NewMemorySinkLogger()
+	sink := NewEmfMetricsSink(logger)
+
+	met := &MetricsContext{OpName: "Op", Metrics: map[string]*MetricEntry{}}
+	met.AddCount("Calls", 1)
+	met.AddCount("_aws", 1)
+	met.AddCount(OperationNameKey, 1)
+	met.AddMetricWithDims("table", Dimensions{"table": "users"}, 1,
+		cloudwatch.StandardUnitCount)
+	sink.SubmitSegmentMetrics(met)
+
+	// Only the valid metric is written, the rest are reported
+	docs := readEmfDocuments(t, logSink)
+	assert.Equal(t, 4, len(docs))
+	var metrics []string
+	for _, doc := range docs {
+		if doc["msg"] == "Metrics" {
+			directive := doc["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+			for _, m := range directive["Metrics"].([]interface{}) {
+				metrics = append(metrics, m.(map[string]interface{})["Name"].(string))
+			}
+			assert.Equal(t, 1.0, doc["Calls"])
+			assert.Equal(t, "Op", doc[OperationNameKey])
+		} else {
+			assert.Equal(t, "The metric name collides with an EMF document field",
+				doc["msg"])
+		}
+	}
+	assert.Equal(t, []string{"Calls"}, metrics)
+}
+
+func TestMakeEmfValues(t *testing.T) {
+	dist := NewDistribution(true)
+	for _, v := range []float64{3, 1, 2, 2} {
+		dist.Observe(v)
+	}
+	// All the values are kept for the small distributions
+	values := makeEmfValues(dist)
+	assert.Equal(t, 4, len(values))
+	assert.Equal(t, 1.0, values[0])
+	assert.InDelta(t, 2.0, values[1], 0.05)
+	assert.InDelta(t, 2.0, values[2], 0.05)
+	assert.Equal(t, 3.0, values[3])
+
+	assert.Empty(t, makeEmfValues(NewDistribution(true)))
+}
+
+func TestEmfMetricsSinkLimits(t *testing.T) {
+	logSink, logger := utils.NewMemorySinkLogger()
+	sink := NewEmfMetricsSink(logger)
+
+	met := &MetricsContext{OpName: "Op", Metrics: map[string]*MetricEntry{},
+		KeepSketches: true}
+	for i := 0; i < maxEmfMetrics+1; i++ {
+		met.AddCount(fmt.Sprintf("count%d", i), 1)
+	}
+	for i := 0; i < 1000; i++ {
+		met.ObserveMetric("dist", float64(i), cloudwatch.StandardUnitNone)
+	}
+	dims := Dimensions{}
+	for i := 0; i < MaxCloudWatchDimensions+5; i++ {
+		dims[fmt.Sprintf("dim%02d", i)] = "val"
+	}
+	met.SetMetricWithDims("wide", dims, 1, cloudwatch.StandardUnitNone)
+	sink.SubmitSegmentMetrics(met)
+
+	docs := readEmfDocuments(t, logSink)
+	assert.Equal(t, 3, len(docs))
+	for _, doc := range docs {
+		directive := doc["_aws"].(map[string]interface{})["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+		assert.True(t, len(directive["Metrics"].([]interface{})) <= maxEmfMetrics)
+		if doc["wide"] != nil {
+			dimSet := directive["Dimensions"].([]interface{})[0].([]interface{})
+			assert.Equal(t, MaxCloudWatchDimensions, len(dimSet))
+		}
+		if doc["dist"] != nil {
+			// Downsampled over the whole distribution, with the upper tail
+			values := doc["dist"].([]interface{})
+			assert.Equal(t, maxEmfValues, len(values))
+			assert.Equal(t, 0.0, values[0])
+			assert.InDelta(t, 500.0, values[maxEmfValues/2], 20)
+			assert.InDelta(t, 990.0, values[maxEmfValues-2], 20)
+			assert.Equal(t, 999.0, values[maxEmfValues-1])
+		}
+	}
+}
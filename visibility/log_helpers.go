@@ -17,20 +17,25 @@ type loggerKey struct {
 
 var loggerKeyVal = &loggerKey{}
 
+// Get the context logger, with the request attributes (if any) as the fields
 func CL(ctx context.Context) *zap.Logger {
 	value := ctx.Value(loggerKeyVal)
 	if value == nil {
 		panic("Trying to log from an unimbued context")
 	}
+	if attrs := GetRequestAttributes(ctx); attrs != nil {
+		return attrs.decorate(value.(*zap.Logger))
+	}
 	return value.(*zap.Logger)
 }
 
 func CLS(ctx context.Context) *zap.SugaredLogger {
-	value := ctx.Value(loggerKeyVal)
-	if value == nil {
-		panic("Trying to log from an unimbued context")
-	}
-	return value.(*zap.Logger).Sugar()
+	return CL(ctx).Sugar()
+}
+
+// Check if the context has a logger, CL and CLS panic otherwise
+func HasLogger(ctx context.Context) bool {
+	return ctx.Value(loggerKeyVal) != nil
 }
 
 func ImbueContext(ctx context.Context, logger *zap.Logger) context.Context {
@@ -74,3 +74,9 @@ func TestStackTrace(t *testing.T) {
 	// might break during refactorings
 	assert.True(t, strings.HasSuffix(res[0].Fl, "log_helpers_test.go:62"))
 }
+
+func TestHasLogger(t *testing.T) {
+	ctx := context.Background()
+	assert.False(t, HasLogger(ctx))
+	assert.True(t, HasLogger(ImbueContext(ctx, zap.NewNop())))
+}
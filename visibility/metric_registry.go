@@ -0,0 +1,250 @@
+package visibility
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+)
+
+type MetricKind string
+
+const (
+	MetricKindCount    MetricKind = "count"
+	MetricKindGauge    MetricKind = "gauge"
+	MetricKindDuration MetricKind = "duration"
+)
+
+// The declaration of a metric, the dimensions are the allowed per-metric
+// dimension keys (the context dimensions are not checked)
+type MetricDefinition struct {
+	Name        string                  `json:"name"`
+	Unit        cloudwatch.StandardUnit `json:"unit"`
+	Kind        MetricKind              `json:"kind"`
+	Description string                  `json:"description,omitempty"`
+	Dimensions  []string                `json:"dimensions,omitempty"`
+}
+
+// How the metric is recorded, checked against the declared kind
+type MetricRecording int
+
+const (
+	// AddMetric, the values are summed
+	RecordingAdd MetricRecording = iota
+	// SetMetric, the value is replaced
+	RecordingSet
+	// ObserveMetric, the values make a distribution
+	RecordingObserve
+)
+
+type ValidationMode int
+
+const (
+	ValidationOff ValidationMode = iota
+	// Log the violations, for the production
+	ValidationWarn
+	// Panic on the violations, for the tests
+	ValidationPanic
+)
+
+// The declared metrics of the service. The MetricsContext checks the
+// recorded metrics against it: the unit, the kind and the dimensions must
+// match the declaration.
+type MetricRegistry struct {
+	Mode ValidationMode
+	// Report the metrics that are not declared
+	RequireDeclared bool
+
+	logger     *zap.Logger
+	mtx        sync.Mutex
+	defs       map[string]*MetricDefinition
+	warned     map[string]bool
+	violations int64
+}
+
+// Used when the MetricsContext has no registry of its own, nil disables
+// the validation
+var DefaultMetricRegistry *MetricRegistry
+
+func NewMetricRegistry(mode ValidationMode, logger *zap.Logger) *MetricRegistry {
+	return &MetricRegistry{
+		Mode:   mode,
+		logger: logger,
+		defs:   make(map[string]*MetricDefinition),
+		warned: make(map[string]bool),
+	}
+}
+
+func checkDefinition(def *MetricDefinition) error {
+	if def.Name == "" {
+		return fmt.Errorf("the metric name is empty")
+	}
+	if _, ok := unitInfos[def.Unit]; !ok {
+		return fmt.Errorf("metric %s has an unknown unit %s", def.Name, def.Unit)
+	}
+
+	switch def.Kind {
+	case MetricKindCount:
+		if def.Unit != cloudwatch.StandardUnitCount {
+			return fmt.Errorf("count %s must have the Count unit", def.Name)
+		}
+	case MetricKindDuration:
+		if GetUnitDimension(def.Unit) != DimensionTime {
+			return fmt.Errorf("duration %s must have a time unit", def.Name)
+		}
+	case MetricKindGauge:
+	default:
+		return fmt.Errorf("metric %s has an unknown kind %s", def.Name, def.Kind)
+	}
+	return nil
+}
+
+// Declare the metrics, the names must be unique
+func (r *MetricRegistry) Register(defs ...MetricDefinition) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for i := range defs {
+		def := defs[i]
+		if err := checkDefinition(&def); err != nil {
+			return err
+		}
+		if r.defs[def.Name] != nil {
+			return fmt.Errorf("metric %s is already registered", def.Name)
+		}
+		def.Dimensions = append([]string{}, def.Dimensions...)
+		r.defs[def.Name] = &def
+	}
+	return nil
+}
+
+func (r *MetricRegistry) MustRegister(defs ...MetricDefinition) {
+	err := r.Register(defs...)
+	if err != nil {
+		panic(err.Error())
+	}
+}
+
+func (r *MetricRegistry) Lookup(name string) (MetricDefinition, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	def := r.defs[name]
+	if def == nil {
+		return MetricDefinition{}, false
+	}
+	return *def, true
+}
+
+// The number of the violations so far, including the repeated ones
+func (r *MetricRegistry) Violations() int64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.violations
+}
+
+// Check the recorded metric against its declaration, the counts can't be
+// distributions and the gauges can't be summed
+func (r *MetricRegistry) Validate(name string, dims Dimensions,
+	unit cloudwatch.StandardUnit, recording MetricRecording) error {
+
+	r.mtx.Lock()
+	def := r.defs[name]
+	r.mtx.Unlock()
+
+	if def == nil {
+		if r.RequireDeclared {
+			return fmt.Errorf("metric %s is not declared", name)
+		}
+		return nil
+	}
+
+	if unit != def.Unit {
+		return fmt.Errorf("metric %s has the unit %s, declared %s", name, unit, def.Unit)
+	}
+	if recording == RecordingObserve && def.Kind == MetricKindCount {
+		return fmt.Errorf("count %s can't be a distribution", name)
+	}
+	if recording == RecordingAdd && def.Kind == MetricKindGauge {
+		return fmt.Errorf("gauge %s can't be added to", name)
+	}
+	for _, k := range dims.sortedKeys() {
+		if !containsString(def.Dimensions, k) {
+			return fmt.Errorf("metric %s has an undeclared dimension %s", name, k)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate the metric and handle the violation according to the mode, each
+// distinct violation is logged once
+func (r *MetricRegistry) check(name string, dims Dimensions,
+	unit cloudwatch.StandardUnit, recording MetricRecording) {
+
+	if r.Mode == ValidationOff {
+		return
+	}
+	err := r.Validate(name, dims, unit, recording)
+	if err == nil {
+		return
+	}
+	if r.Mode == ValidationPanic {
+		panic(err.Error())
+	}
+	r.warn(err)
+}
+
+// Count the violation and log it if it's new
+func (r *MetricRegistry) warn(err error) {
+	r.mtx.Lock()
+	r.violations++
+	firstTime := !r.warned[err.Error()]
+	r.warned[err.Error()] = true
+	r.mtx.Unlock()
+
+	if firstTime {
+		r.logger.Warn("Metric schema violation", zap.Error(err))
+	}
+}
+
+type metricCatalogEntry struct {
+	MetricDefinition
+	// The unit of the exported values, see MetricEntry.Normalize
+	NormalizedUnit cloudwatch.StandardUnit `json:"normalizedUnit"`
+}
+
+type metricCatalog struct {
+	UnitVersion int                  `json:"unitVersion"`
+	Metrics     []metricCatalogEntry `json:"metrics"`
+}
+
+// Get the JSON catalog of the declared metrics sorted by name, to use when
+// building the dashboards
+func (r *MetricRegistry) Catalog() ([]byte, error) {
+	r.mtx.Lock()
+	catalog := metricCatalog{UnitVersion: UnitNormalizationVersion,
+		Metrics: make([]metricCatalogEntry, 0, len(r.defs))}
+	for _, def := range r.defs {
+		catalog.Metrics = append(catalog.Metrics, metricCatalogEntry{
+			MetricDefinition: *def,
+			NormalizedUnit:   getNormalizedUnit(def.Unit),
+		})
+	}
+	r.mtx.Unlock()
+
+	sort.Slice(catalog.Metrics, func(i, j int) bool {
+		return catalog.Metrics[i].Name < catalog.Metrics[j].Name
+	})
+	return json.MarshalIndent(catalog, "", "  ")
+}
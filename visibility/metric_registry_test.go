@@ -0,0 +1,181 @@
+package visibility
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestRegistry(mode ValidationMode) (*utils.MemorySink, *MetricRegistry) {
+	logSink, logger := utils.NewMemorySinkLogger()
+	reg := NewMetricRegistry(mode, logger)
+	reg.MustRegister(
+		MetricDefinition{Name: "calls", Unit: cloudwatch.StandardUnitCount,
+			Kind: MetricKindCount, Description: "The calls", Dimensions: []string{"table"}},
+		MetricDefinition{Name: "latency", Unit: cloudwatch.StandardUnitMilliseconds,
+			Kind: MetricKindDuration},
+		MetricDefinition{Name: "size", Unit: cloudwatch.StandardUnitKilobytes,
+			Kind: MetricKindGauge})
+	return logSink, reg
+}
+
+func TestMetricRegistration(t *testing.T) {
+	_, reg := makeTestRegistry(ValidationPanic)
+
+	def, ok := reg.Lookup("calls")
+	assert.True(t, ok)
+	assert.Equal(t, "The calls", def.Description)
+	_, ok = reg.Lookup("nope")
+	assert.False(t, ok)
+
+	tests := []struct {
+		def MetricDefinition
+		err string
+	}{
+		{MetricDefinition{Name: "calls", Unit: cloudwatch.StandardUnitCount,
+			Kind: MetricKindCount}, "already registered"},
+		{MetricDefinition{Unit: cloudwatch.StandardUnitCount,
+			Kind: MetricKindCount}, "name is empty"},
+		{MetricDefinition{Name: "bad", Unit: cloudwatch.StandardUnitBytes,
+			Kind: MetricKindCount}, "must have the Count unit"},
+		{MetricDefinition{Name: "bad", Unit: cloudwatch.StandardUnitCount,
+			Kind: MetricKindDuration}, "must have a time unit"},
+		{MetricDefinition{Name: "bad", Unit: "Furlongs",
+			Kind: MetricKindGauge}, "unknown unit"},
+		{MetricDefinition{Name: "bad", Unit: cloudwatch.StandardUnitCount,
+			Kind: "histogram"}, "unknown kind"},
+	}
+	for _, tt := range tests {
+		err := reg.Register(tt.def)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), tt.err)
+	}
+}
+
+func TestMetricValidation(t *testing.T) {
+	_, reg := makeTestRegistry(ValidationPanic)
+
+	tests := []struct {
+		name      string
+		dims      Dimensions
+		unit      cloudwatch.StandardUnit
+		recording MetricRecording
+		err       string
+	}{
+		{"calls", Dimensions{"table": "users"}, cloudwatch.StandardUnitCount,
+			RecordingAdd, ""},
+		{"calls", nil, cloudwatch.StandardUnitCount, RecordingSet, ""},
+		{"latency", nil, cloudwatch.StandardUnitMilliseconds, RecordingObserve, ""},
+		{"latency", nil, cloudwatch.StandardUnitMilliseconds, RecordingAdd, ""},
+		{"size", nil, cloudwatch.StandardUnitKilobytes, RecordingSet, ""},
+		{"size", nil, cloudwatch.StandardUnitKilobytes, RecordingObserve, ""},
+		{"undeclared", nil, cloudwatch.StandardUnitCount, RecordingAdd, ""},
+		{"calls", nil, cloudwatch.StandardUnitBytes, RecordingAdd, "has the unit Bytes"},
+		{"calls", nil, cloudwatch.StandardUnitCount, RecordingObserve,
+			"can't be a distribution"},
+		{"size", nil, cloudwatch.StandardUnitKilobytes, RecordingAdd,
+			"can't be added to"},
+		{"calls", Dimensions{"user": "1"}, cloudwatch.StandardUnitCount, RecordingAdd,
+			"undeclared dimension user"},
+	}
+	for _, tt := range tests {
+		err := reg.Validate(tt.name, tt.dims, tt.unit, tt.recording)
+		if tt.err == "" {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.Error(t, err, tt.name)
+			assert.Contains(t, err.Error(), tt.err)
+		}
+	}
+
+	reg.RequireDeclared = true
+	assert.Error(t, reg.Validate("undeclared", nil, cloudwatch.StandardUnitCount,
+		RecordingAdd))
+}
+
+func TestMetricsContextValidation(t *testing.T) {
+	_, reg := makeTestRegistry(ValidationPanic)
+	ctx := MakeMetricContext(context.Background(), "TestOp")
+	met := GetMetricsFromContext(ctx)
+	met.Registry = reg
+
+	met.AddCount("calls", 1)
+	met.ObserveMetric("latency", 2, cloudwatch.StandardUnitMilliseconds)
+	assert.Panics(t, func() { met.SetMetric("size", 1, cloudwatch.StandardUnitBytes) })
+	assert.Panics(t, func() { met.ObserveMetric("calls", 1, cloudwatch.StandardUnitCount) })
+
+	// The child scopes inherit the registry
+	child := GetMetricsFromContext(MakeChildMetricContext(ctx, "Child"))
+	assert.Panics(t, func() {
+		child.AddMetricWithDims("calls", Dimensions{"user": "1"}, 1,
+			cloudwatch.StandardUnitCount)
+	})
+
+	// The warnings are logged once
+	logSink, warnReg := makeTestRegistry(ValidationWarn)
+	met.Registry = warnReg
+	met.SetMetric("size", 1, cloudwatch.StandardUnitBytes)
+	met.SetMetric("size", 2, cloudwatch.StandardUnitBytes)
+	assert.Equal(t, 2.0, met.GetMetricVal("size"))
+	assert.Equal(t, int64(2), warnReg.Violations())
+	assert.Equal(t, 1, strings.Count(logSink.String(), "Metric schema violation"))
+
+	met.Registry = NewMetricRegistry(ValidationOff, zap.NewNop())
+	met.Registry.RequireDeclared = true
+	assert.NotPanics(t, func() { met.AddCount("whatever", 1) })
+}
+
+func TestMetricConflicts(t *testing.T) {
+	met := GetMetricsFromContext(MakeMetricContext(context.Background(), "TestOp"))
+	met.AddCount("count", 1)
+	met.ObserveDuration("dist", time.Second)
+
+	// No registry, the conflicts panic
+	assert.Panics(t, func() { met.AddMetric("count", 1, cloudwatch.StandardUnitBytes) })
+	assert.Panics(t, func() { met.AddCount("dist", 1) })
+	assert.Panics(t, func() { met.ObserveMetric("count", 1, cloudwatch.StandardUnitCount) })
+
+	_, met.Registry = makeTestRegistry(ValidationPanic)
+	assert.Panics(t, func() { met.AddMetric("count", 1, cloudwatch.StandardUnitBytes) })
+
+	// The warnings keep the first value
+	logSink, warnReg := makeTestRegistry(ValidationWarn)
+	met.Registry = warnReg
+	assert.NotPanics(t, func() {
+		met.AddMetric("count", 1, cloudwatch.StandardUnitBytes)
+		met.AddMetric("count", 1, cloudwatch.StandardUnitBytes)
+		met.AddCount("dist", 1)
+		met.ObserveMetric("count", 1, cloudwatch.StandardUnitCount)
+	})
+	val, unit := met.GetMetric("count")
+	assert.Equal(t, 1.0, val)
+	assert.Equal(t, cloudwatch.StandardUnitCount, unit)
+	assert.Equal(t, int64(1), met.GetDistribution("dist").Count)
+	assert.Equal(t, int64(4), warnReg.Violations())
+	assert.Equal(t, 3, strings.Count(logSink.String(), "Metric schema violation"))
+	assert.Contains(t, logSink.String(), "inconsistent unit assignment, was Count want Bytes")
+}
+
+func TestMetricCatalog(t *testing.T) {
+	_, reg := makeTestRegistry(ValidationWarn)
+	data, err := reg.Catalog()
+	assert.NoError(t, err)
+
+	var catalog map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &catalog))
+	assert.Equal(t, float64(UnitNormalizationVersion), catalog["unitVersion"])
+
+	metrics := catalog["metrics"].([]interface{})
+	assert.Equal(t, 3, len(metrics))
+	assert.Equal(t, map[string]interface{}{"name": "calls", "unit": "Count",
+		"kind": "count", "description": "The calls", "dimensions": []interface{}{"table"},
+		"normalizedUnit": "Count"}, metrics[0])
+	assert.Equal(t, "Microseconds", metrics[1].(map[string]interface{})["normalizedUnit"])
+	assert.Equal(t, "size", metrics[2].(map[string]interface{})["name"])
+}
@@ -0,0 +1,84 @@
+package visibility
+
+import (
+	"context"
+	. "github.com/aurorasolar/go-service-nr-base/utils"
+)
+
+func HasMetrics(ctx context.Context) bool {
+	_, ok := ctx.Value(MetricsContextKey).(*MetricsContext)
+	return ok
+}
+
+// Create a child scope for the sub-operation, or the root scope if the
+// context has no metrics. The child's op name is prefixed with its parent's
+// (Parent.name), and its metrics are submitted separately. The child
+// inherits the dimensions, the guard and the roll-up setting of the parent.
+func MakeChildMetricContext(ctx context.Context, name string) context.Context {
+	parent, ok := ctx.Value(MetricsContextKey).(*MetricsContext)
+	if !ok {
+		return MakeMetricContext(ctx, name)
+	}
+
+	parent.Lock.Lock()
+	defer parent.Lock.Unlock()
+
+	scope := name
+	if parent.Scope != "" {
+		scope = parent.Scope + "." + name
+	}
+	return context.WithValue(ctx, MetricsContextKey,
+		&MetricsContext{
+			OpName:         parent.OpName + "." + name,
+			Metrics:        map[string]*MetricEntry{},
+			KeepSketches:   parent.KeepSketches,
+			Dimensions:     MergeDimensions(parent.Dimensions),
+			Guard:          parent.Guard,
+			Registry:       parent.Registry,
+			Attributes:     parent.Attributes,
+			Parent:         parent,
+			Scope:          scope,
+			RollUp:         parent.RollUpChildren,
+			RollUpChildren: parent.RollUpChildren,
+		})
+}
+
+// Add the metrics of the child scope to its parent if RollUp is set. The
+// scalars are added up, and the distributions are merged. The metrics keep
+// their names, so the parent's metric includes the child's.
+func (m *MetricsContext) RollUpToParent() {
+	if m.Parent == nil || !m.RollUp {
+		return
+	}
+
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	parent := m.Parent
+	parent.Lock.Lock()
+	defer parent.Lock.Unlock()
+
+	for key, val := range m.Metrics {
+		curVal := parent.Metrics[key]
+		if curVal == nil {
+			copied := *val
+			copied.Dimensions = MergeDimensions(val.Dimensions)
+			if val.Dist != nil {
+				copied.Dist = val.Dist.Copy()
+			}
+			parent.Metrics[key] = &copied
+			continue
+		}
+
+		PanicIfF(curVal.Unit != val.Unit, "inconsistent unit assignment, was %s want %s",
+			curVal.Unit, val.Unit)
+		PanicIfF((curVal.Dist == nil) != (val.Dist == nil),
+			"metric %s is a distribution in one scope only", key)
+		if val.Dist != nil {
+			curVal.Dist.Merge(val.Dist)
+			curVal.Val = curVal.Dist.Sum
+		} else {
+			curVal.Val += val.Val
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func TestChildMetricScopes(t *testing.T) {
+	// No parent, so this is the root scope
+	ctx := MakeChildMetricContext(context.Background(), "Root")
+	root := GetMetricsFromContext(ctx)
+	assert.Equal(t, "Root", root.OpName)
+	assert.Nil(t, root.Parent)
+	root.SetDimension("tier", "pro")
+	root.RollUpChildren = true
+	root.AddCount("calls", 1)
+	root.ObserveMetric("latency", 1, cloudwatch.StandardUnitSeconds)
+
+	childCtx := MakeChildMetricContext(ctx, "Child")
+	child := GetMetricsFromContext(childCtx)
+	assert.Equal(t, "Root.Child", child.OpName)
+	assert.Equal(t, "Child", child.Scope)
+	assert.Equal(t, "pro", child.Dimensions["tier"])
+	assert.True(t, child.RollUp)
+	child.AddCount("calls", 2)
+	child.AddCount("childcalls", 3)
+	child.ObserveMetric("latency", 3, cloudwatch.StandardUnitSeconds)
+
+	grandCtx := MakeChildMetricContext(childCtx, "Grand")
+	grand := GetMetricsFromContext(grandCtx)
+	assert.Equal(t, "Root.Child.Grand", grand.OpName)
+	assert.Equal(t, "Child.Grand", grand.Scope)
+	grand.RollUp = false
+	grand.AddCount("calls", 100)
+	grand.RollUpToParent()
+	assert.Equal(t, 2.0, child.GetMetricVal("calls"))
+
+	child.RollUpToParent()
+	assert.Equal(t, 3.0, root.GetMetricVal("calls"))
+	assert.Equal(t, 3.0, root.GetMetricVal("childcalls"))
+	assert.Equal(t, int64(2), root.GetDistribution("latency").Count)
+	assert.Equal(t, 4.0, root.GetMetricVal("latency"))
+	// The child's own metrics are unchanged
+	assert.Equal(t, 2.0, child.GetMetricVal("calls"))
+
+	// The inconsistent metrics can't be rolled up
+	child.Reset()
+	child.AddMetric("calls", 1, cloudwatch.StandardUnitBytes)
+	assert.Panics(t, child.RollUpToParent)
+}
+
+func TestNestedRunInstrumented(t *testing.T) {
+	app := makeTestApp()
+	sink := &recordingSink{}
+
+	// The OAPI interceptor creates the root scope for the request
+	ctx := MakeMetricContext(context.Background(), "Request")
+	root := GetMetricsFromContext(ctx)
+	root.RollUpChildren = true
+
+	err := RunInstrumented(ctx, "Outer", app, sink, zap.NewNop(),
+		func(c context.Context) error {
+			GetMetricsFromContext(c).AddCount("calls", 1)
+			return RunInstrumented(c, "Inner", app, sink, zap.NewNop(),
+				func(c context.Context) error {
+					GetMetricsFromContext(c).AddCount("calls", 2)
+					return nil
+				})
+		})
+	assert.NoError(t, err)
+
+	// The scopes are submitted separately, the innermost first
+	assert.Equal(t, []string{"Request.Outer.Inner", "Request.Outer"}, sink.getOps())
+	assert.Equal(t, 3.0, root.GetMetricVal("calls"))
+
+	// The inner scope shares the transaction, its attributes are prefixed.
+	// The outer scope has the inner's calls rolled up.
+	evt := getEvt(getMetrics(app), 1)
+	assert.Equal(t, 3.0, evt["Outer.calls"])
+	assert.Equal(t, 2.0, evt["Outer.Inner.calls"])
+}
@@ -2,6 +2,7 @@ package visibility
 
 import (
 	"context"
+	"fmt"
 	. "github.com/aurorasolar/go-service-nr-base/utils"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	newrelic "github.com/newrelic/go-agent"
@@ -18,73 +19,57 @@ type MetricsContext struct {
 	Lock    sync.Mutex
 	OpName  string
 	Metrics map[string]*MetricEntry
+	// Keep the quantile sketches for the distribution metrics
+	KeepSketches bool
+	// The dimensions of all the metrics in the context
+	Dimensions Dimensions
+	// The cardinality guard for the exported dimensions, the
+	// DefaultCardinalityGuard is used if it's nil
+	Guard *CardinalityGuard
+	// The declared metrics to validate against, the DefaultMetricRegistry
+	// is used if it's nil
+	Registry *MetricRegistry
+	// The request attributes that become the dimensions of all the metrics
+	Attributes *RequestAttributes
+
+	// The parent of the child scope, nil for the root scope
+	Parent *MetricsContext
+	// The name of the child scope relative to the root scope, it prefixes the
+	// transaction attributes. Empty for the root scope.
+	Scope string
+	// Add the metrics to the parent when the child scope is done
+	RollUp bool
+	// The default RollUp of the child scopes
+	RollUpChildren bool
 }
 
 type MetricEntry struct {
 	Val       float64
 	Unit      cloudwatch.StandardUnit
 	Timestamp time.Time
+	// The observations of a distribution metric, the Val is their sum
+	Dist *Distribution
+	// The metric name without the dimensions, the Metrics map key is used
+	// if it's empty
+	Name       string
+	Dimensions Dimensions
 }
 
 // Normalize unit to use the smallest possible unit: microsecond, bit, byte
 func (e MetricEntry) Normalize() (float64, cloudwatch.StandardUnit) {
-	switch e.Unit {
-	case cloudwatch.StandardUnitSeconds:
-		return e.Val * 10e6, cloudwatch.StandardUnitMicroseconds
-	case cloudwatch.StandardUnitMicroseconds:
-		return e.Val, cloudwatch.StandardUnitMicroseconds
-	case cloudwatch.StandardUnitMilliseconds:
-		return e.Val * 10e3, cloudwatch.StandardUnitMicroseconds
-	case cloudwatch.StandardUnitBytes:
-		return e.Val, cloudwatch.StandardUnitBytes
-	case cloudwatch.StandardUnitKilobytes:
-		return e.Val * 1024, cloudwatch.StandardUnitBytes
-	case cloudwatch.StandardUnitMegabytes:
-		return e.Val * 1024 * 1024, cloudwatch.StandardUnitBytes
-	case cloudwatch.StandardUnitGigabytes:
-		return e.Val * 1024 * 1024 * 1024, cloudwatch.StandardUnitBytes
-	case cloudwatch.StandardUnitTerabytes:
-		return e.Val * 1024 * 1024 * 1024 * 1024, cloudwatch.StandardUnitBytes
-	case cloudwatch.StandardUnitBits:
-		return e.Val, cloudwatch.StandardUnitBits
-	case cloudwatch.StandardUnitKilobits:
-		return e.Val * 1024, cloudwatch.StandardUnitBits
-	case cloudwatch.StandardUnitMegabits:
-		return e.Val * 1024 * 1024, cloudwatch.StandardUnitBits
-	case cloudwatch.StandardUnitGigabits:
-		return e.Val * 1024 * 1024 * 1024, cloudwatch.StandardUnitBits
-	case cloudwatch.StandardUnitTerabits:
-		return e.Val * 1024 * 1024 * 1024 * 1024, cloudwatch.StandardUnitBits
-	case cloudwatch.StandardUnitPercent:
-		return e.Val, cloudwatch.StandardUnitPercent
-	case cloudwatch.StandardUnitCount:
-		return e.Val, cloudwatch.StandardUnitCount
-	case cloudwatch.StandardUnitBytesSecond:
-		return e.Val, cloudwatch.StandardUnitBytesSecond
-	case cloudwatch.StandardUnitKilobytesSecond:
-		return e.Val * 1024, cloudwatch.StandardUnitBytesSecond
-	case cloudwatch.StandardUnitMegabytesSecond:
-		return e.Val * 1024 * 1024, cloudwatch.StandardUnitBytesSecond
-	case cloudwatch.StandardUnitGigabytesSecond:
-		return e.Val * 1024 * 1024 * 1024, cloudwatch.StandardUnitBytesSecond
-	case cloudwatch.StandardUnitTerabytesSecond:
-		return e.Val * 1024 * 1024 * 1024 * 1024, cloudwatch.StandardUnitBytesSecond
-	case cloudwatch.StandardUnitBitsSecond:
-		return e.Val, cloudwatch.StandardUnitBitsSecond
-	case cloudwatch.StandardUnitKilobitsSecond:
-		return e.Val * 1024, cloudwatch.StandardUnitBitsSecond
-	case cloudwatch.StandardUnitMegabitsSecond:
-		return e.Val * 1024 * 1024, cloudwatch.StandardUnitBitsSecond
-	case cloudwatch.StandardUnitGigabitsSecond:
-		return e.Val * 1024 * 1024 * 1024, cloudwatch.StandardUnitBitsSecond
-	case cloudwatch.StandardUnitTerabitsSecond:
-		return e.Val * 1024 * 1024 * 1024 * 1024, cloudwatch.StandardUnitBitsSecond
-	case cloudwatch.StandardUnitCountSecond:
-		return e.Val, cloudwatch.StandardUnitCountSecond
-	case cloudwatch.StandardUnitNone:
-		return e.Val, cloudwatch.StandardUnitNone
-	}
-	return e.Val, cloudwatch.StandardUnitNone
+	normUnit := getNormalizedUnit(e.Unit)
+	factor, err := GetConversionFactor(e.Unit, normUnit)
+	if err != nil {
+		// The unknown units are passed as is
+		return e.Val, normUnit
+	}
+	return e.Val * factor, normUnit
+}
+
+// The multiplier for the Normalize() conversion
+func (e MetricEntry) normalizeFactor() float64 {
+	factor, _ := MetricEntry{Val: 1, Unit: e.Unit}.Normalize()
+	return factor
 }
 
 func MakeMetricContext(ctx context.Context, opName string) context.Context {
@@ -92,8 +77,9 @@ func MakeMetricContext(ctx context.Context, opName string) context.Context {
 
 	return context.WithValue(ctx, MetricsContextKey,
 		&MetricsContext{
-			OpName:  opName,
-			Metrics: map[string]*MetricEntry{},
+			OpName:     opName,
+			Metrics:    map[string]*MetricEntry{},
+			Attributes: GetRequestAttributes(ctx),
 		})
 }
 
@@ -129,31 +115,121 @@ func (m *MetricsContext) GetMetricVal(name string) float64 {
 	return v
 }
 
+// Set the dimension for all the metrics in the context
+func (m *MetricsContext) SetDimension(key, value string) {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	if m.Dimensions == nil {
+		m.Dimensions = make(Dimensions)
+	}
+	m.Dimensions[key] = value
+}
+
 func (m *MetricsContext) AddMetric(name string, val float64, unit cloudwatch.StandardUnit) {
+	m.AddMetricWithDims(name, nil, val, unit)
+}
+
+// Add to the metric with the given dimensions, the metrics with different
+// dimensions are separate (see MetricKey).
+func (m *MetricsContext) AddMetricWithDims(name string, dims Dimensions,
+	val float64, unit cloudwatch.StandardUnit) {
+
+	m.validate(name, dims, unit, RecordingAdd)
+
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
-	curVal := m.Metrics[name]
+	key := MetricKey(name, dims)
+	curVal := m.Metrics[key]
 	if curVal == nil {
-		m.Metrics[name] = &MetricEntry{
-			Val:       val,
-			Unit:      unit,
-			Timestamp: time.Now(),
+		m.Metrics[key] = &MetricEntry{
+			Val:        val,
+			Unit:       unit,
+			Timestamp:  time.Now(),
+			Name:       name,
+			Dimensions: MergeDimensions(dims),
 		}
 		return
 	}
 
-	PanicIfF(curVal.Unit != unit, "inconsistent unit assignment, was %s want %s",
-		curVal.Unit, unit)
+	if curVal.Unit != unit {
+		m.conflict("inconsistent unit assignment, was %s want %s", curVal.Unit, unit)
+		return
+	}
+	if curVal.Dist != nil {
+		m.conflict("metric %s is a distribution", name)
+		return
+	}
 	curVal.Val += val
 }
 
+// Record an observation of the distribution metric, unlike AddMetric
+// this keeps the count, min and max of the values.
+func (m *MetricsContext) ObserveMetric(name string, val float64, unit cloudwatch.StandardUnit) {
+	m.ObserveMetricWithDims(name, nil, val, unit)
+}
+
+func (m *MetricsContext) ObserveMetricWithDims(name string, dims Dimensions,
+	val float64, unit cloudwatch.StandardUnit) {
+
+	m.validate(name, dims, unit, RecordingObserve)
+
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	key := MetricKey(name, dims)
+	curVal := m.Metrics[key]
+	if curVal == nil {
+		curVal = &MetricEntry{
+			Unit:       unit,
+			Timestamp:  time.Now(),
+			Dist:       NewDistribution(m.KeepSketches),
+			Name:       name,
+			Dimensions: MergeDimensions(dims),
+		}
+		m.Metrics[key] = curVal
+	}
+
+	if curVal.Unit != unit {
+		m.conflict("inconsistent unit assignment, was %s want %s", curVal.Unit, unit)
+		return
+	}
+	if curVal.Dist == nil {
+		m.conflict("metric %s is not a distribution", name)
+		return
+	}
+	curVal.Dist.Observe(val)
+	curVal.Val = curVal.Dist.Sum
+}
+
+// Get a copy of the distribution metric, nil if there's no such distribution
+func (m *MetricsContext) GetDistribution(name string) *Distribution {
+	m.Lock.Lock()
+	defer m.Lock.Unlock()
+
+	curVal := m.Metrics[name]
+	if curVal == nil || curVal.Dist == nil {
+		return nil
+	}
+	return curVal.Dist.Copy()
+}
+
 func (m *MetricsContext) SetMetric(name string, val float64, unit cloudwatch.StandardUnit) {
+	m.SetMetricWithDims(name, nil, val, unit)
+}
+
+func (m *MetricsContext) SetMetricWithDims(name string, dims Dimensions,
+	val float64, unit cloudwatch.StandardUnit) {
+
+	m.validate(name, dims, unit, RecordingSet)
+
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
-	ent := &MetricEntry{Val: val, Unit: unit, Timestamp: time.Now()}
-	m.Metrics[name] = ent
+	ent := &MetricEntry{Val: val, Unit: unit, Timestamp: time.Now(),
+		Name: name, Dimensions: MergeDimensions(dims)}
+	m.Metrics[MetricKey(name, dims)] = ent
 }
 
 func (m *MetricsContext) AddCount(name string, val float64) {
@@ -172,6 +248,10 @@ func (m *MetricsContext) SetDuration(name string, duration time.Duration) {
 	m.SetMetric(name, duration.Seconds(), cloudwatch.StandardUnitSeconds)
 }
 
+func (m *MetricsContext) ObserveDuration(name string, duration time.Duration) {
+	m.ObserveMetric(name, duration.Seconds(), cloudwatch.StandardUnitSeconds)
+}
+
 type TimeMeasurement struct {
 	parent *MetricsContext
 	name   string
@@ -190,44 +270,160 @@ func (t *TimeMeasurement) Done() {
 	t.parent.AddDuration(t.name, time.Now().Sub(t.start))
 }
 
+func (m *MetricsContext) registry() *MetricRegistry {
+	if m.Registry != nil {
+		return m.Registry
+	}
+	return DefaultMetricRegistry
+}
+
+func (m *MetricsContext) validate(name string, dims Dimensions,
+	unit cloudwatch.StandardUnit, recording MetricRecording) {
+
+	if registry := m.registry(); registry != nil {
+		registry.check(name, dims, unit, recording)
+	}
+}
+
+// The value conflicts with the existing metric. The registry in the warning
+// mode logs it and the value is dropped, otherwise it's a panic.
+func (m *MetricsContext) conflict(msg string, args ...interface{}) {
+	registry := m.registry()
+	if registry == nil || registry.Mode != ValidationWarn {
+		panic(fmt.Sprintf(msg, args...))
+	}
+	registry.warn(fmt.Errorf(msg, args...))
+}
+
+func (m *MetricsContext) attributeDimensions() Dimensions {
+	if m.Attributes == nil {
+		return nil
+	}
+	return m.Attributes.Dimensions()
+}
+
+func (m *MetricsContext) guard() *CardinalityGuard {
+	if m.Guard != nil {
+		return m.Guard
+	}
+	return DefaultCardinalityGuard
+}
+
+// Get the metric name and its guarded dimensions, merged with the context
+// dimensions. Must be called with the lock held.
+func (m *MetricsContext) exportedMetric(key string, val *MetricEntry) (
+	string, Dimensions) {
+
+	name := val.Name
+	if name == "" {
+		name = key
+	}
+	return name, m.guard().Apply(MergeDimensions(m.attributeDimensions(),
+		m.Dimensions, val.Dimensions))
+}
+
+// Copy the metrics to the transaction attributes. The context dimensions
+// become the attributes, and the values of the per-metric dimensions are
+// appended to the attribute name: name.value1.value2 (in the key order).
+// The child scopes share the transaction with their parents, so their
+// attribute names are prefixed by the scope name, and their context
+// dimensions are left to the root scope.
 func (m *MetricsContext) CopyToTransaction(trans newrelic.Transaction) {
+	if trans == nil {
+		return
+	}
+	m.CopyToSpan(&newRelicSpan{txn: trans})
+}
+
+// Copy the metrics to the span attributes, see CopyToTransaction
+func (m *MetricsContext) CopyToSpan(trans Span) {
+	if trans == nil {
+		return
+	}
+
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
-	for name, val := range m.Metrics {
+	if m.Scope == "" {
+		for k, v := range m.guard().Apply(m.Dimensions) {
+			trans.AddAttribute(k, v)
+		}
+	}
+	if len(m.Metrics) != 0 {
+		trans.AddAttribute(UnitVersionAttribute, UnitNormalizationVersion)
+	}
+
+	for key, val := range m.Metrics {
+		name := val.Name
+		if name == "" {
+			name = key
+		}
+		if m.Scope != "" {
+			name = m.Scope + "." + name
+		}
+		dims := m.guard().Apply(val.Dimensions)
+		for _, k := range dims.sortedKeys() {
+			name += "." + dims[k]
+		}
+
 		normVal, normUnit := val.Normalize()
-		_ = trans.AddAttribute(name, normVal)
-		_ = trans.AddAttribute(name+"Unit", string(normUnit))
-		_ = trans.AddAttribute(name+"OrigUnit", string(val.Unit))
+		trans.AddAttribute(name, normVal)
+		trans.AddAttribute(name+"Unit", string(normUnit))
+		trans.AddAttribute(name+"OrigUnit", string(val.Unit))
+		if val.Dist != nil {
+			trans.AddAttribute(name+"Count", val.Dist.Count)
+		}
 	}
 }
 
+func makeMetricAttributes(dims Dimensions, val *MetricEntry,
+	normUnit cloudwatch.StandardUnit) map[string]interface{} {
+
+	res := make(map[string]interface{}, len(dims)+3)
+	for k, v := range dims {
+		res[k] = v
+	}
+	res["Unit"] = string(normUnit)
+	res["OrigUnit"] = string(val.Unit)
+	res[UnitVersionAttribute] = UnitNormalizationVersion
+	return res
+}
+
+// Copy the metrics to the harvester, the dimensions become the metric
+// attributes.
 func (m *MetricsContext) CopyToHarvester(h *telemetry.Harvester) {
 	m.Lock.Lock()
 	defer m.Lock.Unlock()
 
-	for name, val := range m.Metrics {
+	for key, val := range m.Metrics {
 		normVal, normUnit := val.Normalize()
-
-		if val.Unit == cloudwatch.StandardUnitCount {
+		name, dims := m.exportedMetric(key, val)
+		attrs := makeMetricAttributes(dims, val, normUnit)
+
+		if val.Dist != nil {
+			factor := val.normalizeFactor()
+			h.RecordMetric(telemetry.Summary{
+				Name:       m.OpName + "_" + name,
+				Attributes: attrs,
+				Count:      float64(val.Dist.Count),
+				Sum:        val.Dist.Sum * factor,
+				Min:        val.Dist.Min * factor,
+				Max:        val.Dist.Max * factor,
+				Timestamp:  time.Now(),
+			})
+		} else if val.Unit == cloudwatch.StandardUnitCount {
 			h.RecordMetric(telemetry.Count{
-				Name: m.OpName + "_" + name,
-				Attributes: map[string]interface{}{
-					"Unit":     string(normUnit),
-					"OrigUnit": string(val.Unit),
-				},
-				Value:     normVal,
-				Timestamp: time.Now(),
+				Name:       m.OpName + "_" + name,
+				Attributes: attrs,
+				Value:      normVal,
+				Timestamp:  time.Now(),
 			})
 		} else {
 			h.RecordMetric(telemetry.Gauge{
-				Name: m.OpName + "_" + name,
-				Attributes: map[string]interface{}{
-					"Unit":     string(normUnit),
-					"OrigUnit": string(val.Unit),
-				},
-				Value:     normVal,
-				Timestamp: time.Now(),
+				Name:       m.OpName + "_" + name,
+				Attributes: attrs,
+				Value:      normVal,
+				Timestamp:  time.Now(),
 			})
 		}
 	}
@@ -2,27 +2,88 @@ package visibility
 
 import (
 	"context"
-	"github.com/aurorasolar/go-service-nr-base/utils"
+	"fmt"
 	"github.com/newrelic/newrelic-telemetry-sdk-go/telemetry"
+	"go.uber.org/zap"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DefaultMetricsSink struct {
-	Harvester *telemetry.Harvester
+	Harvester       *telemetry.Harvester
+	HarvestInterval time.Duration
+
+	logger        *zap.Logger
+	harvestErrors int64
+
+	// The harvests are serialized, so the errors reported by the harvester
+	// are collected by the harvest that caused them
+	harvestMtx sync.Mutex
+	errorsMtx  sync.Mutex
+	callErrors *[]string
+
+	stopAutoHarvest chan struct{}
+	autoHarvestDone chan struct{}
+	startOnce       sync.Once
 }
 
+var _ FlushingSink = &DefaultMetricsSink{}
+
 type MetricsSink interface {
 	SubmitSegmentMetrics(met *MetricsContext)
 }
 
+// The sinks that aggregate the distribution metrics over time can ask for the
+// quantile sketches to be kept
+type SketchingSink interface {
+	MetricsSink
+	WantsSketches() bool
+}
+
+func wantsSketches(sink MetricsSink) bool {
+	sketching, ok := sink.(SketchingSink)
+	return ok && sketching.WantsSketches()
+}
+
+// The sinks that buffer the metrics and can send them right away
+type FlushingSink interface {
+	MetricsSink
+	Flush(ctx context.Context) error
+}
+
+// The sinks with the background processes
+type startableSink interface {
+	Start(registry *ProcessRegistry)
+}
+
 type nullSink struct{
 }
 func (n *nullSink) SubmitSegmentMetrics(met *MetricsContext) {
 }
 var NullSink = &nullSink{}
 
+// How often the harvester sends the metrics to New Relic
+const DefaultHarvestInterval = 5 * time.Second
+
+// The harvest interval before the sink is started, overridden in the tests
+var autoHarvestInterval = DefaultHarvestInterval
+
+// Creates the sink that sends the metrics to New Relic. The harvester
+// errors are logged and counted, see HarvestErrors. The metrics are
+// harvested every DefaultHarvestInterval in the background until Start
+// hands the harvests over to the process registry.
 func NewMetricsSink(nrLicenseKey, appName string, suffix string,
-	client *http.Client) *DefaultMetricsSink {
+	client *http.Client, logger *zap.Logger) (*DefaultMetricsSink, error) {
+
+	sink := &DefaultMetricsSink{
+		HarvestInterval: DefaultHarvestInterval,
+		logger:          logger,
+		stopAutoHarvest: make(chan struct{}),
+		autoHarvestDone: make(chan struct{}),
+	}
 
 	harv, err := telemetry.NewHarvester(
 		telemetry.ConfigAPIKey(nrLicenseKey),
@@ -30,21 +91,110 @@ func NewMetricsSink(nrLicenseKey, appName string, suffix string,
 			if client != nil {
 				c.Client = client
 			}
+			c.ErrorLogger = sink.onHarvestError
 		},
+		// The harvester's own harvest routine can't be stopped, so the
+		// harvests are run by the sink instead
+		telemetry.ConfigHarvestPeriod(0),
 		telemetry.ConfigCommonAttributes(map[string]interface{}{
 			"app.name": appName,
 			"env":      suffix,
 		}))
-	utils.PanicIfF(err != nil, "Can't create the harvester")
+	if err != nil {
+		return nil, fmt.Errorf("can't create the harvester: %v", err)
+	}
+	sink.Harvester = harv
+	go sink.autoHarvest(autoHarvestInterval)
+
+	return sink, nil
+}
+
+func (m *DefaultMetricsSink) autoHarvest(interval time.Duration) {
+	defer close(m.autoHarvestDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// The errors are logged by onHarvestError
+			_ = m.SendMetrics(context.Background())
+		case <-m.stopAutoHarvest:
+			return
+		}
+	}
+}
+
+func (m *DefaultMetricsSink) onHarvestError(fields map[string]interface{}) {
+	atomic.AddInt64(&m.harvestErrors, 1)
+	zapFields := make([]zap.Field, 0, len(fields))
+	for k, v := range fields {
+		zapFields = append(zapFields, zap.Any(k, v))
+	}
+	m.logger.Error("Failed to harvest the metrics", zapFields...)
 
-	return &DefaultMetricsSink{Harvester: harv}
+	m.errorsMtx.Lock()
+	defer m.errorsMtx.Unlock()
+	if m.callErrors != nil {
+		*m.callErrors = append(*m.callErrors, fmt.Sprintf("%v", fields))
+	}
+}
+
+// The number of the harvester errors so far
+func (m *DefaultMetricsSink) HarvestErrors() int64 {
+	return atomic.LoadInt64(&m.harvestErrors)
 }
 
 func (m *DefaultMetricsSink) SubmitSegmentMetrics(met *MetricsContext) {
 	met.CopyToHarvester(m.Harvester)
 }
 
+// Send the metrics right away, the harvester errors are returned as well as
+// logged. The concurrent calls wait for each other.
 func (m *DefaultMetricsSink) SendMetrics(ctx context.Context) error {
+	m.harvestMtx.Lock()
+	defer m.harvestMtx.Unlock()
+
+	var errs []string
+	m.errorsMtx.Lock()
+	m.callErrors = &errs
+	m.errorsMtx.Unlock()
+
 	m.Harvester.HarvestNow(ctx)
+
+	m.errorsMtx.Lock()
+	m.callErrors = nil
+	m.errorsMtx.Unlock()
+
+	if len(errs) != 0 {
+		return fmt.Errorf("failed to harvest the metrics, %d errors: %s",
+			len(errs), strings.Join(errs, "; "))
+	}
 	return nil
 }
+
+func (m *DefaultMetricsSink) Flush(ctx context.Context) error {
+	return m.SendMetrics(ctx)
+}
+
+// Harvest the metrics periodically, and once more when the registry closes.
+// The background harvests started by NewMetricsSink are stopped, waiting
+// for the harvest in flight.
+func (m *DefaultMetricsSink) Start(registry *ProcessRegistry) {
+	m.startOnce.Do(func() {
+		close(m.stopAutoHarvest)
+		<-m.autoHarvestDone
+	})
+
+	harvestCtx := registry.CreateProcessContext("MetricsHarvest")
+	harvestCtx.RunPeriodicProcess(m.HarvestInterval, func(ctx context.Context) error {
+		// Closing the registry must not cancel the harvest in flight and drop
+		// the metrics, the harvester has its own timeout
+		return m.SendMetrics(context.Background())
+	})
+
+	finalCtx := registry.CreateProcessContext("MetricsFinalHarvest")
+	finalCtx.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		return m.SendMetrics(context.Background())
+	})
+}
@@ -0,0 +1,181 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type rejectingClient struct {
+}
+
+func (r *rejectingClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The forbidden status is not retried
+	return &http.Response{
+		Status:     "Forbidden",
+		StatusCode: http.StatusForbidden,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+// Rejects the first request once it's released, accepts the rest
+type blockingClient struct {
+	entered  chan struct{}
+	release  chan struct{}
+	requests int32
+}
+
+func (b *blockingClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&b.requests, 1) == 1 {
+		close(b.entered)
+		<-b.release
+		return (&rejectingClient{}).RoundTrip(req)
+	}
+	return &http.Response{
+		Status:     "Accepted",
+		StatusCode: http.StatusAccepted,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+type countingClient struct {
+	requests int32
+}
+
+func (c *countingClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&c.requests, 1)
+	return &http.Response{
+		Status:     "Accepted",
+		StatusCode: http.StatusAccepted,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+func (c *countingClient) count() int32 {
+	return atomic.LoadInt32(&c.requests)
+}
+
+func TestMetricsSinkConstructor(t *testing.T) {
+	_, err := NewMetricsSink("", "testApp", "Suffix", nil, zap.NewNop())
+	assert.Error(t, err)
+}
+
+func TestMetricsSinkLifecycle(t *testing.T) {
+	fc := &fakeClient{}
+	sink, err := NewMetricsSink("lic", "testApp", "Suffix",
+		&http.Client{Transport: fc}, zap.NewNop())
+	assert.NoError(t, err)
+
+	reg := NewProcessRegistryWithTracer("", zap.NewNop(), NoopTracer, NullSink)
+	sink.Start(reg)
+	assert.True(t, reg.HasProcess("MetricsHarvest"))
+	assert.True(t, reg.HasProcess("MetricsFinalHarvest"))
+
+	mctx := &MetricsContext{OpName: "TestOp", Metrics: map[string]*MetricEntry{}}
+	mctx.AddCount("calls", 3)
+	sink.SubmitSegmentMetrics(mctx)
+
+	// The metrics are harvested on close
+	reg.Close()
+	var found bool
+	for _, m := range fc.data["metrics"].([]interface{}) {
+		if m.(map[string]interface{})["name"] == "TestOp_calls" {
+			found = true
+		}
+	}
+	assert.True(t, found)
+	assert.Equal(t, int64(0), sink.HarvestErrors())
+}
+
+func TestMetricsSinkAutoHarvest(t *testing.T) {
+	autoHarvestInterval = 10 * time.Millisecond
+	defer func() {
+		autoHarvestInterval = DefaultHarvestInterval
+	}()
+
+	cc := &countingClient{}
+	sink, err := NewMetricsSink("lic", "testApp", "Suffix",
+		&http.Client{Transport: cc}, zap.NewNop())
+	assert.NoError(t, err)
+	submit := func() {
+		mctx := &MetricsContext{OpName: "TestOp", Metrics: map[string]*MetricEntry{}}
+		mctx.AddCount("calls", 3)
+		sink.SubmitSegmentMetrics(mctx)
+	}
+
+	// The metrics are harvested without the process registry
+	submit()
+	for cc.count() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The registry takes over the harvests
+	reg := NewProcessRegistryWithTracer("", zap.NewNop(), NoopTracer, NullSink)
+	sink.HarvestInterval = time.Hour
+	sink.Start(reg)
+	// The periodic process harvests right away
+	time.Sleep(50 * time.Millisecond)
+	sent := cc.count()
+	submit()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, sent, cc.count())
+
+	reg.Close()
+	assert.Equal(t, sent+1, cc.count())
+}
+
+func TestMetricsSinkErrors(t *testing.T) {
+	logSink, logger := utils.NewMemorySinkLogger()
+	sink, err := NewMetricsSink("lic", "testApp", "Suffix",
+		&http.Client{Transport: &rejectingClient{}}, logger)
+	assert.NoError(t, err)
+
+	mctx := &MetricsContext{OpName: "TestOp", Metrics: map[string]*MetricEntry{}}
+	mctx.AddCount("calls", 3)
+	sink.SubmitSegmentMetrics(mctx)
+
+	assert.Error(t, sink.SendMetrics(context.Background()))
+	assert.Equal(t, int64(1), sink.HarvestErrors())
+	assert.True(t, strings.Contains(logSink.String(), "Failed to harvest the metrics"))
+	assert.True(t, strings.Contains(logSink.String(), "403"))
+}
+
+func TestMetricsSinkConcurrentErrors(t *testing.T) {
+	bc := &blockingClient{entered: make(chan struct{}), release: make(chan struct{})}
+	sink, err := NewMetricsSink("lic", "testApp", "Suffix",
+		&http.Client{Transport: bc}, zap.NewNop())
+	assert.NoError(t, err)
+
+	submit := func() {
+		mctx := &MetricsContext{OpName: "TestOp", Metrics: map[string]*MetricEntry{}}
+		mctx.AddCount("calls", 3)
+		sink.SubmitSegmentMetrics(mctx)
+	}
+
+	submit()
+	firstRes := make(chan error)
+	go func() {
+		firstRes <- sink.SendMetrics(context.Background())
+	}()
+	<-bc.entered
+
+	// The second harvest starts while the first one is still failing
+	submit()
+	secondRes := make(chan error)
+	go func() {
+		secondRes <- sink.SendMetrics(context.Background())
+	}()
+	close(bc.release)
+
+	assert.Error(t, <-firstRes)
+	assert.NoError(t, <-secondRes)
+	assert.Equal(t, int64(1), sink.HarvestErrors())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&bc.requests))
+}
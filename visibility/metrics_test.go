@@ -9,6 +9,7 @@ import (
 	"github.com/aurorasolar/go-service-nr-base/utils"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -80,6 +81,120 @@ func TestMetricsContext(t *testing.T) {
 	assert.Equal(t, 0.0, mctx.GetMetricVal("zonk"))
 }
 
+func TestDistributionMetrics(t *testing.T) {
+	ctx := MakeMetricContext(context.Background(), "TestOp")
+	mctx := GetMetricsFromContext(ctx)
+
+	mctx.ObserveDuration("call", 100*time.Millisecond)
+	mctx.ObserveDuration("call", 300*time.Millisecond)
+	mctx.ObserveMetric("size", 10, cloudwatch.StandardUnitBytes)
+
+	dist := mctx.GetDistribution("call")
+	assert.Equal(t, int64(2), dist.Count)
+	assert.InDelta(t, 0.4, dist.Sum, 1e-9)
+	assert.InDelta(t, 0.1, dist.Min, 1e-9)
+	assert.InDelta(t, 0.3, dist.Max, 1e-9)
+	assert.Nil(t, dist.Sketch)
+	assert.InDelta(t, 0.4, mctx.GetMetricVal("call"), 1e-9)
+	assert.Nil(t, mctx.GetDistribution("nope"))
+
+	mctx.KeepSketches = true
+	mctx.ObserveMetric("sketched", 1, cloudwatch.StandardUnitCount)
+	assert.NotNil(t, mctx.GetDistribution("sketched").Sketch)
+
+	// The scalars and the distributions can't be mixed
+	assert.Panics(t, func() { mctx.AddMetric("size", 1, cloudwatch.StandardUnitBytes) })
+	mctx.SetCount("count", 1)
+	assert.Panics(t, func() { mctx.ObserveMetric("count", 1, cloudwatch.StandardUnitCount) })
+
+	fc := &fakeClient{}
+	sink, err := NewMetricsSink("lic", "testApp", "Suffix",
+		&http.Client{Transport: fc}, zap.NewNop())
+	assert.NoError(t, err)
+	sink.SubmitSegmentMetrics(mctx)
+	sink.Harvester.HarvestNow(ctx)
+
+	for _, m := range fc.data["metrics"].([]interface{}) {
+		mObj := m.(map[string]interface{})
+		if mObj["name"] != "TestOp_call" {
+			continue
+		}
+		assert.Equal(t, "summary", mObj["type"])
+		val := mObj["value"].(map[string]interface{})
+		assert.Equal(t, 2.0, val["count"])
+		assert.InDelta(t, 0.4*MetricEntry{Unit: cloudwatch.StandardUnitSeconds}.
+			normalizeFactor(), val["sum"], 1e-3)
+		assert.Equal(t, "Microseconds", mObj["attributes"].
+			(map[string]interface{})["Unit"])
+		return
+	}
+	assert.Fail(t, "failed to find the summary")
+}
+
+func TestDimensionalMetrics(t *testing.T) {
+	ctx := MakeMetricContext(context.Background(), "TestOp")
+	mctx := GetMetricsFromContext(ctx)
+	mctx.Guard = NewCardinalityGuard(1, OverflowDimensionValue)
+	// The first value seen is kept, the export order is random
+	mctx.Guard.Apply(Dimensions{"table": "users"})
+
+	mctx.SetDimension("tier", "pro")
+	mctx.AddCount("calls", 1)
+	mctx.AddMetricWithDims("calls", Dimensions{"table": "users"}, 2,
+		cloudwatch.StandardUnitCount)
+	mctx.AddMetricWithDims("calls", Dimensions{"table": "users"}, 3,
+		cloudwatch.StandardUnitCount)
+	mctx.SetMetricWithDims("calls", Dimensions{"table": "orders"}, 4,
+		cloudwatch.StandardUnitCount)
+	mctx.ObserveMetricWithDims("latency", Dimensions{"table": "users"}, 0.5,
+		cloudwatch.StandardUnitSeconds)
+
+	assert.Equal(t, 1.0, mctx.GetMetricVal("calls"))
+	assert.Equal(t, 5.0, mctx.GetMetricVal(MetricKey("calls",
+		Dimensions{"table": "users"})))
+
+	fc := &fakeClient{}
+	sink, err := NewMetricsSink("lic", "testApp", "Suffix",
+		&http.Client{Transport: fc}, zap.NewNop())
+	assert.NoError(t, err)
+	sink.SubmitSegmentMetrics(mctx)
+	sink.Harvester.HarvestNow(ctx)
+
+	counts := make(map[string]float64)
+	for _, m := range fc.data["metrics"].([]interface{}) {
+		mObj := m.(map[string]interface{})
+		attrs := mObj["attributes"].(map[string]interface{})
+		assert.Equal(t, "pro", attrs["tier"])
+		if mObj["name"] == "TestOp_calls" {
+			table, _ := attrs["table"].(string)
+			counts[table] += mObj["value"].(float64)
+		}
+	}
+	// The second table is over the limit
+	assert.Equal(t, map[string]float64{"": 1, "users": 5,
+		OverflowDimensionValue: 4}, counts)
+}
+
+func TestDimensionsInTransaction(t *testing.T) {
+	app := makeTestApp()
+
+	err := RunInstrumented(context.Background(), "test1", app,
+		NullSink, zap.NewNop(), func(c context.Context) error {
+			met := GetMetricsFromContext(c)
+			met.SetDimension("tier", "pro")
+			met.AddMetricWithDims("dimcount", Dimensions{"table": "users"}, 3,
+				cloudwatch.StandardUnitCount)
+			return nil
+		})
+	assert.NoError(t, err)
+
+	// The context dimensions become the attributes, and the per-metric
+	// dimension values are appended to the attribute names
+	evt := getEvt(getMetrics(app), 1)
+	assert.Equal(t, "pro", evt["tier"])
+	assert.Equal(t, float64(3), evt["dimcount.users"])
+}
+
 type fakeClient struct {
 	data map[string]interface{}
 }
@@ -118,7 +233,9 @@ func TestMetricsSubmission(t *testing.T) {
 
 	fc := &fakeClient{}
 	cli := &http.Client{Transport: fc}
-	sink := NewMetricsSink("lic", "testApp", "Suffix", cli)
+	sink, err := NewMetricsSink("lic", "testApp", "Suffix",
+		cli, zap.NewNop())
+	assert.NoError(t, err)
 	sink.SubmitSegmentMetrics(GetMetricsFromContext(ctx))
 	sink.Harvester.HarvestNow(ctx)
 
@@ -148,6 +265,8 @@ func TestMetricsSubmission(t *testing.T) {
 				assert.Equal(t, float64(i), mObj["value"])
 				assert.Equal(t, "Bytes", mObj["attributes"].
 					(map[string]interface{})["Unit"])
+				assert.Equal(t, float64(UnitNormalizationVersion), mObj["attributes"].
+					(map[string]interface{})[UnitVersionAttribute])
 				continue outer
 			}
 		}
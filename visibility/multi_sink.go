@@ -0,0 +1,204 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+// Sends the metrics to all the sinks. A panicking sink is logged and
+// skipped, so the other sinks still get the metrics.
+type FanOutSink struct {
+	Sinks []MetricsSink
+}
+
+var _ FlushingSink = &FanOutSink{}
+var _ SketchingSink = &FanOutSink{}
+
+func NewFanOutSink(sinks ...MetricsSink) *FanOutSink {
+	return &FanOutSink{Sinks: sinks}
+}
+
+func (f *FanOutSink) SubmitSegmentMetrics(met *MetricsContext) {
+	for _, s := range f.Sinks {
+		f.submit(s, met)
+	}
+}
+
+func (f *FanOutSink) submit(sink MetricsSink, met *MetricsContext) {
+	defer func() {
+		if p := recover(); p != nil {
+			zap.L().Error("The metrics sink has panicked",
+				zap.String("sink", fmt.Sprintf("%T", sink)),
+				zap.String("panic", fmt.Sprintf("%v", p)))
+		}
+	}()
+	sink.SubmitSegmentMetrics(met)
+}
+
+// The sketches are kept if any of the sinks wants them
+func (f *FanOutSink) WantsSketches() bool {
+	for _, s := range f.Sinks {
+		if wantsSketches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush the sinks that buffer the metrics, returns the first error
+func (f *FanOutSink) Flush(ctx context.Context) error {
+	var firstErr error
+	for _, s := range f.Sinks {
+		if flushing, ok := s.(FlushingSink); ok {
+			err := flushing.Flush(ctx)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Start the background processes of the sinks that have them
+func (f *FanOutSink) Start(registry *ProcessRegistry) {
+	for _, s := range f.Sinks {
+		if startable, ok := s.(startableSink); ok {
+			startable.Start(registry)
+		}
+	}
+}
+
+// The self-reported metrics of the AsyncSink
+const (
+	AsyncSinkDroppedMetric = "Dropped"
+	AsyncSinkPanicsMetric  = "Panics"
+)
+
+const (
+	DefaultAsyncSinkQueueSize      = 1000
+	DefaultAsyncSinkReportInterval = time.Minute
+)
+
+// Submits the metrics to the delegate sink in the background, so a slow
+// sink doesn't stall the requests. The metrics are dropped if the queue is
+// full, and the delegate panics are logged and counted instead of crashing
+// the process. The drop and the panic counts are periodically submitted to
+// the delegate itself, with the sink name as the op name.
+type AsyncSink struct {
+	Name     string
+	Delegate MetricsSink
+	// How often the drop and the panic counts are reported,
+	// DefaultAsyncSinkReportInterval if not set
+	ReportInterval time.Duration
+
+	queue    chan *MetricsContext
+	dropped  int64
+	panics   int64
+	reported [2]int64
+}
+
+var _ FlushingSink = &AsyncSink{}
+var _ SketchingSink = &AsyncSink{}
+
+func NewAsyncSink(name string, delegate MetricsSink, queueSize int) *AsyncSink {
+	return &AsyncSink{
+		Name:           name,
+		Delegate:       delegate,
+		ReportInterval: DefaultAsyncSinkReportInterval,
+		queue:          make(chan *MetricsContext, queueSize),
+	}
+}
+
+func (a *AsyncSink) SubmitSegmentMetrics(met *MetricsContext) {
+	select {
+	case a.queue <- met:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+func (a *AsyncSink) WantsSketches() bool {
+	return wantsSketches(a.Delegate)
+}
+
+func (a *AsyncSink) Dropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+func (a *AsyncSink) Panics() int64 {
+	return atomic.LoadInt64(&a.panics)
+}
+
+func (a *AsyncSink) submit(ctx context.Context, met *MetricsContext) {
+	defer func() {
+		if p := recover(); p != nil {
+			atomic.AddInt64(&a.panics, 1)
+			if HasLogger(ctx) {
+				CL(ctx).Error("The metrics sink has panicked",
+					zap.String("sink", a.Name), zap.String("panic", fmt.Sprintf("%v", p)))
+			}
+		}
+	}()
+	a.Delegate.SubmitSegmentMetrics(met)
+}
+
+// Submit the drop and the panic counts since the last report
+func (a *AsyncSink) report(ctx context.Context) {
+	dropped, panics := a.Dropped(), a.Panics()
+	met := &MetricsContext{OpName: a.Name, Metrics: map[string]*MetricEntry{}}
+	met.AddCount(AsyncSinkDroppedMetric, float64(dropped-a.reported[0]))
+	met.AddCount(AsyncSinkPanicsMetric, float64(panics-a.reported[1]))
+	a.reported = [2]int64{dropped, panics}
+	a.submit(ctx, met)
+}
+
+// Submit the queued metrics to the delegate and flush it if it buffers them
+func (a *AsyncSink) Flush(ctx context.Context) error {
+	for {
+		select {
+		case met := <-a.queue:
+			a.submit(ctx, met)
+		default:
+			if flushing, ok := a.Delegate.(FlushingSink); ok {
+				return flushing.Flush(ctx)
+			}
+			return nil
+		}
+	}
+}
+
+func (a *AsyncSink) run(ctx context.Context) error {
+	interval := a.ReportInterval
+	if interval <= 0 {
+		interval = DefaultAsyncSinkReportInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case met := <-a.queue:
+			a.submit(ctx, met)
+		case <-ticker.C:
+			a.report(ctx)
+		case <-ctx.Done():
+			// Drain the queue, the delegate might have already done its final
+			// flush, so flush it again
+			a.report(ctx)
+			return a.Flush(context.Background())
+		}
+	}
+}
+
+// Start submitting the metrics, the queue is drained when the registry
+// closes. The delegate's processes are started as well.
+func (a *AsyncSink) Start(registry *ProcessRegistry) {
+	if startable, ok := a.Delegate.(startableSink); ok {
+		startable.Start(registry)
+	}
+	pc := registry.CreateProcessContext(a.Name + "Submitter")
+	pc.Run(a.run)
+}
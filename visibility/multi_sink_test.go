@@ -0,0 +1,116 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the op names of the submitted metrics, optionally blocking or
+// panicking
+type recordingSink struct {
+	mtx      sync.Mutex
+	ops      []string
+	flushes  int
+	block    chan struct{}
+	panicOp  string
+	sketches bool
+}
+
+func (r *recordingSink) SubmitSegmentMetrics(met *MetricsContext) {
+	if r.block != nil {
+		<-r.block
+	}
+	if met.OpName == r.panicOp {
+		panic("bad sink")
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.ops = append(r.ops, met.OpName)
+}
+
+func (r *recordingSink) Flush(ctx context.Context) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.flushes++
+	return nil
+}
+
+func (r *recordingSink) WantsSketches() bool {
+	return r.sketches
+}
+
+func (r *recordingSink) getOps() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]string{}, r.ops...)
+}
+
+func makeOpMetrics(opName string) *MetricsContext {
+	return &MetricsContext{OpName: opName, Metrics: map[string]*MetricEntry{}}
+}
+
+func TestFanOutSink(t *testing.T) {
+	first, second := &recordingSink{}, &recordingSink{}
+	fanOut := NewFanOutSink(first, second, NullSink)
+	assert.False(t, wantsSketches(fanOut))
+	second.sketches = true
+	assert.True(t, wantsSketches(fanOut))
+
+	fanOut.SubmitSegmentMetrics(makeOpMetrics("Op"))
+	assert.Equal(t, []string{"Op"}, first.getOps())
+	assert.Equal(t, []string{"Op"}, second.getOps())
+
+	assert.NoError(t, fanOut.Flush(context.Background()))
+	assert.Equal(t, 1, first.flushes)
+	assert.Equal(t, 1, second.flushes)
+
+	// A panicking sink doesn't affect the others
+	first.panicOp = "Bad"
+	fanOut.SubmitSegmentMetrics(makeOpMetrics("Bad"))
+	assert.Equal(t, []string{"Op"}, first.getOps())
+	assert.Equal(t, []string{"Op", "Bad"}, second.getOps())
+}
+
+func TestAsyncSink(t *testing.T) {
+	delegate := &recordingSink{block: make(chan struct{}), panicOp: "Bad"}
+	async := NewAsyncSink("Async", delegate, 2)
+	// The default interval is used
+	async.ReportInterval = 0
+
+	logSink, logger := utils.NewMemorySinkLogger()
+	reg := NewProcessRegistry("", logger, makeTestApp(), NullSink)
+	async.Start(reg)
+
+	// The delegate is stuck, but the submissions don't block
+	for i := 0; i < 10; i++ {
+		async.SubmitSegmentMetrics(makeOpMetrics("Op"))
+	}
+	assert.True(t, async.Dropped() >= 7)
+
+	close(delegate.block)
+	waitForQueue := func() {
+		for len(async.queue) != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForQueue()
+	async.SubmitSegmentMetrics(makeOpMetrics("Bad"))
+	waitForQueue()
+	async.SubmitSegmentMetrics(makeOpMetrics("Last"))
+
+	// The queue is drained and the delegate is flushed on close
+	reg.Close()
+	ops := delegate.getOps()
+	assert.Contains(t, ops, "Last")
+	assert.Equal(t, int64(1), async.Panics())
+	assert.True(t, delegate.flushes >= 1)
+	assert.True(t, strings.Contains(logSink.String(), "The metrics sink has panicked"))
+
+	// The drop counts are reported to the delegate
+	assert.Contains(t, ops, "Async")
+}
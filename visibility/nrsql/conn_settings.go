@@ -0,0 +1,363 @@
+package nrsql
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/lib/pq"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The URL parameters interpreted by the connector itself, the rest of the
+// parameters are passed to lib/pq.
+const (
+	// The credentials provider: secretsmanager (default), ssm, env or file
+	CredentialsParam = "credentials"
+	// The secret ID, the SSM parameter name, the environment prefix or the file path
+	SecretIdParam = "secret_id"
+	// Where to get the endpoint: url (default if the host is set), secret (default
+	// if the host is empty) or rds (DescribeDBInstances lookup)
+	EndpointParam = "endpoint"
+	// The RDS instance identifier for the rds endpoint source
+	InstanceParam = "instance"
+	// How long the credentials are cached, as a Go duration
+	CredentialsTtlParam = "credentials_ttl"
+)
+
+const (
+	EndpointFromUrl    = "url"
+	EndpointFromSecret = "secret"
+	EndpointFromRds    = "rds"
+)
+
+// The connection settings parsed from the connection string
+type connSettings struct {
+	// The lib/pq parameters, except for the host, port, user and password
+	params map[string]string
+	// The endpoint and user overrides, the values from the credentials are used
+	// if they are empty.
+	host string
+	port int32
+	user string
+
+	provider DbCredentialsProvider
+	ttl      time.Duration
+}
+
+// Parse the connection string. Three formats are supported in addition to the
+// regular lib/pq connection strings:
+//
+// rds:<instance>:<database> - the credentials and the endpoint are taken from
+// the db/<instance> secret in the SecretsManager.
+//
+// rds-iam:<instance>:<database>:<user> or rds-iam:<host>:<port>:<database>:<user> -
+// the RDS IAM authentication, see IamTokenGenerator.
+//
+// postgres://[user@][host[:port]]/database?credentials=...&secret_id=...&... - the
+// URL form with the pluggable credentials and endpoint sources, see the
+// parameter constants above. The sslmode defaults to verify-full, the
+// connect_timeout and statement_timeout parameters can be specified as Go
+// durations. A URL without any of the connector parameters is passed to
+// lib/pq as-is.
+//
+// Returns nil settings for the regular lib/pq connection strings.
+func parseConnString(ctx context.Context, connStr string, sslCaPath string,
+	config aws.Config) (*connSettings, error) {
+
+	switch {
+	case strings.HasPrefix(connStr, "rds-iam:"):
+		return parseIamSettings(ctx, connStr, sslCaPath, config)
+	case strings.HasPrefix(connStr, "rds:"):
+		// Split the connection string
+		splits := strings.Split(connStr, ":")
+		if len(splits) != 3 {
+			return nil, fmt.Errorf("bad RDS connection string %s", connStr)
+		}
+		return &connSettings{
+			params: makeSslParams(splits[2], "verify-full", sslCaPath),
+			provider: &SecretsManagerCredentials{Config: config,
+				SecretId: rdsSecretName(splits[1])},
+			ttl: DefaultCredentialsTtl,
+		}, nil
+	case strings.HasPrefix(connStr, "postgres://"),
+		strings.HasPrefix(connStr, "postgresql://"):
+		return parseUrlSettings(ctx, connStr, sslCaPath, config)
+	}
+
+	return nil, nil
+}
+
+func rdsSecretName(rdsDb string) string {
+	return fmt.Sprintf("db/%s", rdsDb)
+}
+
+func makeSslParams(dbName, sslMode, sslCaPath string) map[string]string {
+	params := map[string]string{
+		"database": dbName,
+		"sslmode":  sslMode,
+	}
+	if sslCaPath != "" {
+		params["sslrootcert"] = sslCaPath
+	}
+	return params
+}
+
+func parseIamSettings(ctx context.Context, connStr string, sslCaPath string,
+	config aws.Config) (*connSettings, error) {
+
+	instance, host, port, dbName, user, err := parseIamConnString(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if instance != "" {
+		host, port, err = lookupRdsEndpoint(ctx, config, instance)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &connSettings{
+		params: makeSslParams(dbName, "verify-full", sslCaPath),
+		provider: &IamCredentials{
+			Tokens: NewIamTokenGenerator(fmt.Sprintf("%s:%d", host, port),
+				config.Region, user, config.Credentials),
+			Host: host,
+			Port: port,
+		},
+		ttl: IamTokenRefreshInterval,
+	}, nil
+}
+
+func parseUrlSettings(ctx context.Context, connStr string, sslCaPath string,
+	config aws.Config) (*connSettings, error) {
+
+	u, err := url.Parse(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	hasOwnParams := false
+	for _, p := range []string{CredentialsParam, SecretIdParam, EndpointParam,
+		InstanceParam, CredentialsTtlParam} {
+		if _, ok := query[p]; ok {
+			hasOwnParams = true
+		}
+	}
+	if !hasOwnParams {
+		return nil, nil
+	}
+
+	if _, hasPassword := u.User.Password(); hasPassword {
+		return nil, fmt.Errorf("the password can't be used with the credentials provider")
+	}
+
+	provider, err := MakeCredentialsProvider(query.Get(CredentialsParam),
+		query.Get(SecretIdParam), config)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &connSettings{
+		params:   makeSslParams(strings.TrimPrefix(u.Path, "/"), "verify-full", sslCaPath),
+		user:     u.User.Username(),
+		provider: provider,
+		ttl:      DefaultCredentialsTtl,
+	}
+
+	if ttl := query.Get(CredentialsTtlParam); ttl != "" {
+		res.ttl, err = time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value: %s", CredentialsTtlParam, ttl)
+		}
+	}
+
+	// Find out the endpoint
+	endpoint := query.Get(EndpointParam)
+	if endpoint == "" {
+		endpoint = EndpointFromSecret
+		if u.Hostname() != "" {
+			endpoint = EndpointFromUrl
+		}
+	}
+	switch endpoint {
+	case EndpointFromUrl:
+		res.host = u.Hostname()
+		if u.Port() != "" {
+			port, err := strconv.ParseInt(u.Port(), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("bad port %s", u.Port())
+			}
+			res.port = int32(port)
+		} else {
+			res.port = 5432
+		}
+	case EndpointFromRds:
+		instance := query.Get(InstanceParam)
+		if instance == "" {
+			instance = u.Hostname()
+		}
+		res.host, res.port, err = lookupRdsEndpoint(ctx, config, instance)
+		if err != nil {
+			return nil, err
+		}
+	case EndpointFromSecret:
+	default:
+		return nil, fmt.Errorf("unknown endpoint source %s", endpoint)
+	}
+
+	// Now copy the rest of the parameters
+	for k, v := range query {
+		switch k {
+		case CredentialsParam, SecretIdParam, EndpointParam, InstanceParam,
+			CredentialsTtlParam:
+			continue
+		case "connect_timeout":
+			res.params[k], err = convertTimeout(v[0], time.Second)
+		case "statement_timeout", "lock_timeout", "idle_in_transaction_session_timeout":
+			res.params[k], err = convertTimeout(v[0], time.Millisecond)
+		default:
+			res.params[k] = v[0]
+		}
+		if err != nil {
+			return nil, fmt.Errorf("bad %s value: %s", k, v[0])
+		}
+	}
+
+	return res, nil
+}
+
+// Convert the Go duration into the integer number of units, plain integers are
+// passed as-is.
+func convertTimeout(val string, unit time.Duration) (string, error) {
+	if _, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return val, nil
+	}
+	dur, err := time.ParseDuration(val)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(int64(dur/unit), 10), nil
+}
+
+// Get the endpoint to connect to, the settings take precedence over the
+// endpoint from the credentials.
+func (s *connSettings) endpoint(creds *DbCredentials) (string, int32) {
+	if s.host != "" {
+		return s.host, s.port
+	}
+	return creds.Host, creds.Port
+}
+
+// Make the lib/pq connection string for the credentials
+func (s *connSettings) makeConnString(creds *DbCredentials) string {
+	params := make(map[string]string)
+	for k, v := range s.params {
+		params[k] = v
+	}
+
+	host, port := s.endpoint(creds)
+	params["host"], params["port"] = host, strconv.Itoa(int(port))
+	params["user"] = creds.Username
+	if s.user != "" {
+		params["user"] = s.user
+	}
+	params["password"] = creds.Password
+
+	return formatConnParams(params)
+}
+
+// Make the key=value connection string sorted by the key
+func formatConnParams(params map[string]string) string {
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var res []string
+	for _, k := range keys {
+		res = append(res, k+"="+quoteConnValue(params[k]))
+	}
+	return strings.Join(res, " ")
+}
+
+// Parse the regular lib/pq connection string, either the URL or the
+// key=value pairs with the optionally quoted values
+func parsePlainConnString(connStr string) (map[string]string, error) {
+	if strings.HasPrefix(connStr, "postgres://") ||
+		strings.HasPrefix(connStr, "postgresql://") {
+		var err error
+		connStr, err = pq.ParseURL(connStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	res := make(map[string]string)
+	pos := 0
+	for {
+		for pos < len(connStr) && isConnSpace(connStr[pos]) {
+			pos++
+		}
+		if pos == len(connStr) {
+			return res, nil
+		}
+
+		eq := strings.IndexByte(connStr[pos:], '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("missing '=' in the connection string")
+		}
+		key := strings.TrimSpace(connStr[pos : pos+eq])
+		pos += eq + 1
+		for pos < len(connStr) && connStr[pos] == ' ' {
+			pos++
+		}
+
+		quoted := pos < len(connStr) && connStr[pos] == '\''
+		if quoted {
+			pos++
+		}
+		var val strings.Builder
+		closed := !quoted
+		for ; pos < len(connStr); pos++ {
+			c := connStr[pos]
+			if c == '\\' && pos+1 < len(connStr) {
+				pos++
+				val.WriteByte(connStr[pos])
+				continue
+			}
+			if quoted && c == '\'' {
+				pos++
+				closed = true
+				break
+			}
+			if !quoted && isConnSpace(c) {
+				break
+			}
+			val.WriteByte(c)
+		}
+		if !closed {
+			return nil, fmt.Errorf("unterminated quoted value of %s "+
+				"in the connection string", key)
+		}
+		res[key] = val.String()
+	}
+}
+
+func isConnSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// Quote the value for the key=value connection string, the generated passwords
+// and the IAM tokens can contain spaces and quotes.
+func quoteConnValue(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `'`, `\'`, -1)
+	return "'" + val + "'"
+}
@@ -0,0 +1,187 @@
+package nrsql
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// The version stages of the SecretsManager secrets
+const (
+	StageCurrent  = "AWSCURRENT"
+	StagePending  = "AWSPENDING"
+	StagePrevious = "AWSPREVIOUS"
+)
+
+// How long the RDS credentials are cached
+var DefaultCredentialsTtl = 5 * time.Minute
+
+// The credentials are refreshed in background once they are older than this
+// fraction of the TTL.
+const credentialsRefreshAhead = 0.75
+
+// The timeout for a single credentials fetch, it's not bound to the context of
+// the caller because other callers might be waiting for the result.
+const credentialsFetchTimeout = 30 * time.Second
+
+type cachedConnInfo struct {
+	*DbCredentials
+	stage   string
+	fetched time.Time
+}
+
+type credentialsFetch struct {
+	done chan struct{}
+	res  *cachedConnInfo
+	err  error
+}
+
+// A cache for the RDS credentials. Concurrent lookups of the expired credentials
+// are coalesced into a single fetch, and the credentials that are close to their
+// expiration are refreshed in background.
+//
+// The versions that failed to authenticate are remembered, so if the AWSCURRENT
+// version is known to be bad then the AWSPREVIOUS version is used. This covers
+// the rotation window when the secret is already updated but the database
+// hasn't caught up yet.
+type credentialsCache struct {
+	provider DbCredentialsProvider
+	ttl      time.Duration
+	clock    func() time.Time
+
+	mtx      sync.Mutex
+	current  *cachedConnInfo
+	previous *cachedConnInfo
+	failed   map[string]bool
+	inflight *credentialsFetch
+}
+
+func newCredentialsCache(provider DbCredentialsProvider,
+	ttl time.Duration) *credentialsCache {
+
+	return &credentialsCache{
+		provider: provider,
+		ttl:      ttl,
+		clock:    time.Now,
+		failed:   make(map[string]bool),
+	}
+}
+
+// Get the credentials to use for a new connection
+func (c *credentialsCache) Get(ctx context.Context) (*cachedConnInfo, error) {
+	c.mtx.Lock()
+	cur := c.current
+	var age time.Duration
+	if cur != nil {
+		age = c.clock().Sub(cur.fetched)
+	}
+
+	if cur != nil && age < c.ttl {
+		if age > time.Duration(float64(c.ttl)*credentialsRefreshAhead) {
+			c.startFetch()
+		}
+		res := c.pickUsable()
+		c.mtx.Unlock()
+		return res, nil
+	}
+
+	fetch := c.startFetch()
+	c.mtx.Unlock()
+
+	select {
+	case <-fetch.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if fetch.err != nil {
+		return nil, fetch.err
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.pickUsable(), nil
+}
+
+// Mark the credentials as failed, the next Get will re-read the secret
+func (c *credentialsCache) Invalidate(failed *cachedConnInfo) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.failed[failed.VersionId] = true
+	if c.current != nil && c.current.VersionId == failed.VersionId {
+		c.current.fetched = time.Time{}
+	}
+}
+
+// Pick the current version, unless it's known to be broken. Must be called
+// with the lock held.
+func (c *credentialsCache) pickUsable() *cachedConnInfo {
+	if !c.failed[c.current.VersionId] {
+		return c.current
+	}
+	if c.previous != nil && !c.failed[c.previous.VersionId] {
+		return c.previous
+	}
+	// Everything has failed, start from scratch
+	c.failed = make(map[string]bool)
+	return c.current
+}
+
+// Start the fetch if it's not yet running. Must be called with the lock held.
+func (c *credentialsCache) startFetch() *credentialsFetch {
+	if c.inflight != nil {
+		return c.inflight
+	}
+
+	fetch := &credentialsFetch{done: make(chan struct{})}
+	c.inflight = fetch
+
+	go func() {
+		defer close(fetch.done)
+		ctx, cancel := context.WithTimeout(context.Background(),
+			credentialsFetchTimeout)
+		defer cancel()
+
+		cur, err := c.fetch(ctx, StageCurrent)
+
+		// Try to get the previous version if the current one is known to be bad
+		var prev *cachedConnInfo
+		if err == nil && c.isFailed(cur.VersionId) {
+			prev, _ = c.fetch(ctx, StagePrevious)
+		}
+
+		c.mtx.Lock()
+		defer c.mtx.Unlock()
+		c.inflight = nil
+		fetch.res, fetch.err = cur, err
+		if err != nil {
+			return
+		}
+
+		cur.fetched = c.clock()
+		if c.current == nil || c.current.VersionId != cur.VersionId {
+			// A new version has arrived, forget the old failures
+			c.failed = make(map[string]bool)
+		}
+		c.current = cur
+		c.previous = prev
+	}()
+
+	return fetch
+}
+
+func (c *credentialsCache) fetch(ctx context.Context,
+	stage string) (*cachedConnInfo, error) {
+
+	creds, err := c.provider.GetCredentials(ctx, stage)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedConnInfo{DbCredentials: creds, stage: stage}, nil
+}
+
+func (c *credentialsCache) isFailed(versionId string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.failed[versionId]
+}
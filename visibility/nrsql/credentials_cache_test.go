@@ -0,0 +1,154 @@
+package nrsql
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeFetcher struct {
+	mtx      sync.Mutex
+	versions map[string]string
+	calls    int32
+	gate     chan struct{}
+}
+
+func (f *fakeFetcher) GetCredentials(ctx context.Context,
+	stage string) (*DbCredentials, error) {
+
+	atomic.AddInt32(&f.calls, 1)
+	if f.gate != nil {
+		<-f.gate
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	ver, ok := f.versions[stage]
+	if !ok {
+		return nil, fmt.Errorf("no stage %s", stage)
+	}
+	return &DbCredentials{Username: ver, VersionId: ver}, nil
+}
+
+func (f *fakeFetcher) set(stage, version string) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.versions[stage] = version
+}
+
+func TestCredentialsCacheTtl(t *testing.T) {
+	ff := &fakeFetcher{versions: map[string]string{StageCurrent: "v1"}}
+	cache := newCredentialsCache(ff, time.Minute)
+	now := time.Unix(1000, 0)
+	cache.clock = func() time.Time { return now }
+
+	ctx := context.Background()
+	creds, err := cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", creds.VersionId)
+
+	// Cached
+	ff.set(StageCurrent, "v2")
+	now = now.Add(30 * time.Second)
+	creds, err = cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", creds.VersionId)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ff.calls))
+
+	// Expired
+	now = now.Add(31 * time.Second)
+	creds, err = cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", creds.VersionId)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ff.calls))
+}
+
+func TestCredentialsCacheRefreshAhead(t *testing.T) {
+	ff := &fakeFetcher{versions: map[string]string{StageCurrent: "v1"}}
+	cache := newCredentialsCache(ff, time.Minute)
+	now := time.Unix(1000, 0)
+	cache.clock = func() time.Time { return now }
+
+	ctx := context.Background()
+	_, err := cache.Get(ctx)
+	assert.NoError(t, err)
+
+	// The cached value is returned immediately and the refresh starts in background
+	ff.set(StageCurrent, "v2")
+	now = now.Add(50 * time.Second)
+	creds, err := cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", creds.VersionId)
+
+	for {
+		creds, err = cache.Get(ctx)
+		assert.NoError(t, err)
+		if creds.VersionId == "v2" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&ff.calls))
+}
+
+func TestCredentialsCacheSingleFlight(t *testing.T) {
+	ff := &fakeFetcher{versions: map[string]string{StageCurrent: "v1"},
+		gate: make(chan struct{})}
+	cache := newCredentialsCache(ff, time.Minute)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			creds, err := cache.Get(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, "v1", creds.VersionId)
+		}()
+	}
+
+	// Cancelled waiters don't affect the fetch
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cache.Get(cancelled)
+	assert.Equal(t, context.Canceled, err)
+
+	close(ff.gate)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ff.calls))
+}
+
+func TestCredentialsCacheFallback(t *testing.T) {
+	ff := &fakeFetcher{versions: map[string]string{StageCurrent: "v2",
+		StagePrevious: "v1"}}
+	cache := newCredentialsCache(ff, time.Minute)
+
+	ctx := context.Background()
+	creds, err := cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", creds.VersionId)
+
+	// The current version has failed, so the previous one is used
+	cache.Invalidate(creds)
+	creds, err = cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", creds.VersionId)
+	assert.Equal(t, StagePrevious, creds.stage)
+
+	// Now the previous one fails as well, start from scratch
+	cache.Invalidate(creds)
+	creds, err = cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", creds.VersionId)
+
+	// A new version resets the failures
+	cache.Invalidate(creds)
+	ff.set(StageCurrent, "v3")
+	creds, err = cache.Get(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "v3", creds.VersionId)
+}
@@ -0,0 +1,232 @@
+package nrsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Database credentials and, optionally, the endpoint to connect to
+type DbCredentials struct {
+	Username, Password string
+	Host               string
+	Port               int32
+
+	// Identifies the version of the credentials, the connector re-creates its
+	// delegate connector once the version changes.
+	VersionId string
+}
+
+// A source of the database credentials. The providers that don't support
+// versioning should return an error for all stages except for AWSCURRENT.
+type DbCredentialsProvider interface {
+	GetCredentials(ctx context.Context, stage string) (*DbCredentials, error)
+}
+
+// Example secret structure:
+//
+//	{
+//	  "username": "rds",
+//	  "engine": "postgres",
+//	  "host": "xyzzy-db.cbimanaxd4pt.us-east-2.rds.amazonaws.com",
+//	  "password": "7f*w3-oOZ$17,g&b_uVIH;N^Or]=H7<>",
+//	  "port": 5432, "dbInstanceIdentifier": "xyzzy-db"
+//	}
+type connInfo struct {
+	Username, Password string
+	Host               string
+	Port               int32
+}
+
+func parseConnInfo(data []byte, versionId string) (*DbCredentials, error) {
+	info := connInfo{}
+	err := json.Unmarshal(data, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &DbCredentials{
+		Username:  info.Username,
+		Password:  info.Password,
+		Host:      info.Host,
+		Port:      info.Port,
+		VersionId: versionId,
+	}, nil
+}
+
+func contentVersion(data ...string) string {
+	hash := sha256.New()
+	for _, d := range data {
+		_, _ = hash.Write([]byte(d))
+		_, _ = hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func checkUnversionedStage(stage string) error {
+	if stage != StageCurrent {
+		return fmt.Errorf("no %s version of the credentials", stage)
+	}
+	return nil
+}
+
+// Credentials stored in the SecretsManager as a JSON object, in the format
+// used by the RDS rotation lambdas.
+type SecretsManagerCredentials struct {
+	Config   aws.Config
+	SecretId string
+}
+
+func (s *SecretsManagerCredentials) GetCredentials(ctx context.Context,
+	stage string) (*DbCredentials, error) {
+
+	sm := secretsmanager.New(s.Config)
+
+	//Create a Secrets Manager client
+	input := &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(s.SecretId),
+		VersionStage: aws.String(stage),
+	}
+
+	result, err := sm.GetSecretValueRequest(input).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.SecretString == nil || *result.SecretString == "" {
+		return nil, fmt.Errorf("no string secret")
+	}
+
+	return parseConnInfo([]byte(*result.SecretString),
+		aws.StringValue(result.VersionId))
+}
+
+// Credentials stored in the SSM Parameter Store as a JSON object, in the same
+// format as the SecretsManager secrets. SecureString parameters are decrypted.
+type SsmCredentials struct {
+	Config        aws.Config
+	ParameterName string
+}
+
+func (s *SsmCredentials) GetCredentials(ctx context.Context,
+	stage string) (*DbCredentials, error) {
+
+	if err := checkUnversionedStage(stage); err != nil {
+		return nil, err
+	}
+
+	svc := ssm.New(s.Config)
+	result, err := svc.GetParameterRequest(&ssm.GetParameterInput{
+		Name:           aws.String(s.ParameterName),
+		WithDecryption: aws.Bool(true),
+	}).Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Parameter == nil || aws.StringValue(result.Parameter.Value) == "" {
+		return nil, fmt.Errorf("empty SSM parameter %s", s.ParameterName)
+	}
+
+	return parseConnInfo([]byte(*result.Parameter.Value),
+		strconv.FormatInt(aws.Int64Value(result.Parameter.Version), 10))
+}
+
+// Credentials from the environment variables: <Prefix>USER, <Prefix>PASSWORD,
+// <Prefix>HOST and <Prefix>PORT. The host and port are optional.
+type EnvCredentials struct {
+	Prefix string
+}
+
+func (e *EnvCredentials) GetCredentials(ctx context.Context,
+	stage string) (*DbCredentials, error) {
+
+	if err := checkUnversionedStage(stage); err != nil {
+		return nil, err
+	}
+
+	user := os.Getenv(e.Prefix + "USER")
+	if user == "" {
+		return nil, fmt.Errorf("the %sUSER variable is not set", e.Prefix)
+	}
+	password := os.Getenv(e.Prefix + "PASSWORD")
+	host := os.Getenv(e.Prefix + "HOST")
+
+	var port int64
+	if portStr := os.Getenv(e.Prefix + "PORT"); portStr != "" {
+		var err error
+		port, err = strconv.ParseInt(portStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad %sPORT value %s", e.Prefix, portStr)
+		}
+	}
+
+	return &DbCredentials{
+		Username:  user,
+		Password:  password,
+		Host:      host,
+		Port:      int32(port),
+		VersionId: contentVersion(user, password, host, strconv.FormatInt(port, 10)),
+	}, nil
+}
+
+// Credentials in a JSON file, in the same format as the SecretsManager secrets.
+// The file is re-read on each refresh, so it can be updated in place (e.g. by
+// a Kubernetes secret volume).
+type FileCredentials struct {
+	Path string
+}
+
+func (f *FileCredentials) GetCredentials(ctx context.Context,
+	stage string) (*DbCredentials, error) {
+
+	if err := checkUnversionedStage(stage); err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConnInfo(data, contentVersion(string(data)))
+}
+
+// Make the credentials provider by its name: secretsmanager, ssm, env or file.
+// The secretId is interpreted by the provider: it's the secret ID, the SSM
+// parameter name, the environment variable prefix or the file path.
+func MakeCredentialsProvider(name, secretId string,
+	config aws.Config) (DbCredentialsProvider, error) {
+
+	switch strings.ToLower(name) {
+	case "secretsmanager", "":
+		if secretId == "" {
+			return nil, fmt.Errorf("the secret ID is not set")
+		}
+		return &SecretsManagerCredentials{Config: config, SecretId: secretId}, nil
+	case "ssm":
+		if secretId == "" {
+			return nil, fmt.Errorf("the SSM parameter name is not set")
+		}
+		return &SsmCredentials{Config: config, ParameterName: secretId}, nil
+	case "env":
+		if secretId == "" {
+			secretId = "PG"
+		}
+		return &EnvCredentials{Prefix: secretId}, nil
+	case "file":
+		if secretId == "" {
+			return nil, fmt.Errorf("the credentials file path is not set")
+		}
+		return &FileCredentials{Path: secretId}, nil
+	}
+
+	return nil, fmt.Errorf("unknown credentials provider %s", name)
+}
@@ -0,0 +1,87 @@
+package nrsql
+
+import (
+	"context"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSsmCredentials(t *testing.T) {
+	mock := utils.NewAwsMockHandler()
+	mock.AddHandler(func(ctx context.Context, input *ssm.GetParameterInput) (
+		*ssm.GetParameterOutput, error) {
+		assert.Equal(t, "/db/orders", *input.Name)
+		assert.True(t, *input.WithDecryption)
+		return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{
+			Value:   aws.String(nrsqltest.MakeDbSecretString("db.example.com", 5432, "rds", "pw")),
+			Version: aws.Int64(3),
+		}}, nil
+	})
+
+	provider, err := MakeCredentialsProvider("ssm", "/db/orders", mock.AwsConfig())
+	assert.NoError(t, err)
+	creds, err := provider.GetCredentials(context.Background(), StageCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, &DbCredentials{Username: "rds", Password: "pw",
+		Host: "db.example.com", Port: 5432, VersionId: "3"}, creds)
+
+	_, err = provider.GetCredentials(context.Background(), StagePrevious)
+	assert.Error(t, err)
+}
+
+func TestEnvCredentials(t *testing.T) {
+	defer os.Unsetenv("TESTDB_USER")
+	defer os.Unsetenv("TESTDB_PASSWORD")
+	defer os.Unsetenv("TESTDB_PORT")
+
+	provider := &EnvCredentials{Prefix: "TESTDB_"}
+	_, err := provider.GetCredentials(context.Background(), StageCurrent)
+	assert.Error(t, err)
+
+	_ = os.Setenv("TESTDB_USER", "app")
+	_ = os.Setenv("TESTDB_PASSWORD", "pw1")
+	_ = os.Setenv("TESTDB_PORT", "5433")
+	creds, err := provider.GetCredentials(context.Background(), StageCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, "app", creds.Username)
+	assert.Equal(t, "pw1", creds.Password)
+	assert.Equal(t, int32(5433), creds.Port)
+
+	// The version follows the content
+	_ = os.Setenv("TESTDB_PASSWORD", "pw2")
+	creds2, err := provider.GetCredentials(context.Background(), StageCurrent)
+	assert.NoError(t, err)
+	assert.NotEqual(t, creds.VersionId, creds2.VersionId)
+
+	_ = os.Setenv("TESTDB_PORT", "port")
+	_, err = provider.GetCredentials(context.Background(), StageCurrent)
+	assert.Error(t, err)
+}
+
+func TestFileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "creds")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "creds.json")
+
+	provider, err := MakeCredentialsProvider("file", path, aws.Config{})
+	assert.NoError(t, err)
+	_, err = provider.GetCredentials(context.Background(), StageCurrent)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(
+		nrsqltest.MakeDbSecretString("localhost", 5432, "rds", "pw")), 0600))
+	creds, err := provider.GetCredentials(context.Background(), StageCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, "rds", creds.Username)
+	assert.Equal(t, "pw", creds.Password)
+	assert.Equal(t, "localhost", creds.Host)
+	assert.NotEmpty(t, creds.VersionId)
+}
@@ -0,0 +1,77 @@
+//go:build ignore
+// +build ignore
+
+// Downloads the global RDS CA bundle and writes it to rds_global_bundle.go,
+// run with "go generate" to update the embedded certificates.
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const bundleUrl = "https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem"
+
+func main() {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(bundleUrl)
+	if err != nil {
+		fail(err)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fail(fmt.Errorf("unexpected status %s", resp.Status))
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		fail(err)
+	}
+
+	// Re-encode the certificates to drop everything else
+	var sb strings.Builder
+	count := 0
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			fail(err)
+		}
+		sb.WriteString("# " + cert.Subject.CommonName + ", expires " +
+			cert.NotAfter.Format("2006-01-02") + "\n")
+		sb.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: block.Bytes}))
+		count++
+	}
+	if count == 0 {
+		fail(fmt.Errorf("no certificates in the bundle"))
+	}
+
+	out := "// Code generated by gen_rds_ca_bundle.go; DO NOT EDIT.\n\n" +
+		"package nrsql\n\n" +
+		"// The global RDS CA bundle from " + bundleUrl + ",\n" +
+		"// with the roots and the intermediates for all the commercial regions\n" +
+		"const RdsGlobalBundle = `" + sb.String() + "`\n"
+	err = ioutil.WriteFile("rds_global_bundle.go", []byte(out), 0644)
+	if err != nil {
+		fail(err)
+	}
+	fmt.Printf("Wrote %d certificates\n", count)
+}
+
+func fail(err error) {
+	_, _ = fmt.Fprintln(os.Stderr, "Failed to generate the RDS CA bundle:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,138 @@
+package nrsql
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The RDS IAM authentication tokens are valid for 15 minutes
+const IamTokenLifetime = 15 * time.Minute
+
+// The tokens are re-generated well before their expiration, so that the
+// connections started just before the refresh still have a valid token.
+const IamTokenRefreshInterval = 10 * time.Minute
+
+// Generates the RDS IAM authentication tokens, the tokens are signed locally
+// using the AWS credentials and can be used as Postgres passwords.
+type IamTokenGenerator struct {
+	Endpoint    string // host:port
+	Region      string
+	User        string
+	Credentials aws.CredentialsProvider
+	Clock       func() time.Time
+}
+
+func NewIamTokenGenerator(endpoint, region, user string,
+	credentials aws.CredentialsProvider) *IamTokenGenerator {
+
+	return &IamTokenGenerator{
+		Endpoint:    endpoint,
+		Region:      region,
+		User:        user,
+		Credentials: credentials,
+		Clock:       time.Now,
+	}
+}
+
+// Make the authentication token, returns the token and its expiration time.
+// This is similar to rdsutils.BuildAuthToken, but with the controllable clock.
+func (g *IamTokenGenerator) MakeToken() (string, time.Time, error) {
+	req, err := http.NewRequest("GET", "https://"+g.Endpoint+"/", nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	values := req.URL.Query()
+	values.Set("Action", "connect")
+	values.Set("DBUser", g.User)
+	req.URL.RawQuery = values.Encode()
+
+	signTime := g.Clock()
+	signer := v4.Signer{Credentials: g.Credentials}
+	_, err = signer.Presign(req, nil, "rds-db", g.Region, IamTokenLifetime, signTime)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return strings.TrimPrefix(req.URL.String(), "https://"),
+		signTime.Add(IamTokenLifetime), nil
+}
+
+// Parse the IAM connection string. The supported formats are:
+// rds-iam:<instance identifier>:<database>:<user>
+// rds-iam:<host>:<port>:<database>:<user>
+func parseIamConnString(connStr string) (instance, host string, port int32,
+	dbName, user string, err error) {
+
+	splits := strings.Split(strings.TrimPrefix(connStr, "rds-iam:"), ":")
+	switch len(splits) {
+	case 3:
+		return splits[0], "", 0, splits[1], splits[2], nil
+	case 4:
+		portNum, err := strconv.ParseInt(splits[1], 10, 32)
+		if err != nil {
+			return "", "", 0, "", "", fmt.Errorf("bad port in the "+
+				"connection string %s", connStr)
+		}
+		return "", splits[0], int32(portNum), splits[2], splits[3], nil
+	}
+
+	return "", "", 0, "", "", fmt.Errorf("bad RDS IAM connection string %s", connStr)
+}
+
+// Find the endpoint of the RDS instance
+func lookupRdsEndpoint(ctx context.Context, config aws.Config,
+	instance string) (string, int32, error) {
+
+	svc := rds.New(config)
+	res, err := svc.DescribeDBInstancesRequest(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(instance),
+	}).Send(ctx)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(res.DBInstances) == 0 || res.DBInstances[0].Endpoint == nil ||
+		res.DBInstances[0].Endpoint.Address == nil {
+		return "", 0, fmt.Errorf("no endpoint for the RDS instance %s", instance)
+	}
+
+	endpoint := res.DBInstances[0].Endpoint
+	return *endpoint.Address, int32(aws.Int64Value(endpoint.Port)), nil
+}
+
+// The credentials provider for the RDS IAM authentication, the password is
+// the authentication token.
+type IamCredentials struct {
+	Tokens *IamTokenGenerator
+	Host   string
+	Port   int32
+}
+
+func (i *IamCredentials) GetCredentials(ctx context.Context,
+	stage string) (*DbCredentials, error) {
+
+	// There are no previous versions for the IAM tokens
+	if stage != StageCurrent {
+		return nil, fmt.Errorf("no %s version of the IAM token", stage)
+	}
+
+	token, expires, err := i.Tokens.MakeToken()
+	if err != nil {
+		return nil, err
+	}
+
+	return &DbCredentials{
+		Username:  i.Tokens.User,
+		Password:  token,
+		Host:      i.Host,
+		Port:      i.Port,
+		VersionId: strconv.FormatInt(expires.UnixNano(), 10),
+	}, nil
+}
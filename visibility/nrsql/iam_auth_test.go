@@ -0,0 +1,107 @@
+package nrsql
+
+import (
+	"context"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/rds"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIamTokenGenerator(t *testing.T) {
+	gen := NewIamTokenGenerator("db.example.com:5432", "us-mars-1", "iamuser",
+		aws.NewStaticCredentialsProvider("AKID", "SECRET", ""))
+	gen.Clock = utils.StaticClock(1500000000)
+
+	token, expires, err := gen.MakeToken()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500000000+15*60), expires.Unix())
+
+	assert.True(t, strings.HasPrefix(token, "db.example.com:5432/?Action=connect&"))
+	parsed, err := url.Parse("https://" + token)
+	assert.NoError(t, err)
+	query := parsed.Query()
+	assert.Equal(t, "connect", query.Get("Action"))
+	assert.Equal(t, "iamuser", query.Get("DBUser"))
+	assert.Equal(t, "900", query.Get("X-Amz-Expires"))
+	assert.Equal(t, "20170714T024000Z", query.Get("X-Amz-Date"))
+	assert.Equal(t, "AKID/20170714/us-mars-1/rds-db/aws4_request",
+		query.Get("X-Amz-Credential"))
+	assert.NotEmpty(t, query.Get("X-Amz-Signature"))
+
+	// Signing is deterministic
+	token2, _, err := gen.MakeToken()
+	assert.NoError(t, err)
+	assert.Equal(t, token, token2)
+}
+
+func TestParseIamConnString(t *testing.T) {
+	instance, host, port, db, user, err := parseIamConnString(
+		"rds-iam:mydb:postgres:iamuser")
+	assert.NoError(t, err)
+	assert.Equal(t, "mydb", instance)
+	assert.Equal(t, "", host)
+	assert.Equal(t, "postgres", db)
+	assert.Equal(t, "iamuser", user)
+
+	instance, host, port, db, user, err = parseIamConnString(
+		"rds-iam:db.example.com:5433:postgres:iamuser")
+	assert.NoError(t, err)
+	assert.Equal(t, "", instance)
+	assert.Equal(t, "db.example.com", host)
+	assert.Equal(t, int32(5433), port)
+
+	_, _, _, _, _, err = parseIamConnString("rds-iam:host:badport:db:user")
+	assert.Error(t, err)
+	_, _, _, _, _, err = parseIamConnString("rds-iam:db")
+	assert.Error(t, err)
+}
+
+func TestIamConnector(t *testing.T) {
+	server, err := nrsqltest.NewFakePgServer(func(user, password string) bool {
+		return user == "iamuser" && strings.Contains(password,
+			"Action=connect&DBUser=iamuser")
+	})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	mock := utils.NewAwsMockHandler()
+	mock.AddHandler(func(ctx context.Context, input *rds.DescribeDBInstancesInput) (
+		*rds.DescribeDBInstancesOutput, error) {
+		assert.Equal(t, "mydb", *input.DBInstanceIdentifier)
+		return &rds.DescribeDBInstancesOutput{
+			DBInstances: []rds.DBInstance{{
+				Endpoint: &rds.Endpoint{
+					Address: aws.String(server.Host()),
+					Port:    aws.Int64(int64(server.Port())),
+				},
+			}},
+		}, nil
+	})
+
+	ctx := context.Background()
+	conn, err := MakePgConnector(ctx, "rds-iam:mydb:postgres:iamuser",
+		server.CaPath(), mock.AwsConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.ConnectionCount())
+
+	// The token is re-generated once it's close to the expiration
+	now := time.Now()
+	conn.credentials.clock = func() time.Time { return now }
+	conn.settings.provider.(*IamCredentials).Tokens.Clock = func() time.Time { return now }
+	creds, err := conn.credentials.Get(ctx)
+	assert.NoError(t, err)
+
+	now = now.Add(IamTokenRefreshInterval + time.Second)
+	newCreds, err := conn.credentials.Get(ctx)
+	assert.NoError(t, err)
+	assert.NotEqual(t, creds.Password, newCreds.Password)
+	assert.NoError(t, conn.Ping(ctx))
+	assert.Equal(t, 2, server.ConnectionCount())
+	assert.Equal(t, 0, server.AuthFailureCount())
+}
@@ -0,0 +1,93 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// Make the "migrate" command that applies the migrations from the file system
+// (usually an embedded one). The --dir flag overrides the migrations source.
+func MakeMigrateCmd(fs http.FileSystem, dir string) *cobra.Command {
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Applies the database schema migrations",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return utils.CheckRequiredFlags(cmd)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger, err := zap.NewDevelopment()
+			if err != nil {
+				return err
+			}
+			ctx := visibility.ImbueContext(context.Background(), logger)
+
+			// The override must not stick to the later runs
+			srcFs, srcDir := fs, dir
+			if overrideDir := utils.GetFlagS(cmd, "dir"); overrideDir != "" {
+				srcFs, srcDir = http.Dir(overrideDir), "/"
+			}
+			migrations, err := LoadMigrations(srcFs, srcDir)
+			if err != nil {
+				return err
+			}
+
+			config, err := external.LoadDefaultAWSConfig()
+			if err != nil {
+				return err
+			}
+			connector, err := MakePgConnector(ctx, utils.GetFlagS(cmd, "db"),
+				utils.GetFlagS(cmd, "ssl-ca"), config)
+			if err != nil {
+				return err
+			}
+			db := sql.OpenDB(connector)
+			//noinspection GoUnhandledErrorResult
+			defer db.Close()
+
+			return RunMigrations(ctx, db, migrations, utils.GetFlagB(cmd, "dry-run"),
+				int(utils.GetFlagI(cmd, "down")))
+		},
+	}
+
+	migrateCmd.Flags().String("db", "", "The database connection string")
+	migrateCmd.Flags().String("ssl-ca", "", "The path to the database CA certificate")
+	migrateCmd.Flags().String("dir", "", "Load the migrations from this directory")
+	migrateCmd.Flags().Bool("dry-run", false, "Only show the migrations to apply")
+	migrateCmd.Flags().Int64("down", 0, "Revert this many last migrations")
+	_ = migrateCmd.MarkFlagRequired("db")
+
+	return migrateCmd
+}
+
+// Apply the migrations, or revert the downSteps last ones if downSteps > 0
+func RunMigrations(ctx context.Context, db *sql.DB, migrations []*Migration,
+	dryRun bool, downSteps int) error {
+
+	runner := NewMigrationRunner(db, migrations)
+	runner.DryRun = dryRun
+
+	var done []*Migration
+	var err error
+	if downSteps > 0 {
+		done, err = runner.Down(ctx, downSteps)
+	} else {
+		done, err = runner.Up(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(done) == 0 {
+		visibility.CL(ctx).Info("The schema is up to date")
+	}
+	for _, mig := range done {
+		visibility.CLS(ctx).Infof("Done: %d_%s", mig.Version, mig.Name)
+	}
+	return nil
+}
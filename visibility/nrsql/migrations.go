@@ -0,0 +1,353 @@
+package nrsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/lib/pq"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const DefaultMigrationsTable = "schema_migrations"
+
+// A versioned schema migration, loaded from the <version>_<name>.up.sql and
+// the optional <version>_<name>.down.sql files. The <version>_<name>.sql
+// files are treated as up-migrations.
+type Migration struct {
+	Version  int64
+	Name     string
+	Up, Down string
+}
+
+// The checksum of the up-migration, it's recorded for the applied migrations
+// to detect the files that were changed after they had been applied.
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_(.+?)(\.up|\.down)?\.sql$`)
+
+// Load the migrations from the directory of the file system, the http.Dir and
+// the http.FS-wrapped embedded file systems both work. The files that don't
+// look like migrations are ignored.
+func LoadMigrations(fs http.FileSystem, dir string) ([]*Migration, error) {
+	dirFile, err := fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer dirFile.Close()
+
+	infos, err := dirFile.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, info := range infos {
+		match := migrationFileRe.FindStringSubmatch(info.Name())
+		if info.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad migration version in %s", info.Name())
+		}
+
+		data, err := readMigrationFile(fs, path.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != match[2] {
+			return nil, fmt.Errorf("conflicting names for the migration %d: %s and %s",
+				version, mig.Name, match[2])
+		}
+
+		target := &mig.Up
+		if match[3] == ".down" {
+			target = &mig.Down
+		}
+		if *target != "" {
+			return nil, fmt.Errorf("duplicate migration file %s", info.Name())
+		}
+		*target = data
+	}
+
+	var res []*Migration
+	for _, mig := range byVersion {
+		if mig.Up == "" {
+			return nil, fmt.Errorf("no up-migration for the version %d", mig.Version)
+		}
+		res = append(res, mig)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// Load the migrations from the directory on the disk
+func LoadMigrationsFromDir(dir string) ([]*Migration, error) {
+	return LoadMigrations(http.Dir(dir), "/")
+}
+
+func readMigrationFile(fs http.FileSystem, name string) (string, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Applies the migrations, each one in its own transaction. The runner holds
+// a Postgres advisory lock while working, so only one instance migrates the
+// database at a time.
+type MigrationRunner struct {
+	DB         *sql.DB
+	Migrations []*Migration
+	// The table with the applied versions, DefaultMigrationsTable by default
+	Table string
+	// Only log what would be done, without changing anything
+	DryRun bool
+}
+
+func NewMigrationRunner(db *sql.DB, migrations []*Migration) *MigrationRunner {
+	return &MigrationRunner{
+		DB:         db,
+		Migrations: migrations,
+		Table:      DefaultMigrationsTable,
+	}
+}
+
+type appliedMigration struct {
+	version  int64
+	checksum string
+}
+
+// The advisory lock key, it's derived from the table name so that several
+// independent schemas in the same database don't block each other.
+func (m *MigrationRunner) lockKey() int64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte("nrsql-migrations:" + m.Table))
+	return int64(h.Sum64())
+}
+
+// Run the function with the advisory lock held on a dedicated connection
+func (m *MigrationRunner) withLock(ctx context.Context,
+	fn func(conn *sql.Conn) error) error {
+
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer conn.Close()
+
+	visibility.CL(ctx).Info("Acquiring the migrations lock")
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", m.lockKey())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = conn.ExecContext(context.Background(),
+			"SELECT pg_advisory_unlock($1)", m.lockKey())
+	}()
+
+	return fn(conn)
+}
+
+func (m *MigrationRunner) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	if m.DryRun {
+		return nil
+	}
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+
+		pq.QuoteIdentifier(m.Table)+` (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	return err
+}
+
+// Get the applied migrations in the version order
+func (m *MigrationRunner) getApplied(ctx context.Context,
+	conn *sql.Conn) ([]appliedMigration, error) {
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, checksum FROM "+
+		pq.QuoteIdentifier(m.Table)+" ORDER BY version")
+	if err != nil {
+		// The table is not created in the dry-run mode
+		if pqErr, ok := err.(*pq.Error); ok && m.DryRun &&
+			pqErr.Code.Name() == "undefined_table" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer rows.Close()
+
+	var res []appliedMigration
+	for rows.Next() {
+		var am appliedMigration
+		err = rows.Scan(&am.version, &am.checksum)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, am)
+	}
+	return res, rows.Err()
+}
+
+func (m *MigrationRunner) findMigration(version int64) *Migration {
+	for _, mig := range m.Migrations {
+		if mig.Version == version {
+			return mig
+		}
+	}
+	return nil
+}
+
+// Apply the pending migrations, returns the applied ones. The checksums of
+// the already applied migrations are verified first.
+func (m *MigrationRunner) Up(ctx context.Context) ([]*Migration, error) {
+	var res []*Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		err := m.ensureTable(ctx, conn)
+		if err != nil {
+			return err
+		}
+		applied, err := m.getApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		done := make(map[int64]bool)
+		for _, am := range applied {
+			mig := m.findMigration(am.version)
+			if mig == nil {
+				return fmt.Errorf("the applied migration %d is missing", am.version)
+			}
+			if mig.Checksum() != am.checksum {
+				return fmt.Errorf("the migration %d_%s was changed after it "+
+					"had been applied", mig.Version, mig.Name)
+			}
+			done[am.version] = true
+		}
+
+		for _, mig := range m.Migrations {
+			if done[mig.Version] {
+				continue
+			}
+			err = m.apply(ctx, conn, mig, true)
+			if err != nil {
+				return err
+			}
+			res = append(res, mig)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// Revert the given number of the last applied migrations, returns the
+// reverted ones.
+func (m *MigrationRunner) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	var res []*Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		err := m.ensureTable(ctx, conn)
+		if err != nil {
+			return err
+		}
+		applied, err := m.getApplied(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(applied) - 1; i >= 0 && len(res) < steps; i-- {
+			mig := m.findMigration(applied[i].version)
+			if mig == nil {
+				return fmt.Errorf("the applied migration %d is missing",
+					applied[i].version)
+			}
+			if mig.Down == "" {
+				return fmt.Errorf("no down-migration for %d_%s", mig.Version, mig.Name)
+			}
+			err = m.apply(ctx, conn, mig, false)
+			if err != nil {
+				return err
+			}
+			res = append(res, mig)
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (m *MigrationRunner) apply(ctx context.Context, conn *sql.Conn,
+	mig *Migration, up bool) error {
+
+	direction, script := "up", mig.Up
+	if !up {
+		direction, script = "down", mig.Down
+	}
+
+	if m.DryRun {
+		visibility.CLS(ctx).Infof("Would apply the %s-migration %d_%s:\n%s", direction,
+			mig.Version, mig.Name, script)
+		return nil
+	}
+	visibility.CLS(ctx).Infof("Applying the %s-migration %d_%s", direction,
+		mig.Version, mig.Name)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return fmt.Errorf("the %s-migration %d_%s failed: %v", direction,
+			mig.Version, mig.Name, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO "+pq.QuoteIdentifier(m.Table)+
+			" (version, name, checksum) VALUES ($1, $2, $3)",
+			mig.Version, mig.Name, mig.Checksum())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM "+pq.QuoteIdentifier(m.Table)+
+			" WHERE version = $1", mig.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
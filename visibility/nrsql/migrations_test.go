@@ -0,0 +1,241 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Just enough of the migrations table semantics, with transactions
+type fakeMigrationsDb struct {
+	mtx      sync.Mutex
+	applied  map[int64]string
+	pending  map[int64]string
+	deleted  map[int64]bool
+	scripts  []string
+	hasTable bool
+	locks    int
+}
+
+func (f *fakeMigrationsDb) handle(q nrsqltest.FakePgQuery) (*nrsqltest.FakePgResult, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	switch {
+	case strings.HasPrefix(q.SQL, "SELECT version, checksum"):
+		if !f.hasTable {
+			return nil, &pq.Error{Code: "42P01", Message: "no table"}
+		}
+		res := &nrsqltest.FakePgResult{Columns: []string{"version", "checksum"}}
+		if q.Describe {
+			return res, nil
+		}
+		var versions []int64
+		for v := range f.applied {
+			versions = append(versions, v)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+		for _, v := range versions {
+			res.Rows = append(res.Rows, []string{strconv.FormatInt(v, 10), f.applied[v]})
+		}
+		return res, nil
+	case q.Describe:
+		return &nrsqltest.FakePgResult{}, nil
+	case strings.HasPrefix(q.SQL, "SELECT pg_advisory_lock"):
+		f.locks++
+	case strings.HasPrefix(q.SQL, "SELECT pg_advisory_unlock"):
+		f.locks--
+	case strings.HasPrefix(q.SQL, "CREATE TABLE IF NOT EXISTS"):
+		f.hasTable = true
+	case strings.HasPrefix(q.SQL, "INSERT INTO"):
+		version, _ := strconv.ParseInt(q.Args[0], 10, 64)
+		f.pending[version] = q.Args[2]
+	case strings.HasPrefix(q.SQL, "DELETE FROM"):
+		version, _ := strconv.ParseInt(q.Args[0], 10, 64)
+		f.deleted[version] = true
+	case strings.HasPrefix(q.SQL, "BEGIN"):
+		f.pending, f.deleted = map[int64]string{}, map[int64]bool{}
+	case q.SQL == "COMMIT":
+		for k, v := range f.pending {
+			f.applied[k] = v
+		}
+		for k := range f.deleted {
+			delete(f.applied, k)
+		}
+	case q.SQL == "ROLLBACK":
+	default:
+		if strings.Contains(q.SQL, "FAIL") {
+			return nil, fmt.Errorf("syntax error")
+		}
+		f.scripts = append(f.scripts, q.SQL)
+	}
+	return &nrsqltest.FakePgResult{}, nil
+}
+
+func (f *fakeMigrationsDb) takeScripts() []string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	res := f.scripts
+	f.scripts = nil
+	return res
+}
+
+func writeMigrations(t *testing.T, dir string, files map[string]string) {
+	for name, data := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600))
+	}
+}
+
+func setupMigrations(t *testing.T) (string, *nrsqltest.FakePgServer, *fakeMigrationsDb, *sql.DB) {
+	dir, err := ioutil.TempDir("", "migrations")
+	assert.NoError(t, err)
+	writeMigrations(t, dir, map[string]string{
+		"001_init.up.sql":   "CREATE TABLE a()",
+		"001_init.down.sql": "DROP TABLE a",
+		"002_b.sql":         "CREATE TABLE b()",
+		"README.md":         "Not a migration",
+	})
+
+	server, err := nrsqltest.NewFakePgServer(func(user, password string) bool {
+		return true
+	})
+	assert.NoError(t, err)
+	fake := &fakeMigrationsDb{applied: map[int64]string{}}
+	server.SetQueryHandler(fake.handle)
+
+	conn, err := MakePgConnector(context.Background(),
+		server.ConnString("user", "pass", "db"), "", aws.Config{})
+	assert.NoError(t, err)
+
+	return dir, server, fake, sql.OpenDB(conn)
+}
+
+func TestLoadMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeMigrations(t, dir, map[string]string{
+		"10_second.up.sql": "SELECT 2",
+		"9_first.sql":      "SELECT 1",
+		"9_first.down.sql": "SELECT -1",
+		"notes.txt":        "",
+	})
+	migrations, err := LoadMigrations(http.Dir(dir), "/")
+	assert.NoError(t, err)
+	assert.Equal(t, []*Migration{
+		{Version: 9, Name: "first", Up: "SELECT 1", Down: "SELECT -1"},
+		{Version: 10, Name: "second", Up: "SELECT 2"},
+	}, migrations)
+
+	writeMigrations(t, dir, map[string]string{"11_third.down.sql": "SELECT 3"})
+	_, err = LoadMigrationsFromDir(dir)
+	assert.Error(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "11_third.down.sql")))
+
+	writeMigrations(t, dir, map[string]string{"10_other.sql": "SELECT 3"})
+	_, err = LoadMigrationsFromDir(dir)
+	assert.Error(t, err)
+}
+
+func TestMigrationRunner(t *testing.T) {
+	dir, server, fake, db := setupMigrations(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+	defer db.Close()
+
+	ctx := visibility.ImbueContext(context.Background(), zap.NewNop())
+	migrations, err := LoadMigrationsFromDir(dir)
+	assert.NoError(t, err)
+	runner := NewMigrationRunner(db, migrations)
+
+	// Dry run doesn't change anything
+	runner.DryRun = true
+	done, err := runner.Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(done))
+	assert.Equal(t, 0, len(fake.takeScripts()))
+	assert.False(t, fake.hasTable)
+
+	runner.DryRun = false
+	done, err = runner.Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(done))
+	assert.Equal(t, []string{"CREATE TABLE a()", "CREATE TABLE b()"}, fake.takeScripts())
+	assert.Equal(t, migrations[0].Checksum(), fake.applied[1])
+	assert.Equal(t, 0, fake.locks)
+
+	// Everything is applied
+	done, err = runner.Up(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(done))
+
+	// The failed migration is not recorded
+	runner.Migrations = append(runner.Migrations, &Migration{Version: 3,
+		Name: "bad", Up: "FAIL"})
+	_, err = runner.Up(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(fake.applied))
+	runner.Migrations = migrations
+
+	// No down-migration for the version 2
+	_, err = runner.Down(ctx, 1)
+	assert.Error(t, err)
+	migrations[1].Down = "DROP TABLE b"
+	done, err = runner.Down(ctx, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(done))
+	assert.Equal(t, []string{"DROP TABLE b", "DROP TABLE a"}, fake.takeScripts())
+	assert.Equal(t, 0, len(fake.applied))
+
+	// The changed migrations are detected
+	_, err = runner.Up(ctx)
+	assert.NoError(t, err)
+	migrations[0].Up = "CREATE TABLE a(id int)"
+	_, err = runner.Up(ctx)
+	assert.Error(t, err)
+}
+
+func TestMigrateCmd(t *testing.T) {
+	dir, server, fake, db := setupMigrations(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+	defer db.Close()
+
+	cmd := MakeMigrateCmd(http.Dir("/nonexistent"), "/")
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	cmd.SetArgs([]string{"--dir", dir})
+	assert.Error(t, cmd.Execute())
+
+	cmd.SetArgs([]string{"--db", server.ConnString("user", "pass", "db"),
+		"--dir", dir})
+	assert.NoError(t, cmd.Execute())
+	assert.Equal(t, 2, len(fake.applied))
+
+	cmd.SetArgs([]string{"--db", server.ConnString("user", "pass", "db"),
+		"--dir", dir, "--down", "1"})
+	assert.Error(t, cmd.Execute()) // No down-migration for the version 2
+	assert.Equal(t, 2, len(fake.applied))
+
+	// Without the override the default file system is used again
+	cmd.SetArgs([]string{"--db", server.ConnString("user", "pass", "db"),
+		"--dir", "", "--down", "0"})
+	err := cmd.Execute()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "nonexistent")
+}
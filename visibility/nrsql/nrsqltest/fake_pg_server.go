@@ -0,0 +1,716 @@
+package nrsqltest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"github.com/lib/pq"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pgProtocolVersion = 196608
+	pgSslRequestCode  = 80877103
+	pgTextOid         = 25
+)
+
+// A query received by the FakePgServer. Extended-protocol statements are first
+// described (with Describe set to true and no arguments), the handler must
+// return the result columns without executing the query in this case.
+type FakePgQuery struct {
+	SQL      string
+	Args     []string
+	Describe bool
+}
+
+// The first keyword of the query in the upper case, the leading comments are
+// skipped
+func (q FakePgQuery) Verb() string {
+	return strings.ToUpper(firstPgWord(q.SQL))
+}
+
+// The row value that is sent as NULL
+const PgNull = "\x00NULL"
+
+// The result of a query, all the values are sent in the text format. The command
+// tag is synthesized from the query if it's not set explicitly.
+type FakePgResult struct {
+	Columns      []string
+	Rows         [][]string
+	RowsAffected int
+	Tag          string
+}
+
+// Handle a query, the returned error is sent to the client. Use *pq.Error to
+// control the SQLSTATE code.
+type FakePgQueryHandler func(q FakePgQuery) (*FakePgResult, error)
+
+// A fake Postgres server that speaks just enough of the wire protocol for lib/pq:
+// TLS, cleartext password authentication, simple and extended queries and
+// transaction status tracking. It's meant to test the connection handling
+// without a real database, the queries themselves are answered by
+// a FakePgQueryHandler.
+type FakePgServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	caPath    string
+	caPem     []byte
+	auth      func(user, password string) bool
+
+	mtx          sync.Mutex
+	handler      FakePgQueryHandler
+	conns        map[net.Conn]bool
+	numConnected int
+	numAuthFails int
+	nextPid      int32
+
+	running sync.WaitGroup
+}
+
+// Start the fake server on a random localhost port. The auth function decides
+// whether the user/password pair is accepted.
+func NewFakePgServer(auth func(user, password string) bool) (*FakePgServer, error) {
+	tlsConfig, caPem, err := makeSelfSignedTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	caFile, err := ioutil.TempFile("", "fake-pg-ca-*.pem")
+	if err != nil {
+		return nil, err
+	}
+	_, err = caFile.Write(caPem)
+	_ = caFile.Close()
+	if err != nil {
+		_ = os.Remove(caFile.Name())
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		_ = os.Remove(caFile.Name())
+		return nil, err
+	}
+
+	res := &FakePgServer{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+		caPath:    caFile.Name(),
+		caPem:     caPem,
+		auth:      auth,
+		conns:     make(map[net.Conn]bool),
+	}
+	res.running.Add(1)
+	go res.acceptLoop()
+
+	return res, nil
+}
+
+func (s *FakePgServer) Host() string {
+	return "127.0.0.1"
+}
+
+func (s *FakePgServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+// The path to the PEM file with the CA certificate of the server, it can be used
+// as the sslrootcert for the verify-full mode.
+func (s *FakePgServer) CaPath() string {
+	return s.caPath
+}
+
+// The PEM-encoded CA certificate of the server
+func (s *FakePgServer) CaPem() []byte {
+	return s.caPem
+}
+
+// Make a regular (non-RDS) connection string for the server
+func (s *FakePgServer) ConnString(user, password, dbName string) string {
+	return fmt.Sprintf("host=%s port=%d database=%s user=%s password=%s "+
+		"sslmode=verify-full sslrootcert=%s", s.Host(), s.Port(), dbName, user,
+		password, s.caPath)
+}
+
+func (s *FakePgServer) SetQueryHandler(handler FakePgQueryHandler) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.handler = handler
+}
+
+// The number of successfully authenticated connections so far
+func (s *FakePgServer) ConnectionCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.numConnected
+}
+
+// The number of rejected authentication attempts so far
+func (s *FakePgServer) AuthFailureCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.numAuthFails
+}
+
+// Forcibly close all the open connections, simulating a server restart
+func (s *FakePgServer) DropConnections() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func (s *FakePgServer) Close() {
+	_ = s.listener.Close()
+	s.DropConnections()
+	s.running.Wait()
+	_ = os.Remove(s.caPath)
+}
+
+func (s *FakePgServer) acceptLoop() {
+	defer s.running.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		s.conns[conn] = true
+		s.nextPid++
+		pid := s.nextPid
+		s.running.Add(1)
+		s.mtx.Unlock()
+
+		go func() {
+			defer s.running.Done()
+			fc := &fakePgConn{server: s, conn: conn, pid: pid, txStatus: 'I',
+				statements: make(map[string]string)}
+			defer func() { s.forget(fc.conn) }()
+			fc.serve()
+		}()
+	}
+}
+
+func (s *FakePgServer) forget(conn net.Conn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_ = conn.Close()
+	delete(s.conns, conn)
+}
+
+func (s *FakePgServer) track(raw, wrapped net.Conn) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	// Closing the TLS wrapper also closes the raw connection
+	delete(s.conns, raw)
+	s.conns[wrapped] = true
+}
+
+func (s *FakePgServer) runQuery(q FakePgQuery) (*FakePgResult, error) {
+	s.mtx.Lock()
+	handler := s.handler
+	s.mtx.Unlock()
+
+	if handler == nil {
+		return &FakePgResult{}, nil
+	}
+	res, err := handler(q)
+	if err == nil && res == nil {
+		res = &FakePgResult{}
+	}
+	return res, err
+}
+
+type fakePgPortal struct {
+	sql  string
+	args []string
+}
+
+type fakePgConn struct {
+	server   *FakePgServer
+	conn     net.Conn
+	pid      int32
+	txStatus byte
+
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	statements map[string]string
+	portal     fakePgPortal
+	// An error in the extended protocol skips messages until Sync
+	failed bool
+}
+
+func (c *fakePgConn) serve() {
+	c.reader = bufio.NewReader(c.conn)
+	c.writer = bufio.NewWriter(c.conn)
+
+	params, ok := c.readStartup()
+	if !ok {
+		return
+	}
+	if !c.authenticate(params["user"]) {
+		return
+	}
+
+	for {
+		typ, body, err := c.readMessage()
+		if err != nil {
+			return
+		}
+		if typ == 'X' {
+			return
+		}
+		c.processMessage(typ, body)
+		if c.writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (c *fakePgConn) readStartup() (map[string]string, bool) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(c.reader, hdr[:]); err != nil {
+			return nil, false
+		}
+		length := int(binary.BigEndian.Uint32(hdr[:4]))
+		code := binary.BigEndian.Uint32(hdr[4:])
+		if length < 8 || length > 10000 {
+			return nil, false
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(c.reader, body); err != nil {
+			return nil, false
+		}
+
+		switch code {
+		case pgSslRequestCode:
+			if _, err := c.conn.Write([]byte{'S'}); err != nil {
+				return nil, false
+			}
+			tlsConn := tls.Server(c.conn, c.server.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, false
+			}
+			c.server.track(c.conn, tlsConn)
+			c.conn = tlsConn
+			c.reader = bufio.NewReader(tlsConn)
+			c.writer = bufio.NewWriter(tlsConn)
+		case pgProtocolVersion:
+			params := make(map[string]string)
+			fields := strings.Split(string(body), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				params[fields[i]] = fields[i+1]
+			}
+			return params, true
+		default:
+			// Cancellation requests and unknown protocols
+			return nil, false
+		}
+	}
+}
+
+func (c *fakePgConn) authenticate(user string) bool {
+	c.send('R', pgInt32(3)) // AuthenticationCleartextPassword
+	if c.writer.Flush() != nil {
+		return false
+	}
+
+	typ, body, err := c.readMessage()
+	if err != nil || typ != 'p' {
+		return false
+	}
+	password := strings.TrimSuffix(string(body), "\x00")
+
+	s := c.server
+	if s.auth != nil && !s.auth(user, password) {
+		s.mtx.Lock()
+		s.numAuthFails++
+		s.mtx.Unlock()
+
+		c.sendError("FATAL", &pq.Error{Code: "28P01", Message: fmt.Sprintf(
+			"password authentication failed for user \"%s\"", user)})
+		_ = c.writer.Flush()
+		return false
+	}
+
+	s.mtx.Lock()
+	s.numConnected++
+	s.mtx.Unlock()
+
+	c.send('R', pgInt32(0)) // AuthenticationOk
+	for _, kv := range [][2]string{{"server_version", "11.5"},
+		{"client_encoding", "UTF8"}, {"DateStyle", "ISO, MDY"},
+		{"TimeZone", "UTC"}, {"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"}} {
+		c.send('S', append(pgString(kv[0]), pgString(kv[1])...))
+	}
+	c.send('K', append(pgInt32(c.pid), pgInt32(c.pid*7)...))
+	c.send('Z', []byte{c.txStatus})
+	return c.writer.Flush() == nil
+}
+
+func (c *fakePgConn) processMessage(typ byte, body []byte) {
+	if c.failed && typ != 'S' {
+		return
+	}
+	buf := bytes.NewBuffer(body)
+
+	switch typ {
+	case 'Q':
+		query := readPgString(buf)
+		if strings.TrimSpace(query) == "" {
+			c.send('I', nil)
+		} else {
+			res, err := c.execute(FakePgQuery{SQL: query})
+			if err == nil {
+				if len(res.Columns) != 0 {
+					c.sendRowDescription(res.Columns)
+				}
+				c.sendRows(query, res)
+			}
+		}
+		// The simple query protocol has an implicit Sync
+		c.failed = false
+		c.send('Z', []byte{c.txStatus})
+	case 'P':
+		name := readPgString(buf)
+		c.statements[name] = readPgString(buf)
+		c.send('1', nil)
+	case 'D':
+		kind, _ := buf.ReadByte()
+		name := readPgString(buf)
+		query := FakePgQuery{SQL: c.statements[name], Describe: true}
+		if kind == 'S' {
+			numParams := countPgParams(query.SQL)
+			desc := pgInt16(numParams)
+			for i := 0; i < numParams; i++ {
+				desc = append(desc, pgInt32(pgTextOid)...)
+			}
+			c.send('t', desc)
+		} else {
+			query.SQL = c.portal.sql
+		}
+		res, err := c.server.runQuery(query)
+		if err != nil {
+			c.failWith(err)
+			return
+		}
+		c.sendRowDescription(res.Columns)
+	case 'B':
+		stmtName, args, err := readPgBind(buf)
+		if err != nil {
+			c.failWith(err)
+			return
+		}
+		c.portal = fakePgPortal{sql: c.statements[stmtName], args: args}
+		c.send('2', nil)
+	case 'E':
+		res, err := c.execute(FakePgQuery{SQL: c.portal.sql, Args: c.portal.args})
+		if err == nil {
+			c.sendRows(c.portal.sql, res)
+		}
+	case 'C':
+		c.send('3', nil)
+	case 'S':
+		c.failed = false
+		c.send('Z', []byte{c.txStatus})
+	case 'H':
+		// Flush, nothing to do
+	default:
+		c.failWith(fmt.Errorf("unsupported message type %q", typ))
+	}
+}
+
+func (c *fakePgConn) execute(q FakePgQuery) (*FakePgResult, error) {
+	verb := q.Verb()
+	if c.txStatus == 'E' && verb != "ROLLBACK" && verb != "COMMIT" {
+		err := &pq.Error{Code: "25P02", Message: "current transaction is " +
+			"aborted, commands ignored until end of transaction block"}
+		c.failWith(err)
+		return nil, err
+	}
+
+	res, err := c.server.runQuery(q)
+	if err != nil {
+		c.failWith(err)
+		return nil, err
+	}
+
+	switch verb {
+	case "BEGIN", "START":
+		c.txStatus = 'T'
+	case "COMMIT", "END":
+		if c.txStatus == 'E' && res.Tag == "" {
+			res.Tag = "ROLLBACK"
+		}
+		c.txStatus = 'I'
+	case "ROLLBACK", "ABORT":
+		c.txStatus = 'I'
+	}
+	return res, nil
+}
+
+func (c *fakePgConn) failWith(err error) {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		pqErr = &pq.Error{Code: "XX000", Message: err.Error()}
+	}
+	c.sendError("ERROR", pqErr)
+	if c.txStatus == 'T' {
+		c.txStatus = 'E'
+	}
+	c.failed = true
+}
+
+func (c *fakePgConn) sendRowDescription(columns []string) {
+	if len(columns) == 0 {
+		c.send('n', nil)
+		return
+	}
+	desc := pgInt16(len(columns))
+	for _, col := range columns {
+		desc = append(desc, pgString(col)...)
+		desc = append(desc, pgInt32(0)...)         // Table OID
+		desc = append(desc, pgInt16(0)...)         // Column number
+		desc = append(desc, pgInt32(pgTextOid)...) // Type OID
+		desc = append(desc, pgInt16(-1)...)        // Type length
+		desc = append(desc, pgInt32(-1)...)        // Type modifier
+		desc = append(desc, pgInt16(0)...)         // Text format
+	}
+	c.send('T', desc)
+}
+
+func (c *fakePgConn) sendRows(query string, res *FakePgResult) {
+	for _, row := range res.Rows {
+		data := pgInt16(len(row))
+		for _, val := range row {
+			if val == PgNull {
+				data = append(data, pgInt32(-1)...)
+				continue
+			}
+			data = append(data, pgInt32(int32(len(val)))...)
+			data = append(data, val...)
+		}
+		c.send('D', data)
+	}
+
+	tag := res.Tag
+	if tag == "" {
+		tag = makePgCommandTag(query, res)
+	}
+	c.send('C', pgString(tag))
+}
+
+func (c *fakePgConn) sendError(severity string, err *pq.Error) {
+	var data []byte
+	for _, f := range []struct {
+		code byte
+		val  string
+	}{{'S', severity}, {'V', severity}, {'C', string(err.Code)},
+		{'M', err.Message}} {
+		data = append(data, f.code)
+		data = append(data, pgString(f.val)...)
+	}
+	data = append(data, 0)
+	c.send('E', data)
+}
+
+func (c *fakePgConn) send(typ byte, payload []byte) {
+	_ = c.writer.WriteByte(typ)
+	_, _ = c.writer.Write(pgInt32(int32(len(payload) + 4)))
+	_, _ = c.writer.Write(payload)
+}
+
+func (c *fakePgConn) readMessage() (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.reader, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint32(hdr[1:]))
+	if length < 4 {
+		return 0, nil, fmt.Errorf("bad message length %d", length)
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], body, nil
+}
+
+func makePgCommandTag(query string, res *FakePgResult) string {
+	verb := strings.ToUpper(firstPgWord(query))
+	switch verb {
+	case "SELECT", "WITH", "SHOW", "VALUES":
+		return "SELECT " + strconv.Itoa(len(res.Rows))
+	case "INSERT":
+		return "INSERT 0 " + strconv.Itoa(res.RowsAffected)
+	case "UPDATE", "DELETE":
+		return verb + " " + strconv.Itoa(res.RowsAffected)
+	case "START":
+		return "BEGIN"
+	case "END":
+		return "COMMIT"
+	case "ABORT":
+		return "ROLLBACK"
+	}
+	return verb
+}
+
+func firstPgWord(query string) string {
+	// Skip the leading comments
+	for {
+		query = strings.TrimSpace(query)
+		if strings.HasPrefix(query, "/*") && strings.Contains(query, "*/") {
+			query = query[strings.Index(query, "*/")+2:]
+		} else if strings.HasPrefix(query, "--") && strings.Contains(query, "\n") {
+			query = query[strings.Index(query, "\n")+1:]
+		} else {
+			break
+		}
+	}
+
+	fields := strings.FieldsFunc(query, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == ';' || r == '('
+	})
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// Find the largest $N placeholder in the query
+func countPgParams(query string) int {
+	res := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] != '$' {
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		if n, err := strconv.Atoi(query[i+1 : j]); err == nil && n > res {
+			res = n
+		}
+	}
+	return res
+}
+
+func pgInt32(v int32) []byte {
+	var res [4]byte
+	binary.BigEndian.PutUint32(res[:], uint32(v))
+	return res[:]
+}
+
+func pgInt16(v int) []byte {
+	var res [2]byte
+	binary.BigEndian.PutUint16(res[:], uint16(v))
+	return res[:]
+}
+
+func pgString(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+func readPgString(buf *bytes.Buffer) string {
+	s, err := buf.ReadString(0)
+	if err != nil {
+		return s
+	}
+	return s[:len(s)-1]
+}
+
+func readPgInt16(buf *bytes.Buffer) int {
+	data := buf.Next(2)
+	if len(data) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(data))
+}
+
+// Read the statement name and the arguments of the Bind message, the result
+// formats are ignored
+func readPgBind(buf *bytes.Buffer) (string, []string, error) {
+	truncated := &pq.Error{Code: "08P01", Message: "truncated Bind message"}
+
+	_ = readPgString(buf) // Portal name, we support only the unnamed one
+	stmtName := readPgString(buf)
+	if buf.Len() < 2 {
+		return "", nil, truncated
+	}
+	numFormats := readPgInt16(buf)
+	if buf.Len() < 2*numFormats+2 {
+		return "", nil, truncated
+	}
+	buf.Next(2 * numFormats)
+
+	numArgs := readPgInt16(buf)
+	var args []string
+	for i := 0; i < numArgs; i++ {
+		if buf.Len() < 4 {
+			return "", nil, truncated
+		}
+		l := int32(binary.BigEndian.Uint32(buf.Next(4)))
+		if l < 0 {
+			args = append(args, "")
+			continue
+		}
+		if buf.Len() < int(l) {
+			return "", nil, truncated
+		}
+		args = append(args, string(buf.Next(int(l))))
+	}
+	return stmtName, args, nil
+}
+
+// Create a self-signed certificate valid for the localhost addresses
+func makeSelfSignedTlsConfig() (*tls.Config, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "Fake Postgres CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, caPem, nil
+}
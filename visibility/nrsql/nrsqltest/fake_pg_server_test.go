@@ -0,0 +1,39 @@
+package nrsqltest
+
+import (
+	"bytes"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func makePgBind(args ...[]byte) []byte {
+	msg := append(pgString(""), pgString("stmt")...)
+	msg = append(msg, pgInt16(1)...)
+	msg = append(msg, pgInt16(0)...)
+	msg = append(msg, pgInt16(len(args))...)
+	for _, a := range args {
+		if a == nil {
+			msg = append(msg, pgInt32(-1)...)
+		} else {
+			msg = append(msg, pgInt32(int32(len(a)))...)
+			msg = append(msg, a...)
+		}
+	}
+	return msg
+}
+
+func TestReadPgBind(t *testing.T) {
+	msg := makePgBind([]byte("val"), nil)
+	name, args, err := readPgBind(bytes.NewBuffer(msg))
+	assert.NoError(t, err)
+	assert.Equal(t, "stmt", name)
+	assert.Equal(t, []string{"val", ""}, args)
+
+	// Every truncation is a protocol error, not a panic
+	for l := 0; l < len(msg); l++ {
+		_, _, err = readPgBind(bytes.NewBuffer(msg[:l]))
+		assert.Error(t, err, "length %d", l)
+		assert.Equal(t, pq.ErrorCode("08P01"), err.(*pq.Error).Code)
+	}
+}
@@ -0,0 +1,256 @@
+package nrsqltest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"sync"
+	"time"
+)
+
+// The version stages of the SecretsManager
+const (
+	stageCurrent  = "AWSCURRENT"
+	stagePending  = "AWSPENDING"
+	stagePrevious = "AWSPREVIOUS"
+)
+
+// An in-memory stand-in for the AWS SecretsManager. It's meant to be used with
+// the AwsMockHandler and supports the version stages used by the secret rotation:
+// a new secret version is first staged as AWSPENDING and then promoted to
+// AWSCURRENT, moving the old value to AWSPREVIOUS.
+type SecretsMock struct {
+	mtx      sync.Mutex
+	secrets  map[string][]*mockSecretVersion
+	requests int
+	failures int
+	failErr  error
+}
+
+type mockSecretVersion struct {
+	id      string
+	value   string
+	created time.Time
+	stages  map[string]bool
+}
+
+func NewSecretsMock() *SecretsMock {
+	return &SecretsMock{
+		secrets: make(map[string][]*mockSecretVersion),
+	}
+}
+
+// Create an aws.Config that routes the SecretsManager calls to this mock
+func (s *SecretsMock) AwsConfig() aws.Config {
+	handler := utils.NewAwsMockHandler()
+	handler.AddHandler(s)
+	return handler.AwsConfig()
+}
+
+// Make the JSON representation of an RDS secret, in the same format as
+// the one used by the RDS rotation lambdas.
+func MakeDbSecretString(host string, port int, user, password string) string {
+	return utils.MustJson(map[string]interface{}{
+		"username": user,
+		"password": password,
+		"engine":   "postgres",
+		"host":     host,
+		"port":     port,
+	})
+}
+
+// Put an RDS secret for the database, using the db/<name> naming scheme
+func (s *SecretsMock) PutDbSecret(dbName, host string, port int,
+	user, password string) string {
+	return s.PutSecret(dbSecretName(dbName),
+		MakeDbSecretString(host, port, user, password))
+}
+
+// The same naming scheme as the one used by the nrsql connectors
+func dbSecretName(dbName string) string {
+	return "db/" + dbName
+}
+
+// Put a new secret value, making it current immediately (just like the
+// PutSecretValue call without explicit stages). Returns the new version ID.
+func (s *SecretsMock) PutSecret(secretId, value string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ver := s.addVersion(secretId, value)
+	s.promote(secretId, ver)
+	return ver.id
+}
+
+// Stage the new secret value as AWSPENDING, this is the first step of the
+// secret rotation. The AWSCURRENT version is left intact.
+func (s *SecretsMock) StagePending(secretId, value string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, v := range s.secrets[secretId] {
+		delete(v.stages, stagePending)
+	}
+	ver := s.addVersion(secretId, value)
+	ver.stages[stagePending] = true
+	return ver.id
+}
+
+// Finish the rotation by promoting the AWSPENDING version to AWSCURRENT
+func (s *SecretsMock) FinishRotation(secretId string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	pending := s.findVersion(secretId, stagePending)
+	if pending == nil {
+		return fmt.Errorf("no pending version for the secret %s", secretId)
+	}
+	delete(pending.stages, stagePending)
+	s.promote(secretId, pending)
+	return nil
+}
+
+// Perform the complete rotation of the secret to the new value
+func (s *SecretsMock) Rotate(secretId, value string) string {
+	verId := s.StagePending(secretId, value)
+	err := s.FinishRotation(secretId)
+	utils.PanicIfF(err != nil, "failed to finish the rotation: %v", err)
+	return verId
+}
+
+// Get the secret value for the stage, returns an empty string if there's no
+// such value.
+func (s *SecretsMock) GetStageValue(secretId, stage string) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	ver := s.findVersion(secretId, stage)
+	if ver == nil {
+		return ""
+	}
+	return ver.value
+}
+
+// The number of GetSecretValue requests served so far
+func (s *SecretsMock) RequestCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.requests
+}
+
+// Fail the next count GetSecretValue requests with the error, e.g. to simulate
+// the throttling
+func (s *SecretsMock) FailRequests(count int, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.failures = count
+	s.failErr = err
+}
+
+// Create a credentials checker that accepts only the user/password pair from the
+// AWSCURRENT version of the RDS secret for the database.
+func (s *SecretsMock) CurrentDbCredentialsChecker(dbName string) func(user, password string) bool {
+	return func(user, password string) bool {
+		var info struct {
+			Username, Password string
+		}
+		err := json.Unmarshal([]byte(s.GetStageValue(dbSecretName(dbName),
+			stageCurrent)), &info)
+		if err != nil {
+			return false
+		}
+		return info.Username == user && info.Password == password
+	}
+}
+
+func (s *SecretsMock) GetSecretValue(ctx context.Context,
+	input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.requests++
+	if s.failures > 0 {
+		s.failures--
+		return nil, s.failErr
+	}
+
+	secretId := aws.StringValue(input.SecretId)
+	if len(s.secrets[secretId]) == 0 {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException,
+			"Secrets Manager can't find the specified secret.", nil)
+	}
+
+	var ver *mockSecretVersion
+	if input.VersionId != nil {
+		for _, v := range s.secrets[secretId] {
+			if v.id == *input.VersionId {
+				ver = v
+			}
+		}
+	} else {
+		stage := stageCurrent
+		if input.VersionStage != nil {
+			stage = *input.VersionStage
+		}
+		ver = s.findVersion(secretId, stage)
+	}
+
+	if ver == nil {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException,
+			"Secrets Manager can't find the specified secret value.", nil)
+	}
+
+	var stages []string
+	for _, st := range []string{stageCurrent, stagePending, stagePrevious} {
+		if ver.stages[st] {
+			stages = append(stages, st)
+		}
+	}
+
+	return &secretsmanager.GetSecretValueOutput{
+		ARN: aws.String("arn:aws:secretsmanager:us-mars-1:123456789012:secret:" +
+			secretId),
+		Name:          aws.String(secretId),
+		CreatedDate:   aws.Time(ver.created),
+		SecretString:  aws.String(ver.value),
+		VersionId:     aws.String(ver.id),
+		VersionStages: stages,
+	}, nil
+}
+
+func (s *SecretsMock) addVersion(secretId, value string) *mockSecretVersion {
+	ver := &mockSecretVersion{
+		id:      utils.MakeRandomStr(16),
+		value:   value,
+		created: time.Now(),
+		stages:  make(map[string]bool),
+	}
+	s.secrets[secretId] = append(s.secrets[secretId], ver)
+	return ver
+}
+
+func (s *SecretsMock) findVersion(secretId, stage string) *mockSecretVersion {
+	for _, v := range s.secrets[secretId] {
+		if v.stages[stage] {
+			return v
+		}
+	}
+	return nil
+}
+
+// Make the version current, the previously current version becomes AWSPREVIOUS
+func (s *SecretsMock) promote(secretId string, ver *mockSecretVersion) {
+	for _, v := range s.secrets[secretId] {
+		delete(v.stages, stagePrevious)
+	}
+	cur := s.findVersion(secretId, stageCurrent)
+	if cur != nil {
+		delete(cur.stages, stageCurrent)
+		cur.stages[stagePrevious] = true
+	}
+	ver.stages[stageCurrent] = true
+}
@@ -0,0 +1,84 @@
+package nrsqltest
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func getSecret(t *testing.T, sm *secretsmanager.Client, id, stage string) (
+	*secretsmanager.GetSecretValueResponse, error) {
+
+	input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)}
+	if stage != "" {
+		input.VersionStage = aws.String(stage)
+	}
+	return sm.GetSecretValueRequest(input).Send(context.Background())
+}
+
+func TestSecretsMockStages(t *testing.T) {
+	mock := NewSecretsMock()
+	sm := secretsmanager.New(mock.AwsConfig())
+
+	_, err := getSecret(t, sm, "db/missing", "")
+	assert.Error(t, err)
+
+	firstVer := mock.PutSecret("db/test", "first")
+	res, err := getSecret(t, sm, "db/test", "")
+	assert.NoError(t, err)
+	assert.Equal(t, "first", *res.SecretString)
+	assert.Equal(t, firstVer, *res.VersionId)
+	assert.Equal(t, []string{stageCurrent}, res.VersionStages)
+
+	// No previous version yet
+	_, err = getSecret(t, sm, "db/test", stagePrevious)
+	assert.Error(t, err)
+
+	// The pending version doesn't affect the current one
+	pendingVer := mock.StagePending("db/test", "second")
+	res, err = getSecret(t, sm, "db/test", stageCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", *res.SecretString)
+	res, err = getSecret(t, sm, "db/test", stagePending)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", *res.SecretString)
+	assert.Equal(t, pendingVer, *res.VersionId)
+
+	assert.NoError(t, mock.FinishRotation("db/test"))
+	assert.Error(t, mock.FinishRotation("db/test"))
+
+	assert.Equal(t, "second", mock.GetStageValue("db/test", stageCurrent))
+	assert.Equal(t, "first", mock.GetStageValue("db/test", stagePrevious))
+	assert.Equal(t, "", mock.GetStageValue("db/test", stagePending))
+
+	// Versions can be requested by their IDs
+	res, err = sm.GetSecretValueRequest(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String("db/test"), VersionId: aws.String(firstVer),
+	}).Send(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "first", *res.SecretString)
+	assert.Equal(t, []string{stagePrevious}, res.VersionStages)
+
+	mock.Rotate("db/test", "third")
+	assert.Equal(t, "third", mock.GetStageValue("db/test", stageCurrent))
+	assert.Equal(t, "second", mock.GetStageValue("db/test", stagePrevious))
+	assert.Equal(t, 6, mock.RequestCount())
+}
+
+func TestCurrentDbCredentialsChecker(t *testing.T) {
+	mock := NewSecretsMock()
+	checker := mock.CurrentDbCredentialsChecker("test")
+	assert.False(t, checker("rds", "pass1"))
+
+	mock.PutDbSecret("test", "localhost", 5432, "rds", "pass1")
+	assert.True(t, checker("rds", "pass1"))
+	assert.False(t, checker("rds", "pass2"))
+
+	mock.StagePending("db/test", MakeDbSecretString("localhost", 5432, "rds", "pass2"))
+	assert.True(t, checker("rds", "pass1"))
+	assert.NoError(t, mock.FinishRotation("db/test"))
+	assert.False(t, checker("rds", "pass1"))
+	assert.True(t, checker("rds", "pass2"))
+}
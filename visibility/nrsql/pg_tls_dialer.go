@@ -0,0 +1,145 @@
+package nrsql
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"github.com/lib/pq"
+	newrelic "github.com/newrelic/go-agent"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The code of the SSLRequest startup message
+const pgSslRequestCode = 80877103
+
+// A lib/pq dialer that negotiates TLS using an in-memory tls.Config. lib/pq
+// can only read the root certificates from a file, so the connections are
+// made with sslmode=disable and TLS is set up by the dialer instead.
+type pgTlsDialer struct {
+	ctx       context.Context
+	tlsConfig *tls.Config
+}
+
+func (d *pgTlsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(d.ctx, network, address)
+}
+
+func (d *pgTlsDialer) DialTimeout(network, address string,
+	timeout time.Duration) (net.Conn, error) {
+
+	ctx, cancel := context.WithTimeout(d.ctx, timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *pgTlsDialer) DialContext(ctx context.Context, network,
+	address string) (net.Conn, error) {
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn, err := d.negotiateTls(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (d *pgTlsDialer) negotiateTls(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		err := conn.SetDeadline(deadline)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request, 8)
+	binary.BigEndian.PutUint32(request[4:], pgSslRequestCode)
+	_, err := conn.Write(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response := make([]byte, 1)
+	_, err = conn.Read(response)
+	if err != nil {
+		return nil, err
+	}
+	if response[0] != 'S' {
+		return nil, fmt.Errorf("the server does not support SSL")
+	}
+
+	tlsConn := tls.Client(conn, d.tlsConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	// lib/pq sets its own deadline if connect_timeout is used
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// A connector that uses the pgTlsDialer
+type pgTlsConnector struct {
+	dsn       string
+	tlsConfig *tls.Config
+}
+
+func (c *pgTlsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return pq.DialOpen(&pgTlsDialer{ctx: ctx, tlsConfig: c.tlsConfig}, c.dsn)
+}
+
+func (c *pgTlsConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// Make the NewRelic-instrumented connector that verifies the server using the
+// TLS config. The dsn must not enable the lib/pq's own SSL.
+func newPgTlsConnector(dsn string, host string, port int32, dbName string,
+	tlsConfig *tls.Config) driver.Connector {
+
+	return newrelic.InstrumentSQLConnector(&pgTlsConnector{
+		dsn:       dsn,
+		tlsConfig: tlsConfig,
+	}, newrelic.SQLDriverSegmentBuilder{
+		BaseSegment: newrelic.DatastoreSegment{
+			Product:      newrelic.DatastorePostgres,
+			Host:         host,
+			PortPathOrID: strconv.Itoa(int(port)),
+			DatabaseName: dbName,
+		},
+		ParseQuery: parsePgQuery,
+	})
+}
+
+var pgCollectionRe = regexp.MustCompile(
+	`(?is)\b(?:from|into|update|table)\s+(?:only\s+|if\s+(?:not\s+)?exists\s+)?` +
+		`"?([a-z_][a-z0-9_$.]*)"?`)
+
+// A simplified version of the query parser from nrpq, sets the operation and
+// the table name.
+func parsePgQuery(segment *newrelic.DatastoreSegment, query string) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return
+	}
+	segment.Operation = strings.ToLower(fields[0])
+	if match := pgCollectionRe.FindStringSubmatch(query); match != nil {
+		segment.Collection = match[1]
+	}
+}
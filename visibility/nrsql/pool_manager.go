@@ -0,0 +1,168 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"sync"
+	"time"
+)
+
+// The pool metrics submitted to the MetricsSink
+const (
+	PoolOpenMetric         = "OpenConnections"
+	PoolInUseMetric        = "InUse"
+	PoolIdleMetric         = "Idle"
+	PoolWaitCountMetric    = "WaitCount"
+	PoolWaitDurationMetric = "WaitDuration"
+)
+
+type PoolOptions struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// How often the pool stats are published, 1 minute by default
+	StatsInterval time.Duration
+	// The readiness ping timeout, 5 seconds by default
+	PingTimeout time.Duration
+	// How long to wait for the in-use connections on shutdown, 30 seconds
+	// by default
+	DrainTimeout time.Duration
+}
+
+// Owns the connection pool: publishes its stats through the MetricsSink,
+// provides the readiness check and drains the pool on shutdown.
+type PoolManager struct {
+	DB *sql.DB
+
+	name string
+	sink visibility.MetricsSink
+	opts PoolOptions
+
+	mtx              sync.Mutex
+	draining         bool
+	lastWaitCount    int64
+	lastWaitDuration time.Duration
+}
+
+// Create the pool for the connector, the name is used as the metrics
+// operation name and as the process name prefix.
+func NewPoolManager(name string, connector driver.Connector,
+	sink visibility.MetricsSink, opts PoolOptions) *PoolManager {
+
+	if opts.StatsInterval == 0 {
+		opts.StatsInterval = time.Minute
+	}
+	if opts.PingTimeout == 0 {
+		opts.PingTimeout = 5 * time.Second
+	}
+	if opts.DrainTimeout == 0 {
+		opts.DrainTimeout = 30 * time.Second
+	}
+
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+
+	return &PoolManager{
+		DB:   db,
+		name: name,
+		sink: sink,
+		opts: opts,
+	}
+}
+
+// Start publishing the stats periodically and drain the pool once the
+// registry is closed.
+func (p *PoolManager) Start(registry *visibility.ProcessRegistry) {
+	stats := registry.CreateProcessContext(p.name + "PoolStats")
+	stats.RunPeriodicProcess(p.opts.StatsInterval, func(ctx context.Context) error {
+		p.PublishStats()
+		return nil
+	})
+
+	drain := registry.CreateProcessContext(p.name + "PoolDrain")
+	drain.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		drainCtx, cancel := context.WithTimeout(context.Background(),
+			p.opts.DrainTimeout)
+		defer cancel()
+		return p.Close(drainCtx)
+	})
+}
+
+// Submit the current pool stats to the sink. The wait count and the wait
+// duration are the deltas since the previous submission.
+func (p *PoolManager) PublishStats() {
+	stats := p.DB.Stats()
+
+	p.mtx.Lock()
+	waitCount := stats.WaitCount - p.lastWaitCount
+	waitDuration := stats.WaitDuration - p.lastWaitDuration
+	p.lastWaitCount, p.lastWaitDuration = stats.WaitCount, stats.WaitDuration
+	p.mtx.Unlock()
+
+	met := &visibility.MetricsContext{
+		OpName:  p.name + "Pool",
+		Metrics: map[string]*visibility.MetricEntry{},
+	}
+	met.SetMetric(PoolOpenMetric, float64(stats.OpenConnections),
+		cloudwatch.StandardUnitNone)
+	met.SetMetric(PoolInUseMetric, float64(stats.InUse), cloudwatch.StandardUnitNone)
+	met.SetMetric(PoolIdleMetric, float64(stats.Idle), cloudwatch.StandardUnitNone)
+	met.SetCount(PoolWaitCountMetric, float64(waitCount))
+	met.SetDuration(PoolWaitDurationMetric, waitDuration)
+
+	p.sink.SubmitSegmentMetrics(met)
+}
+
+// The readiness check: the pool must not be draining and the database must
+// respond to a ping.
+func (p *PoolManager) CheckReady(ctx context.Context) error {
+	p.mtx.Lock()
+	draining := p.draining
+	p.mtx.Unlock()
+	if draining {
+		return fmt.Errorf("the %s pool is shutting down", p.name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.opts.PingTimeout)
+	defer cancel()
+	return p.DB.PingContext(ctx)
+}
+
+// Wait for the in-use connections to be returned to the pool, until the
+// context is done, and then close the pool.
+func (p *PoolManager) Close(ctx context.Context) error {
+	p.mtx.Lock()
+	p.draining = true
+	p.mtx.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	var drainErr error
+loop:
+	for p.DB.Stats().InUse > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			drainErr = fmt.Errorf("the %s pool is closed with %d connections in use",
+				p.name, p.DB.Stats().InUse)
+			break loop
+		}
+	}
+
+	err := p.DB.Close()
+	if drainErr != nil {
+		return drainErr
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package nrsql
+
+import (
+	"context"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"sync"
+	"testing"
+	"time"
+)
+
+type poolStatsSink struct {
+	mtx     sync.Mutex
+	metrics []*visibility.MetricsContext
+}
+
+func (s *poolStatsSink) SubmitSegmentMetrics(met *visibility.MetricsContext) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.metrics = append(s.metrics, met)
+}
+
+func (s *poolStatsSink) count() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.metrics)
+}
+
+func setupPool(t *testing.T, sink visibility.MetricsSink,
+	opts PoolOptions) (*nrsqltest.FakePgServer, *PoolManager) {
+
+	server, err := nrsqltest.NewFakePgServer(func(user, password string) bool {
+		return true
+	})
+	assert.NoError(t, err)
+
+	conn, err := MakePgConnector(context.Background(),
+		server.ConnString("user", "pass", "db"), "", aws.Config{})
+	assert.NoError(t, err)
+
+	return server, NewPoolManager("Test", conn, sink, opts)
+}
+
+func TestPoolManagerStats(t *testing.T) {
+	sink := &poolStatsSink{}
+	server, pool := setupPool(t, sink, PoolOptions{MaxOpenConns: 1})
+	defer server.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, pool.CheckReady(ctx))
+
+	// Make a waiter
+	conn, err := pool.DB.Conn(ctx)
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	assert.NoError(t, pool.DB.PingContext(ctx))
+
+	pool.PublishStats()
+	met := sink.metrics[0]
+	assert.Equal(t, "TestPool", met.OpName)
+	assert.Equal(t, 1.0, met.GetMetricVal(PoolOpenMetric))
+	assert.Equal(t, 0.0, met.GetMetricVal(PoolInUseMetric))
+	assert.Equal(t, 1.0, met.GetMetricVal(PoolIdleMetric))
+	assert.Equal(t, 1.0, met.GetMetricVal(PoolWaitCountMetric))
+	assert.True(t, met.GetMetricVal(PoolWaitDurationMetric) > 0)
+
+	// The waits are reported as deltas
+	pool.PublishStats()
+	assert.Equal(t, 0.0, sink.metrics[1].GetMetricVal(PoolWaitCountMetric))
+
+	assert.NoError(t, pool.Close(ctx))
+	assert.Error(t, pool.CheckReady(ctx))
+}
+
+func TestPoolManagerDrain(t *testing.T) {
+	sink := &poolStatsSink{}
+	server, pool := setupPool(t, sink, PoolOptions{
+		StatsInterval: 10 * time.Millisecond,
+		DrainTimeout:  50 * time.Millisecond,
+	})
+	defer server.Close()
+
+	registry := visibility.NewProcessRegistryWithTracer("", zap.NewNop(), visibility.NoopTracer,
+		visibility.NullSink)
+	pool.Start(registry)
+	for sink.count() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The in-use connection is waited for, up to the drain timeout
+	conn, err := pool.DB.Conn(context.Background())
+	assert.NoError(t, err)
+	start := time.Now()
+	registry.Close()
+	assert.True(t, time.Now().Sub(start) >= 50*time.Millisecond)
+	assert.Error(t, pool.CheckReady(context.Background()))
+	_ = conn.Close()
+
+	// A connection that is returned in time
+	server2, pool2 := setupPool(t, sink, PoolOptions{DrainTimeout: time.Minute})
+	defer server2.Close()
+	registry2 := visibility.NewProcessRegistryWithTracer("", zap.NewNop(), visibility.NoopTracer,
+		visibility.NullSink)
+	pool2.Start(registry2)
+
+	conn, err = pool2.DB.Conn(context.Background())
+	assert.NoError(t, err)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = conn.Close()
+	}()
+	start = time.Now()
+	registry2.Close()
+	assert.True(t, time.Now().Sub(start) < time.Minute)
+	assert.Equal(t, 0, pool2.DB.Stats().OpenConnections)
+}
@@ -0,0 +1,370 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"go.uber.org/zap"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The metrics recorded into the MetricsContext of the query context
+const (
+	DbQueriesMetric      = "DbQueries"
+	DbErrorsMetric       = "DbErrors"
+	DbTimeMetric         = "DbTime"
+	DbRowsAffectedMetric = "DbRowsAffected"
+	DbRowsReturnedMetric = "DbRowsReturned"
+)
+
+type QueryMetricsOptions struct {
+	// Log the queries that take longer than this, 0 disables the logging
+	SlowQueryThreshold time.Duration
+	// Prepend the queries with the /* operation name */ comment, so they
+	// can be identified in pg_stat_activity and in the database logs
+	TagQueries bool
+}
+
+// Wrap the connector to record the query metrics into the MetricsContext of
+// the query context and to log the slow queries through CL(ctx). The contexts
+// without the metrics or the logger are fine, nothing is recorded for them.
+func WithQueryMetrics(connector driver.Connector,
+	opts QueryMetricsOptions) driver.Connector {
+
+	return &metricsConnector{original: connector, opts: opts}
+}
+
+type metricsConnector struct {
+	original driver.Connector
+	opts     QueryMetricsOptions
+}
+
+func (m *metricsConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := m.original.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsConn{original: conn, opts: &m.opts}, nil
+}
+
+func (m *metricsConnector) Driver() driver.Driver {
+	return m.original.Driver()
+}
+
+type metricsConn struct {
+	original driver.Conn
+	opts     *QueryMetricsOptions
+}
+
+var (
+	_ driver.ConnPrepareContext = &metricsConn{}
+	_ driver.ExecerContext      = &metricsConn{}
+	_ driver.QueryerContext     = &metricsConn{}
+	_ driver.ConnBeginTx        = &metricsConn{}
+	_ driver.Pinger             = &metricsConn{}
+)
+
+func (c *metricsConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *metricsConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	query = c.opts.tag(ctx, query)
+
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.original.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.original.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &metricsStmt{original: stmt, query: query, opts: c.opts}, nil
+}
+
+func (c *metricsConn) Close() error {
+	return c.original.Close()
+}
+
+func (c *metricsConn) Begin() (driver.Tx, error) {
+	return c.original.Begin()
+}
+
+func (c *metricsConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bt, ok := c.original.(driver.ConnBeginTx); ok {
+		return bt.BeginTx(ctx, opts)
+	}
+	//noinspection GoDeprecation
+	return c.original.Begin()
+}
+
+func (c *metricsConn) Ping(ctx context.Context) error {
+	if p, ok := c.original.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *metricsConn) ExecContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Result, error) {
+
+	ec, ok := c.original.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	query = c.opts.tag(ctx, query)
+	start := time.Now()
+	res, err := ec.ExecContext(ctx, query, args)
+	c.opts.record(ctx, query, len(args), start, err, res)
+	return res, err
+}
+
+func (c *metricsConn) QueryContext(ctx context.Context, query string,
+	args []driver.NamedValue) (driver.Rows, error) {
+
+	qc, ok := c.original.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	query = c.opts.tag(ctx, query)
+	start := time.Now()
+	rows, err := qc.QueryContext(ctx, query, args)
+	c.opts.record(ctx, query, len(args), start, err, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsRows{Rows: rows, ctx: ctx}, nil
+}
+
+type metricsStmt struct {
+	original driver.Stmt
+	query    string
+	opts     *QueryMetricsOptions
+}
+
+func (s *metricsStmt) Close() error {
+	return s.original.Close()
+}
+
+func (s *metricsStmt) NumInput() int {
+	return s.original.NumInput()
+}
+
+func (s *metricsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.original.Exec(args)
+}
+
+func (s *metricsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.original.Query(args)
+}
+
+func (s *metricsStmt) ExecContext(ctx context.Context,
+	args []driver.NamedValue) (driver.Result, error) {
+
+	start := time.Now()
+	var res driver.Result
+	var err error
+	if ec, ok := s.original.(driver.StmtExecContext); ok {
+		res, err = ec.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		values, err = namedValuesToValues(args)
+		if err == nil {
+			//noinspection GoDeprecation
+			res, err = s.original.Exec(values)
+		}
+	}
+	s.opts.record(ctx, s.query, len(args), start, err, res)
+	return res, err
+}
+
+func (s *metricsStmt) QueryContext(ctx context.Context,
+	args []driver.NamedValue) (driver.Rows, error) {
+
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if qc, ok := s.original.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		values, err = namedValuesToValues(args)
+		if err == nil {
+			//noinspection GoDeprecation
+			rows, err = s.original.Query(values)
+		}
+	}
+	s.opts.record(ctx, s.query, len(args), start, err, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsRows{Rows: rows, ctx: ctx}, nil
+}
+
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	res := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("named parameters are not supported")
+		}
+		res[i] = arg.Value
+	}
+	return res, nil
+}
+
+// Counts the returned rows
+type metricsRows struct {
+	driver.Rows
+	ctx   context.Context
+	count int
+}
+
+func (r *metricsRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err == nil {
+		r.count++
+	}
+	return err
+}
+
+func (r *metricsRows) Close() error {
+	if met := getMetrics(r.ctx); met != nil {
+		met.AddCount(DbRowsReturnedMetric, float64(r.count))
+	}
+	return r.Rows.Close()
+}
+
+// The optional methods are forwarded to the original rows, with the same
+// defaults as the database/sql uses for the drivers that don't have them.
+
+func (r *metricsRows) HasNextResultSet() bool {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *metricsRows) NextResultSet() error {
+	if rs, ok := r.Rows.(driver.RowsNextResultSet); ok {
+		return rs.NextResultSet()
+	}
+	return io.EOF
+}
+
+func (r *metricsRows) ColumnTypeScanType(index int) reflect.Type {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeScanType); ok {
+		return rs.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *metricsRows) ColumnTypeDatabaseTypeName(index int) string {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return rs.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *metricsRows) ColumnTypeLength(index int) (int64, bool) {
+	if rs, ok := r.Rows.(driver.RowsColumnTypeLength); ok {
+		return rs.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *metricsRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if rs, ok := r.Rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return rs.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func getMetrics(ctx context.Context) *visibility.MetricsContext {
+	met, _ := ctx.Value(visibility.MetricsContextKey).(*visibility.MetricsContext)
+	return met
+}
+
+func (o *QueryMetricsOptions) tag(ctx context.Context, query string) string {
+	if !o.TagQueries {
+		return query
+	}
+	met := getMetrics(ctx)
+	if met == nil || met.OpName == "" {
+		return query
+	}
+	// Don't let the operation name terminate the comment
+	opName := strings.Replace(met.OpName, "*/", "", -1)
+	return "/* " + opName + " */ " + query
+}
+
+func (o *QueryMetricsOptions) record(ctx context.Context, query string, numArgs int,
+	start time.Time, err error, res driver.Result) {
+
+	// The query wasn't actually run
+	if err == driver.ErrSkip {
+		return
+	}
+	elapsed := time.Now().Sub(start)
+
+	met := getMetrics(ctx)
+	if met != nil {
+		met.AddCount(DbQueriesMetric, 1)
+		met.AddDuration(DbTimeMetric, elapsed)
+		if err != nil {
+			met.AddCount(DbErrorsMetric, 1)
+		}
+		if res != nil {
+			if affected, err := res.RowsAffected(); err == nil {
+				met.AddCount(DbRowsAffectedMetric, float64(affected))
+			}
+		}
+	}
+
+	if o.SlowQueryThreshold == 0 || elapsed < o.SlowQueryThreshold ||
+		!visibility.HasLogger(ctx) {
+		return
+	}
+
+	var opName string
+	if met != nil {
+		opName = met.OpName
+	}
+	visibility.CL(ctx).Warn("Slow query",
+		zap.String("sql", NormalizeSql(query)),
+		zap.Int("args", numArgs),
+		zap.Duration("elapsed", elapsed),
+		zap.String("operation", opName),
+		zap.Bool("failed", err != nil))
+}
+
+var (
+	sqlStringLiteralRe = regexp.MustCompile(`(?s)[EeBbXx]?'(?:[^']|'')*'`)
+	sqlDollarQuotedRe  = regexp.MustCompile(`(?s)\$([A-Za-z_]*)\$.*?\$([A-Za-z_]*)\$`)
+	sqlNumberRe        = regexp.MustCompile(`\$?\b\d+(?:\.\d+)?(?:[eE][-+]?\d+)?\b`)
+	sqlWhitespaceRe    = regexp.MustCompile(`\s+`)
+)
+
+// Normalize the SQL for logging: the literals are replaced with '?' and the
+// whitespace is collapsed, so the values embedded into the query text are not
+// leaked into the logs. The parameters ($1, $2, ...) are kept as-is.
+func NormalizeSql(query string) string {
+	res := sqlDollarQuotedRe.ReplaceAllString(query, "?")
+	res = sqlStringLiteralRe.ReplaceAllString(res, "?")
+	res = sqlNumberRe.ReplaceAllStringFunc(res, func(s string) string {
+		if strings.HasPrefix(s, "$") {
+			return s
+		}
+		return "?"
+	})
+	res = sqlWhitespaceRe.ReplaceAllString(res, " ")
+	return strings.TrimSpace(res)
+}
@@ -0,0 +1,113 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupMetricsDb(t *testing.T, opts QueryMetricsOptions) (
+	*nrsqltest.FakePgServer, *sql.DB, *[]string) {
+
+	server, err := nrsqltest.NewFakePgServer(func(user, password string) bool {
+		return user == "user" && password == "pass"
+	})
+	assert.NoError(t, err)
+
+	var mtx sync.Mutex
+	var queries []string
+	server.SetQueryHandler(func(q nrsqltest.FakePgQuery) (*nrsqltest.FakePgResult, error) {
+		mtx.Lock()
+		queries = append(queries, q.SQL)
+		mtx.Unlock()
+
+		if strings.Contains(q.SQL, "pg_sleep") {
+			time.Sleep(60 * time.Millisecond)
+		}
+		switch q.Verb() {
+		case "SELECT":
+			return &nrsqltest.FakePgResult{Columns: []string{"a"},
+				Rows: [][]string{{"1"}, {"2"}}}, nil
+		case "UPDATE":
+			return &nrsqltest.FakePgResult{RowsAffected: 3}, nil
+		}
+		return &nrsqltest.FakePgResult{}, nil
+	})
+
+	conn, err := MakePgConnector(context.Background(),
+		server.ConnString("user", "pass", "db"), "", aws.Config{})
+	assert.NoError(t, err)
+
+	return server, sql.OpenDB(WithQueryMetrics(conn, opts)), &queries
+}
+
+func TestQueryMetrics(t *testing.T) {
+	server, db, queries := setupMetricsDb(t, QueryMetricsOptions{
+		SlowQueryThreshold: 50 * time.Millisecond,
+		TagQueries:         true,
+	})
+	defer server.Close()
+	defer db.Close()
+
+	sink, logger := utils.NewMemorySinkLogger()
+	ctx := visibility.MakeMetricContext(visibility.ImbueContext(
+		context.Background(), logger), "TestOp")
+	met := visibility.GetMetricsFromContext(ctx)
+
+	res, err := db.ExecContext(ctx, "UPDATE t SET a = 'secret' WHERE id = $1", 5)
+	assert.NoError(t, err)
+	affected, err := res.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), affected)
+
+	rows, err := db.QueryContext(ctx, "SELECT a FROM t")
+	assert.NoError(t, err)
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	assert.NoError(t, rows.Close())
+	assert.Equal(t, 2, count)
+
+	assert.Equal(t, 2.0, met.GetMetricVal(DbQueriesMetric))
+	assert.Equal(t, 3.0, met.GetMetricVal(DbRowsAffectedMetric))
+	assert.Equal(t, 2.0, met.GetMetricVal(DbRowsReturnedMetric))
+	assert.True(t, met.GetMetricVal(DbTimeMetric) > 0)
+	assert.Equal(t, 0.0, met.GetMetricVal(DbErrorsMetric))
+	assert.Equal(t, "", sink.String())
+
+	// The queries are tagged with the operation name
+	assert.True(t, strings.HasPrefix((*queries)[0], "/* TestOp */ UPDATE"))
+
+	// Slow queries are logged without the literals
+	_, err = db.ExecContext(ctx, "SELECT pg_sleep(0.06), 'secret'")
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(sink.String(), `"msg":"Slow query"`))
+	assert.True(t, strings.Contains(sink.String(),
+		`"sql":"/* TestOp */ SELECT pg_sleep(?), ?"`))
+	assert.True(t, strings.Contains(sink.String(), `"operation":"TestOp"`))
+	assert.False(t, strings.Contains(sink.String(), "secret"))
+
+	// Contexts without metrics and loggers are fine
+	_, err = db.Exec("SELECT pg_sleep(0.06)")
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT pg_sleep(0.06)", (*queries)[len(*queries)-1])
+}
+
+func TestNormalizeSql(t *testing.T) {
+	for in, out := range map[string]string{
+		"SELECT * FROM t WHERE a = 'x''y' AND b = 12.5e3": "SELECT * FROM t WHERE a = ? AND b = ?",
+		"SELECT  $1,\n\t$2 FROM table1":                   "SELECT $1, $2 FROM table1",
+		"SELECT $$body$$, E'\\n' FROM t LIMIT 10":         "SELECT ?, ? FROM t LIMIT ?",
+	} {
+		assert.Equal(t, out, NormalizeSql(in))
+	}
+}
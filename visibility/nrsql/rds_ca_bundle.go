@@ -0,0 +1,236 @@
+package nrsql
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:generate go run gen_rds_ca_bundle.go
+
+// The global RDS CA bundle with the roots for all the commercial regions
+const RdsGlobalBundleUrl = "https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem"
+
+// The regional RDS CA bundle URL
+func RdsRegionalBundleUrl(region string) string {
+	return fmt.Sprintf("https://truststore.pki.rds.amazonaws.com/%s/%s-bundle.pem",
+		region, region)
+}
+
+// Warn about the certificates that expire within this period
+var CaExpiryWarningPeriod = 90 * 24 * time.Hour
+
+// The timeout for the bundle download
+const caBundleFetchTimeout = 30 * time.Second
+
+// A bundle of the CA certificates to verify the database servers
+type CaBundle struct {
+	pem   []byte
+	certs []*x509.Certificate
+	pool  *x509.CertPool
+
+	mtx  sync.Mutex
+	file string
+}
+
+// Parse the PEM-encoded certificates, the non-certificate blocks are ignored
+func ParseCaBundle(data []byte) (*CaBundle, error) {
+	res := &CaBundle{pem: data, pool: x509.NewCertPool()}
+
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		res.certs = append(res.certs, cert)
+		res.pool.AddCert(cert)
+	}
+
+	if len(res.certs) == 0 {
+		return nil, fmt.Errorf("no certificates in the CA bundle")
+	}
+	return res, nil
+}
+
+// The bundle with the embedded global RDS bundle from rds_global_bundle.go,
+// it's an error if the bundle hasn't been generated
+func EmbeddedRdsCaBundle() (*CaBundle, error) {
+	if RdsGlobalBundle == "" {
+		return nil, fmt.Errorf("the global RDS CA bundle is not embedded, " +
+			"run go generate in the nrsql package")
+	}
+	return ParseCaBundle([]byte(RdsGlobalBundle))
+}
+
+// Log the warning with the context logger, or with the global one for the
+// bare startup contexts
+func warnCaBundle(ctx context.Context, template string, args ...interface{}) {
+	if visibility.HasLogger(ctx) {
+		visibility.CLS(ctx).Warnf(template, args...)
+		return
+	}
+	zap.S().Warnf(template, args...)
+}
+
+// Load the CA bundle from the source, that can be:
+// "" or "embedded" - the embedded RDS certificates, see EmbeddedRdsCaBundle
+// "rds-global" - the global RDS bundle downloaded from the RDS trust store
+// "rds-region:<region>" - the regional RDS bundle from the RDS trust store
+// http:// or https:// URL - the bundle is downloaded from the URL
+// anything else - the path to the PEM file
+//
+// The bundle is rejected if all of its certificates have expired, the
+// certificates that expire within CaExpiryWarningPeriod are logged.
+func LoadCaBundle(ctx context.Context, source string) (*CaBundle, error) {
+	var bundle *CaBundle
+	var err error
+
+	switch {
+	case source == "" || source == "embedded":
+		bundle, err = EmbeddedRdsCaBundle()
+	case source == "rds-global":
+		bundle, err = fetchCaBundle(ctx, RdsGlobalBundleUrl)
+	case strings.HasPrefix(source, "rds-region:"):
+		bundle, err = fetchCaBundle(ctx, RdsRegionalBundleUrl(
+			strings.TrimPrefix(source, "rds-region:")))
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		bundle, err = fetchCaBundle(ctx, source)
+	default:
+		var data []byte
+		data, err = ioutil.ReadFile(source)
+		if err == nil {
+			bundle, err = ParseCaBundle(data)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the CA bundle from %s: %v", source, err)
+	}
+
+	expired, expiring := bundle.CheckExpiry(time.Now(), CaExpiryWarningPeriod)
+	for _, c := range expiring {
+		warnCaBundle(ctx, "The CA certificate %s expires on %s",
+			c.Subject.CommonName, c.NotAfter.Format(time.RFC3339))
+	}
+	if len(expired) == len(bundle.certs) {
+		return nil, fmt.Errorf("all the certificates in the CA bundle "+
+			"from %s have expired", source)
+	}
+
+	return bundle, nil
+}
+
+func fetchCaBundle(ctx context.Context, url string) (*CaBundle, error) {
+	ctx, cancel := context.WithTimeout(ctx, caBundleFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ParseCaBundle(data)
+}
+
+func (b *CaBundle) Certificates() []*x509.Certificate {
+	return b.certs
+}
+
+func (b *CaBundle) Pem() []byte {
+	return b.pem
+}
+
+// Find the certificates that have expired and the ones that will expire
+// within the warning period.
+func (b *CaBundle) CheckExpiry(now time.Time, warnPeriod time.Duration) (
+	expired, expiring []*x509.Certificate) {
+
+	for _, c := range b.certs {
+		if now.After(c.NotAfter) {
+			expired = append(expired, c)
+		} else if now.Add(warnPeriod).After(c.NotAfter) {
+			expiring = append(expiring, c)
+		}
+	}
+	return expired, expiring
+}
+
+// Make the TLS config that verifies the server certificate against the bundle
+func (b *CaBundle) TlsConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		RootCAs:    b.pool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// Get the path to the temporary file with the bundle, for the code that needs
+// the sslrootcert parameter. The file is created once and removed by Close,
+// or by RemoveCaCertFiles.
+func (b *CaBundle) File() (string, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.file != "" {
+		return b.file, nil
+	}
+
+	file, err := ioutil.TempFile("", "rds-ca-*.pem")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(b.pem)
+	_ = file.Close()
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+
+	b.file = file.Name()
+	trackCaBundleFile(b)
+	return b.file, nil
+}
+
+// Remove the temporary file, if it was created
+func (b *CaBundle) Close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.file == "" {
+		return nil
+	}
+	err := os.Remove(b.file)
+	b.file = ""
+	return err
+}
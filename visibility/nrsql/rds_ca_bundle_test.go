@@ -0,0 +1,163 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// The expired RDS roots, for the tests that need a bundle that doesn't
+// verify the fake servers
+func makeLegacyCaBundle() *CaBundle {
+	bundle, err := ParseCaBundle([]byte(RdsRootCert2019 + RdsRootCert2015))
+	if err != nil {
+		panic(err.Error())
+	}
+	return bundle
+}
+
+func TestCaBundleExpiry(t *testing.T) {
+	bundle := makeLegacyCaBundle()
+	assert.Equal(t, 2, len(bundle.Certificates()))
+
+	cert2019 := bundle.Certificates()[0]
+	assert.Equal(t, "Amazon RDS Root 2019 CA", cert2019.Subject.CommonName)
+
+	expired, expiring := bundle.CheckExpiry(cert2019.NotAfter.Add(-time.Hour), time.Hour*2)
+	assert.Equal(t, 1, len(expired))
+	assert.Equal(t, cert2019, expiring[0])
+
+	expired, expiring = bundle.CheckExpiry(cert2019.NotAfter.Add(time.Hour), time.Hour)
+	assert.Equal(t, 2, len(expired))
+	assert.Equal(t, 0, len(expiring))
+
+	_, err := ParseCaBundle([]byte("not a certificate"))
+	assert.Error(t, err)
+}
+
+func TestCaBundleFile(t *testing.T) {
+	bundle := makeLegacyCaBundle()
+
+	file, err := bundle.File()
+	assert.NoError(t, err)
+	file2, err := bundle.File()
+	assert.NoError(t, err)
+	assert.Equal(t, file, file2)
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, bundle.Pem(), data)
+
+	assert.NoError(t, bundle.Close())
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLoadCaBundle(t *testing.T) {
+	server, err := nrsqltest.NewFakePgServer(nil)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	ctx := visibility.ImbueContext(context.Background(), zap.NewNop())
+
+	bundle, err := LoadCaBundle(ctx, server.CaPath())
+	assert.NoError(t, err)
+	assert.Equal(t, server.CaPem(), bundle.Pem())
+
+	httpServer := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			if request.URL.Path == "/expired.pem" {
+				_, _ = writer.Write([]byte(RdsRootCert2019))
+				return
+			}
+			_, _ = writer.Write(server.CaPem())
+		}))
+	defer httpServer.Close()
+
+	bundle, err = LoadCaBundle(ctx, httpServer.URL+"/bundle.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, server.CaPem(), bundle.Pem())
+
+	_, err = LoadCaBundle(ctx, httpServer.URL+"/expired.pem")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "have expired")
+
+	// The embedded bundle is there only once it's generated
+	bundle, err = LoadCaBundle(ctx, "embedded")
+	if RdsGlobalBundle == "" {
+		assert.Error(t, err)
+	} else {
+		assert.NoError(t, err)
+		assert.NotEmpty(t, bundle.Certificates())
+	}
+
+	// The bare startup context has no logger, the global one is used. The
+	// fake CA expires in a day.
+	logSink, logger := utils.NewMemorySinkLogger()
+	restore := zap.ReplaceGlobals(logger)
+	defer restore()
+	_, err = LoadCaBundle(context.Background(), server.CaPath())
+	assert.NoError(t, err)
+	assert.Contains(t, logSink.String(), "The CA certificate Fake Postgres CA expires on")
+
+	_, err = LoadCaBundle(ctx, "/nonexistent/bundle.pem")
+	assert.Error(t, err)
+}
+
+func TestCaBundleConnector(t *testing.T) {
+	secrets, server := setupFakeRds(t)
+	defer server.Close()
+
+	bundle, err := ParseCaBundle(server.CaPem())
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	conn, err := MakePgConnectorWithCaBundle(ctx, "rds:testdb:postgres", bundle,
+		secrets.AwsConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Ping(ctx))
+	assert.Equal(t, 2, server.ConnectionCount())
+
+	// The server is verified against the bundle
+	_, err = MakePgConnectorWithCaBundle(ctx, "rds:testdb:postgres",
+		makeLegacyCaBundle(), secrets.AwsConfig())
+	assert.Error(t, err)
+}
+
+func TestCaBundlePlainConnector(t *testing.T) {
+	server, err := nrsqltest.NewFakePgServer(nil)
+	assert.NoError(t, err)
+	defer server.Close()
+
+	bundle, err := ParseCaBundle(server.CaPem())
+	assert.NoError(t, err)
+
+	// The sslrootcert file is not used, the bundle is
+	connStr := fmt.Sprintf("host=%s port=%d dbname=test user=pg password='p w' "+
+		"sslmode=require sslrootcert=/nonexistent.pem", server.Host(), server.Port())
+	ctx := context.Background()
+	conn, err := MakePgConnectorWithCaBundle(ctx, connStr, bundle, aws.Config{})
+	assert.NoError(t, err)
+	db := sql.OpenDB(conn)
+	assert.NoError(t, db.PingContext(ctx))
+	_ = db.Close()
+
+	// The server is verified against the bundle
+	conn, err = MakePgConnectorWithCaBundle(ctx, connStr, makeLegacyCaBundle(), aws.Config{})
+	assert.NoError(t, err)
+	db = sql.OpenDB(conn)
+	assert.Error(t, db.PingContext(ctx))
+	_ = db.Close()
+}
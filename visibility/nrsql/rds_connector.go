@@ -3,58 +3,106 @@ package nrsql
 import (
 	"context"
 	"database/sql/driver"
-	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/lib/pq"
 	"github.com/newrelic/go-agent/_integrations/nrpq"
-	"strings"
+	"io"
+	"strconv"
 	"sync"
 	"time"
 )
 
 const MaxRdsRetriesSec = 5
 
+// The schedule of the connection retries, the backoff doubles after each
+// failed attempt up to MaxBackoff.
+type ConnectRetryPolicy struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Give up after this much time since the first attempt
+	MaxElapsed time.Duration
+}
+
+var DefaultConnectRetryPolicy = ConnectRetryPolicy{
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	MaxElapsed:     MaxRdsRetriesSec * time.Second,
+}
+
+// The delay before the given retry (starting from 0)
+func (p ConnectRetryPolicy) backoff(retry int) time.Duration {
+	res := p.InitialBackoff
+	for i := 0; i < retry && res < p.MaxBackoff; i++ {
+		res *= 2
+	}
+	if res > p.MaxBackoff {
+		res = p.MaxBackoff
+	}
+	return res
+}
+
 type PgConnectorWithRds struct {
-	config aws.Config
-	isRds  bool
+	// The retries of the failed RDS connections, DefaultConnectRetryPolicy
+	// by default
+	Retry ConnectRetryPolicy
 
-	rdsDb, postgresDbName string
-	sslCaPath             string
+	isRds       bool
+	settings    *connSettings
+	credentials *credentialsCache
+	// The CA bundle for the in-memory TLS config, nil if lib/pq handles SSL
+	caBundle *CaBundle
 
 	mtx        sync.Mutex
 	connString string
 	delegate   driver.Connector
-}
-
-// Example secret structure:
-// {
-//   "username": "rds",
-//   "engine": "postgres",
-//   "host": "xyzzy-db.cbimanaxd4pt.us-east-2.rds.amazonaws.com",
-//   "password": "7f*w3-oOZ$17,g&b_uVIH;N^Or]=H7<>",
-//   "port": 5432, "dbInstanceIdentifier": "xyzzy-db"
-// }
-type connInfo struct {
-	Username, Password string
-	Host               string
-	Port               int32
+	// The secret version used to create the delegate
+	delegateVersion string
 }
 
 // Create a Postgres connector to use with NewRelic. The PgConnector supports
-// resolving RDS endpoints and AWS secrets-based authentication.
+// resolving RDS endpoints and AWS secrets-based authentication, the RDS IAM
+// authentication and the pluggable credentials sources, see parseConnString
+// for the supported connection string formats.
 func MakePgConnector(ctx context.Context, connStr string, sslCaPath string,
 	config aws.Config) (*PgConnectorWithRds, error) {
 
-	// Not an RDS-format connection string
-	if !strings.HasPrefix(connStr, "rds:") {
-		connector, err := pq.NewConnector(connStr)
+	return makePgConnector(ctx, connStr, sslCaPath, nil, config)
+}
+
+// Create a Postgres connector that verifies the server certificates against
+// the CA bundle in memory, without writing it to a file. The sslmode=disable
+// is respected, all other SSL modes are treated as verify-full, for both the
+// RDS and the regular lib/pq connection strings.
+func MakePgConnectorWithCaBundle(ctx context.Context, connStr string,
+	bundle *CaBundle, config aws.Config) (*PgConnectorWithRds, error) {
+
+	return makePgConnector(ctx, connStr, "", bundle, config)
+}
+
+func makePgConnector(ctx context.Context, connStr string, sslCaPath string,
+	bundle *CaBundle, config aws.Config) (*PgConnectorWithRds, error) {
+
+	settings, err := parseConnString(ctx, connStr, sslCaPath, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// A regular connection string
+	if settings == nil {
+		var connector driver.Connector
+		if bundle != nil {
+			connector, err = makePlainTlsConnector(connStr, bundle)
+		} else {
+			connector, err = pq.NewConnector(connStr)
+		}
 		if err != nil {
 			return nil, err
 		}
 
 		res := &PgConnectorWithRds{
+			Retry:      DefaultConnectRetryPolicy,
 			isRds:      false,
 			connString: connStr,
 			delegate:   connector,
@@ -62,22 +110,22 @@ func MakePgConnector(ctx context.Context, connStr string, sslCaPath string,
 		return res, nil
 	}
 
-	// Split the connection string
-	splits := strings.Split(connStr, ":")
-	if len(splits) != 3 {
-		return nil, fmt.Errorf("bad RDS connection string %s", connStr)
+	res := &PgConnectorWithRds{
+		Retry:       DefaultConnectRetryPolicy,
+		isRds:       true,
+		settings:    settings,
+		connString:  connStr,
+		credentials: newCredentialsCache(settings.provider, settings.ttl),
 	}
 
-	res := &PgConnectorWithRds{
-		isRds:          true,
-		config:         config,
-		connString:     connStr,
-		rdsDb:          splits[1],
-		postgresDbName: splits[2],
-		sslCaPath:      sslCaPath,
+	if bundle != nil && settings.params["sslmode"] != "disable" {
+		// The TLS is negotiated by the pgTlsDialer
+		delete(settings.params, "sslrootcert")
+		settings.params["sslmode"] = "disable"
+		res.caBundle = bundle
 	}
 
-	err := res.Ping(ctx)
+	err = res.Ping(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -85,100 +133,188 @@ func MakePgConnector(ctx context.Context, connStr string, sslCaPath string,
 	return res, nil
 }
 
-func (pc *PgConnectorWithRds) getCurrentConnInfo(ctx context.Context) (*connInfo, error) {
-	secretName := fmt.Sprintf("db/%s", pc.rdsDb)
+// Make the connector for the regular connection string that verifies the
+// server against the bundle, unless the SSL is disabled
+func makePlainTlsConnector(connStr string, bundle *CaBundle) (driver.Connector, error) {
+	params, err := parsePlainConnString(connStr)
+	if err != nil {
+		return nil, err
+	}
+	if params["sslmode"] == "disable" {
+		return pq.NewConnector(connStr)
+	}
 
-	sm := secretsmanager.New(pc.config)
+	host := params["host"]
+	if host == "" {
+		host = "localhost"
+	}
+	port := int64(5432)
+	if params["port"] != "" {
+		port, err = strconv.ParseInt(params["port"], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %s: %v", params["port"], err)
+		}
+	}
 
-	//Create a Secrets Manager client
-	input := &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretName),
-		// VersionStage defaults to AWSCURRENT if unspecified
-		VersionStage: aws.String("AWSCURRENT"),
+	// The TLS is negotiated by the pgTlsDialer
+	delete(params, "sslrootcert")
+	params["sslmode"] = "disable"
+	dbName := params["dbname"]
+	if dbName == "" {
+		dbName = params["database"]
 	}
+	return newPgTlsConnector(formatConnParams(params), host, int32(port),
+		dbName, bundle.TlsConfig(host)), nil
+}
 
-	result, err := sm.GetSecretValueRequest(input).Send(ctx)
+// The driver of the current delegate, the plain lib/pq driver if there is
+// no delegate yet
+func (pc *PgConnectorWithRds) Driver() driver.Driver {
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+	if pc.delegate != nil {
+		return pc.delegate.Driver()
+	}
+	return &pq.Driver{}
+}
+
+// Get the delegate connector for the current credentials, the delegate is
+// re-created if the secret version changes.
+func (pc *PgConnectorWithRds) getDelegate(ctx context.Context) (
+	driver.Connector, *cachedConnInfo, error) {
+
+	// Don't hold the lock during the secret lookup
+	creds, err := pc.credentials.Get(ctx)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if result.SecretString == nil || *result.SecretString == "" {
-		return nil, fmt.Errorf("no string secret")
+	pc.mtx.Lock()
+	defer pc.mtx.Unlock()
+
+	if pc.delegate != nil && pc.delegateVersion == creds.VersionId {
+		return pc.delegate, creds, nil
 	}
 
-	info := connInfo{}
-	err = json.Unmarshal([]byte(*result.SecretString), &info)
-	if err != nil {
-		return nil, err
+	var connector driver.Connector
+	connString := pc.settings.makeConnString(creds.DbCredentials)
+	if pc.caBundle != nil {
+		host, port := pc.settings.endpoint(creds.DbCredentials)
+		connector = newPgTlsConnector(connString, host, port,
+			pc.settings.params["database"], pc.caBundle.TlsConfig(host))
+	} else {
+		connector, err = nrpq.NewConnector(connString)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
+	pc.delegate = connector
+	pc.delegateVersion = creds.VersionId
 
-	return &info, nil
+	return connector, creds, nil
 }
 
-func (pc *PgConnectorWithRds) getConnString(info *connInfo) string {
-	return fmt.Sprintf("host=%s port=%d database=%s "+
-		"user=%s sslmode=verify-full sslrootcert=%s password=%s",
-		info.Host, info.Port, pc.postgresDbName, info.Username, pc.sslCaPath,
-		info.Password)
+func isAuthError(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	// Class 28 - Invalid Authorization Specification
+	return ok && pqErr.Code.Class() == "28"
 }
 
-func (pc *PgConnectorWithRds) Driver() driver.Driver {
-	return pc.Driver()
-}
+type connErrorKind int
 
-func (pc *PgConnectorWithRds) tryConnection(ctx context.Context) (driver.Conn, error) {
-	pc.mtx.Lock()
-	defer pc.mtx.Unlock()
+const (
+	// Retrying won't help, e.g. the database doesn't exist
+	connErrorFatal connErrorKind = iota
+	// The credentials are refreshed before the next attempt
+	connErrorAuth
+	// The server is not reachable or not ready yet
+	connErrorNetwork
+)
 
-	if pc.delegate != nil {
-		conn, err := pc.delegate.Connect(ctx)
-		if err == nil {
-			return conn, nil
-		}
-		pc.delegate = nil
+// The credentials lookup can fail transiently, e.g. when the SecretsManager
+// throttles the requests or the AWS endpoint is not reachable
+func isRetryableAwsError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
 	}
+	if _, ok := err.(awserr.Error); !ok {
+		return false
+	}
+	return aws.IsErrorThrottle(err) || aws.IsErrorRetryable(err)
+}
 
-	info, err := pc.getCurrentConnInfo(ctx)
-	if err != nil {
-		return nil, err
+func classifyConnError(err error) connErrorKind {
+	switch {
+	case isAuthError(err):
+		return connErrorAuth
+	// The server can drop the connection during the startup when restarting
+	case isConnectionError(err) || err == io.EOF || err == io.ErrUnexpectedEOF:
+		return connErrorNetwork
+	case isRetryableAwsError(err):
+		return connErrorNetwork
+	default:
+		return connErrorFatal
 	}
+}
 
-	connector, err := nrpq.NewConnector(pc.getConnString(info))
+func (pc *PgConnectorWithRds) tryConnection(ctx context.Context) (driver.Conn, error) {
+	connector, creds, err := pc.getDelegate(ctx)
 	if err != nil {
+		// The throttling and the network errors outlast the AWS SDK retries
+		// during the outages, they are retried just like the connection errors
 		return nil, err
 	}
+
 	conn, err := connector.Connect(ctx)
 	if err == nil {
-		pc.delegate = connector
 		return conn, nil
 	}
 
+	// The secret might have been rotated
+	if classifyConnError(err) == connErrorAuth {
+		pc.credentials.Invalidate(creds)
+	}
 	return nil, err
 }
 
+// Connect to the database. The failed RDS connections are retried with the
+// exponential backoff to compensate for the secret rotation and the server
+// restarts. The authentication failures force the credentials refresh, and
+// the fatal errors are returned immediately.
 func (pc *PgConnectorWithRds) Connect(ctx context.Context) (driver.Conn, error) {
 	if !pc.isRds {
 		return pc.delegate.Connect(ctx)
 	}
 
-	// A small retry loop to compensate for the possibility of secret rotation
-	start := time.Now().Unix()
-	for ;; {
+	start := time.Now()
+	for retry := 0; ; retry++ {
 		conn, err := pc.tryConnection(ctx)
 		if err == nil {
-			return conn, err
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
 
-		if time.Now().Unix()-start > MaxRdsRetriesSec {
+		if classifyConnError(err) == connErrorFatal {
 			return nil, err
 		}
 
-		timer := time.NewTimer(200 * time.Millisecond)
+		delay := pc.Retry.backoff(retry)
+		remaining := pc.Retry.MaxElapsed - time.Since(start)
+		if remaining <= 0 {
+			return nil, err
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+
+		timer := time.NewTimer(delay)
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return nil, ctx.Err()
 		case <-timer.C:
-		default:
 		}
 	}
 }
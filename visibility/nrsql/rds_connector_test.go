@@ -0,0 +1,213 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql/driver"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func setupFakeRds(t *testing.T) (*nrsqltest.SecretsMock, *nrsqltest.FakePgServer) {
+	secrets := nrsqltest.NewSecretsMock()
+	server, err := nrsqltest.NewFakePgServer(secrets.CurrentDbCredentialsChecker("testdb"))
+	assert.NoError(t, err)
+	secrets.PutDbSecret("testdb", server.Host(), server.Port(), "rds", "pass1")
+	return secrets, server
+}
+
+func TestRdsConnectorRotation(t *testing.T) {
+	secrets, server := setupFakeRds(t)
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, err := MakePgConnector(ctx, "rds:testdb:postgres", server.CaPath(),
+		secrets.AwsConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.ConnectionCount())
+	assert.Equal(t, 1, secrets.RequestCount())
+
+	// The cached connection info is reused
+	assert.NoError(t, conn.Ping(ctx))
+	assert.Equal(t, 1, secrets.RequestCount())
+
+	// The pending secret is not used yet
+	secrets.StagePending("db/testdb", nrsqltest.MakeDbSecretString(
+		server.Host(), server.Port(), "rds", "pass2"))
+	assert.NoError(t, conn.Ping(ctx))
+	assert.Equal(t, 1, secrets.RequestCount())
+	assert.Equal(t, 0, server.AuthFailureCount())
+
+	// Finish the rotation, the connector must re-read the secret
+	assert.NoError(t, secrets.FinishRotation("db/testdb"))
+	assert.NoError(t, conn.Ping(ctx))
+	assert.Equal(t, 2, secrets.RequestCount())
+	assert.Equal(t, 1, server.AuthFailureCount())
+	assert.Equal(t, 4, server.ConnectionCount())
+}
+
+func TestFakePgServerQueries(t *testing.T) {
+	server, err := nrsqltest.NewFakePgServer(func(user, password string) bool {
+		return user == "user" && password == "pass"
+	})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	var queries []nrsqltest.FakePgQuery
+	server.SetQueryHandler(func(q nrsqltest.FakePgQuery) (*nrsqltest.FakePgResult, error) {
+		queries = append(queries, q)
+		if q.Verb() == "SELECT" {
+			return &nrsqltest.FakePgResult{Columns: []string{"val"},
+				Rows: [][]string{{"1"}, {"2"}}}, nil
+		}
+		return nil, nil
+	})
+
+	ctx := context.Background()
+	conn, err := MakePgConnector(ctx, server.ConnString("user", "pass", "db"),
+		"", aws.Config{})
+	assert.NoError(t, err)
+
+	c, err := conn.Connect(ctx)
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer c.Close()
+
+	rows, err := c.(driver.QueryerContext).QueryContext(ctx,
+		"SELECT val FROM test WHERE id=$1", []driver.NamedValue{{Ordinal: 1, Value: int64(12)}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"val"}, rows.Columns())
+	vals := make([]driver.Value, 1)
+	assert.NoError(t, rows.Next(vals))
+	assert.Equal(t, "1", vals[0])
+	assert.NoError(t, rows.Next(vals))
+	assert.Equal(t, "2", vals[0])
+	assert.NoError(t, rows.Close())
+
+	assert.Equal(t, "SELECT val FROM test WHERE id=$1", queries[len(queries)-1].SQL)
+	assert.Equal(t, []string{"12"}, queries[len(queries)-1].Args)
+
+	// Wrong password
+	badConn, err := MakePgConnector(ctx, server.ConnString("user", "bad", "db"),
+		"", aws.Config{})
+	assert.NoError(t, err)
+	_, err = badConn.Connect(ctx)
+	assert.Equal(t, pq.ErrorCode("28P01"), err.(*pq.Error).Code)
+	assert.Equal(t, 1, server.ConnectionCount())
+	assert.Equal(t, 1, server.AuthFailureCount())
+}
+
+func TestRdsConnectorPreviousCredentials(t *testing.T) {
+	secrets := nrsqltest.NewSecretsMock()
+	// The database still accepts only the old password
+	server, err := nrsqltest.NewFakePgServer(func(user, password string) bool {
+		return password == "pass1"
+	})
+	assert.NoError(t, err)
+	defer server.Close()
+
+	secrets.PutDbSecret("testdb", server.Host(), server.Port(), "rds", "pass1")
+	secrets.PutDbSecret("testdb", server.Host(), server.Port(), "rds", "pass2")
+
+	ctx := context.Background()
+	conn, err := MakePgConnector(ctx, "rds:testdb:postgres", server.CaPath(),
+		secrets.AwsConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, server.AuthFailureCount())
+	assert.Equal(t, 1, server.ConnectionCount())
+
+	// The previous credentials are used until the new version arrives
+	assert.NoError(t, conn.Ping(ctx))
+	assert.Equal(t, 1, server.AuthFailureCount())
+}
+
+func TestConnectRetryPolicy(t *testing.T) {
+	policy := ConnectRetryPolicy{InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second}
+	assert.Equal(t, 100*time.Millisecond, policy.backoff(0))
+	assert.Equal(t, 200*time.Millisecond, policy.backoff(1))
+	assert.Equal(t, 800*time.Millisecond, policy.backoff(3))
+	assert.Equal(t, time.Second, policy.backoff(4))
+	assert.Equal(t, time.Second, policy.backoff(100))
+}
+
+func TestRdsConnectorRetries(t *testing.T) {
+	secrets, server := setupFakeRds(t)
+	defer server.Close()
+
+	ctx := context.Background()
+	conn, err := MakePgConnector(ctx, "rds:testdb:postgres", server.CaPath(),
+		secrets.AwsConfig())
+	assert.NoError(t, err)
+	assert.NotNil(t, conn.Driver())
+
+	// The network failures are retried with the same credentials until the
+	// time runs out
+	server.Close()
+	conn.Retry = ConnectRetryPolicy{InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff: 40 * time.Millisecond, MaxElapsed: 300 * time.Millisecond}
+	start := time.Now()
+	_, err = conn.Connect(ctx)
+	assert.True(t, isConnectionError(err))
+	assert.True(t, time.Since(start) >= 300*time.Millisecond)
+	assert.True(t, time.Since(start) < 3*time.Second)
+	assert.Equal(t, 1, secrets.RequestCount())
+
+	// The context cancellation stops the retries
+	conn.Retry.MaxElapsed = time.Minute
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = conn.Connect(timeoutCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < 3*time.Second)
+}
+
+func TestRdsConnectorFatalError(t *testing.T) {
+	secrets, server := setupFakeRds(t)
+	defer server.Close()
+	otherServer, err := nrsqltest.NewFakePgServer(nil)
+	assert.NoError(t, err)
+	defer otherServer.Close()
+
+	// The certificate is not trusted, there's no point in retrying
+	start := time.Now()
+	_, err = MakePgConnector(context.Background(), "rds:testdb:postgres",
+		otherServer.CaPath(), secrets.AwsConfig())
+	assert.Error(t, err)
+	assert.Equal(t, connErrorFatal, classifyConnError(err))
+	assert.True(t, time.Since(start) < DefaultConnectRetryPolicy.MaxElapsed/2)
+	assert.Equal(t, 0, server.ConnectionCount())
+}
+
+func TestRdsConnectorCredentialsRetries(t *testing.T) {
+	secrets, server := setupFakeRds(t)
+	defer server.Close()
+
+	assert.Equal(t, connErrorFatal, classifyConnError(awserr.New(
+		secretsmanager.ErrCodeResourceNotFoundException, "no secret", nil)))
+	assert.Equal(t, connErrorNetwork, classifyConnError(awserr.NewRequestFailure(
+		awserr.New("InternalServiceError", "failed", nil), 503, "req")))
+
+	// The throttled lookups are retried
+	secrets.FailRequests(2, awserr.New("ThrottlingException", "Rate exceeded", nil))
+	ctx := context.Background()
+	conn, err := MakePgConnector(ctx, "rds:testdb:postgres", server.CaPath(),
+		secrets.AwsConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, secrets.RequestCount())
+	assert.Equal(t, 1, server.ConnectionCount())
+	assert.NoError(t, conn.Ping(ctx))
+}
+
+func TestConnectorDriver(t *testing.T) {
+	conn, err := MakePgConnector(context.Background(), "host=localhost",
+		"", aws.Config{})
+	assert.NoError(t, err)
+	assert.IsType(t, &pq.Driver{}, conn.Driver())
+}
@@ -0,0 +1,306 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/lib/pq"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The Aurora replica lag in seconds, as seen by the writer. NULL on the
+// writer, the WAL replay functions don't work on Aurora.
+const AuroraReplicaLagQuery = `SELECT replica_lag_in_msec / 1000.0 ` +
+	`FROM aurora_replica_status() ` +
+	`WHERE server_id = aurora_db_instance_identifier()`
+
+// The streaming replica lag in seconds for the non-Aurora Postgres, 0 if the
+// replica has replayed everything it has received. NULL if the server is not
+// a replica.
+const PostgresReplicaLagQuery = `SELECT CASE ` +
+	`WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 ` +
+	`ELSE EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()) END`
+
+const DefaultReplicaLagQuery = AuroraReplicaLagQuery
+
+// The replica metrics submitted to the MetricsSink
+const (
+	ReplicaLagMetric     = "Lag"
+	ReplicaHealthyMetric = "Healthy"
+)
+
+type RouterOptions struct {
+	// How often the replicas are checked, 10 seconds by default
+	CheckInterval time.Duration
+	// The replicas that lag more than this are not used, 0 disables the check.
+	// The replicas with the unknown lag are not used either if it's set.
+	MaxReplicaLag time.Duration
+	// The query that returns the replica lag in seconds, DefaultReplicaLagQuery
+	// by default. NULL or no rows mean that the lag is unknown.
+	LagQuery string
+}
+
+type readOnlyKey struct {
+}
+
+var readOnlyKeyVal = &readOnlyKey{}
+
+// Mark the context as safe for the read replicas
+func ReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKeyVal, true)
+}
+
+func IsReadOnly(ctx context.Context) bool {
+	val, _ := ctx.Value(readOnlyKeyVal).(bool)
+	return val
+}
+
+type replica struct {
+	pool *PoolManager
+
+	mtx     sync.Mutex
+	healthy bool
+	lag     time.Duration
+	hasLag  bool
+}
+
+func (r *replica) isUsable(maxLag time.Duration) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.healthy && (maxLag == 0 || r.hasLag && r.lag <= maxLag)
+}
+
+func (r *replica) setHealth(healthy bool, lag time.Duration, hasLag bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.healthy, r.lag, r.hasLag = healthy, lag, hasLag
+}
+
+// Routes the queries between the writer and the read replicas. The read-only
+// transactions and the queries with the ReadOnly context go to the healthy
+// replicas in round-robin, everything else goes to the writer. The replica
+// that fails a ping is removed from the rotation until the next successful
+// check, and the writer is used if there are no usable replicas.
+type DbRouter struct {
+	writer   *PoolManager
+	replicas []*replica
+	sink     visibility.MetricsSink
+	opts     RouterOptions
+
+	next uint32
+}
+
+// Create the router, the replicas are considered healthy until the first check
+func NewDbRouter(writer *PoolManager, replicas []*PoolManager,
+	sink visibility.MetricsSink, opts RouterOptions) *DbRouter {
+
+	if opts.CheckInterval == 0 {
+		opts.CheckInterval = 10 * time.Second
+	}
+	if opts.LagQuery == "" {
+		opts.LagQuery = DefaultReplicaLagQuery
+	}
+
+	res := &DbRouter{
+		writer: writer,
+		sink:   sink,
+		opts:   opts,
+	}
+	for _, r := range replicas {
+		res.replicas = append(res.replicas, &replica{pool: r, healthy: true,
+			hasLag: true})
+	}
+	return res
+}
+
+// Start the pools and the periodic replica checks
+func (r *DbRouter) Start(registry *visibility.ProcessRegistry) {
+	r.writer.Start(registry)
+	for _, rep := range r.replicas {
+		rep.pool.Start(registry)
+	}
+
+	pc := registry.CreateProcessContext(r.writer.name + "ReplicaCheck")
+	pc.RunPeriodicProcess(r.opts.CheckInterval, func(ctx context.Context) error {
+		r.CheckReplicas(ctx)
+		return nil
+	})
+}
+
+func (r *DbRouter) Writer() *sql.DB {
+	return r.writer.DB
+}
+
+// Get a usable replica, or the writer if there are none
+func (r *DbRouter) Reader() *sql.DB {
+	rep := r.pickReplica(nil)
+	if rep == nil {
+		return r.writer.DB
+	}
+	return rep.pool.DB
+}
+
+// Get the database for the context
+func (r *DbRouter) DB(ctx context.Context) *sql.DB {
+	if IsReadOnly(ctx) {
+		return r.Reader()
+	}
+	return r.writer.DB
+}
+
+// Pick the next usable replica in the round-robin order, skipping the
+// already tried ones.
+func (r *DbRouter) pickReplica(tried map[*replica]bool) *replica {
+	num := uint32(len(r.replicas))
+	if num == 0 {
+		return nil
+	}
+	start := atomic.AddUint32(&r.next, 1)
+	for i := uint32(0); i < num; i++ {
+		rep := r.replicas[(start+i)%num]
+		if !tried[rep] && rep.isUsable(r.opts.MaxReplicaLag) {
+			return rep
+		}
+	}
+	return nil
+}
+
+// Run the operation on the replicas, failing over to the next replica (and
+// eventually to the writer) if the replica connection is broken.
+func (r *DbRouter) runRead(ctx context.Context, op func(db *sql.DB) error) error {
+	tried := make(map[*replica]bool)
+	for {
+		rep := r.pickReplica(tried)
+		if rep == nil {
+			return op(r.writer.DB)
+		}
+		tried[rep] = true
+
+		err := op(rep.pool.DB)
+		if err == nil || !isConnectionError(err) || ctx.Err() != nil {
+			return err
+		}
+		r.checkReplica(ctx, rep)
+	}
+}
+
+func (r *DbRouter) ExecContext(ctx context.Context, query string,
+	args ...interface{}) (sql.Result, error) {
+
+	if !IsReadOnly(ctx) {
+		return r.writer.DB.ExecContext(ctx, query, args...)
+	}
+
+	var res sql.Result
+	err := r.runRead(ctx, func(db *sql.DB) error {
+		var err error
+		res, err = db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+func (r *DbRouter) QueryContext(ctx context.Context, query string,
+	args ...interface{}) (*sql.Rows, error) {
+
+	if !IsReadOnly(ctx) {
+		return r.writer.DB.QueryContext(ctx, query, args...)
+	}
+
+	var rows *sql.Rows
+	err := r.runRead(ctx, func(db *sql.DB) error {
+		var err error
+		rows, err = db.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+// The errors are only reported by Scan, so there's no failover for the
+// single row queries.
+func (r *DbRouter) QueryRowContext(ctx context.Context, query string,
+	args ...interface{}) *sql.Row {
+
+	return r.DB(ctx).QueryRowContext(ctx, query, args...)
+}
+
+// Begin the transaction, the read-only transactions go to the replicas
+func (r *DbRouter) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	if (opts == nil || !opts.ReadOnly) && !IsReadOnly(ctx) {
+		return r.writer.DB.BeginTx(ctx, opts)
+	}
+
+	var tx *sql.Tx
+	err := r.runRead(ctx, func(db *sql.DB) error {
+		var err error
+		tx, err = db.BeginTx(ctx, opts)
+		return err
+	})
+	return tx, err
+}
+
+// Ping the replicas and check their lag, the results are submitted to the sink
+func (r *DbRouter) CheckReplicas(ctx context.Context) {
+	for _, rep := range r.replicas {
+		r.checkReplica(ctx, rep)
+	}
+}
+
+func (r *DbRouter) checkReplica(ctx context.Context, rep *replica) {
+	healthy := true
+	var lagSec sql.NullFloat64
+
+	err := rep.pool.CheckReady(ctx)
+	if err == nil {
+		err = rep.pool.DB.QueryRowContext(ctx, r.opts.LagQuery).Scan(&lagSec)
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+	}
+	if err != nil {
+		healthy = false
+		if visibility.HasLogger(ctx) {
+			visibility.CL(ctx).Warn("The replica is unhealthy",
+				zap.String("replica", rep.pool.name), zap.Error(err))
+		}
+	}
+	lag := time.Duration(lagSec.Float64 * float64(time.Second))
+	rep.setHealth(healthy, lag, lagSec.Valid)
+
+	met := &visibility.MetricsContext{
+		OpName:  rep.pool.name + "Replica",
+		Metrics: map[string]*visibility.MetricEntry{},
+	}
+	// The unknown lag is not reported
+	if lagSec.Valid {
+		met.SetDuration(ReplicaLagMetric, lag)
+	}
+	if healthy {
+		met.SetMetric(ReplicaHealthyMetric, 1, cloudwatch.StandardUnitNone)
+	} else {
+		met.SetMetric(ReplicaHealthyMetric, 0, cloudwatch.StandardUnitNone)
+	}
+	r.sink.SubmitSegmentMetrics(met)
+}
+
+// Check if the error means that the server is not reachable
+func isConnectionError(err error) bool {
+	if err == driver.ErrBadConn {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		// Class 08 - Connection Exception, 57P - the server is shutting down
+		return pqErr.Code.Class() == "08" || strings.HasPrefix(string(pqErr.Code), "57P")
+	}
+	return false
+}
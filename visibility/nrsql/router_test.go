@@ -0,0 +1,140 @@
+package nrsql
+
+import (
+	"context"
+	"database/sql"
+	"github.com/aurorasolar/go-service-nr-base/visibility/nrsql/nrsqltest"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type routedServer struct {
+	*nrsqltest.FakePgServer
+	mtx     sync.Mutex
+	queries []string
+	lag     string
+}
+
+func (s *routedServer) handle(q nrsqltest.FakePgQuery) (*nrsqltest.FakePgResult, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if strings.Contains(q.SQL, "aurora_replica_status") {
+		res := &nrsqltest.FakePgResult{Columns: []string{"lag"}}
+		// No lag, no rows
+		if s.lag != "" {
+			res.Rows = [][]string{{s.lag}}
+		}
+		return res, nil
+	}
+	s.queries = append(s.queries, q.SQL)
+	if q.Verb() == "SELECT" {
+		return &nrsqltest.FakePgResult{Columns: []string{"a"}, Rows: [][]string{{"1"}}}, nil
+	}
+	return &nrsqltest.FakePgResult{}, nil
+}
+
+func (s *routedServer) setLag(lag string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.lag = lag
+}
+
+func (s *routedServer) takeQueries() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	res := s.queries
+	s.queries = nil
+	return res
+}
+
+func setupRoutedServer(t *testing.T, name string, sink *poolStatsSink) (
+	*routedServer, *PoolManager) {
+
+	server, err := nrsqltest.NewFakePgServer(func(user, password string) bool {
+		return true
+	})
+	assert.NoError(t, err)
+	res := &routedServer{FakePgServer: server, lag: "0"}
+	server.SetQueryHandler(res.handle)
+
+	conn, err := MakePgConnector(context.Background(),
+		server.ConnString("user", "pass", "db"), "", aws.Config{})
+	assert.NoError(t, err)
+	return res, NewPoolManager(name, conn, sink, PoolOptions{})
+}
+
+func queryOne(t *testing.T, router *DbRouter, ctx context.Context) {
+	rows, err := router.QueryContext(ctx, "SELECT a FROM t")
+	assert.NoError(t, err)
+	assert.NoError(t, rows.Close())
+}
+
+func TestDbRouter(t *testing.T) {
+	sink := &poolStatsSink{}
+	writer, writerPool := setupRoutedServer(t, "Writer", sink)
+	defer writer.Close()
+	reader, readerPool := setupRoutedServer(t, "Reader", sink)
+	defer reader.Close()
+
+	router := NewDbRouter(writerPool, []*PoolManager{readerPool}, sink,
+		RouterOptions{MaxReplicaLag: time.Second})
+	ctx := context.Background()
+
+	// Regular queries go to the writer
+	queryOne(t, router, ctx)
+	_, err := router.ExecContext(ctx, "UPDATE t SET a = 1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(writer.takeQueries()))
+	assert.Equal(t, router.Writer(), router.DB(ctx))
+
+	// The read-only ones to the replica
+	queryOne(t, router, ReadOnly(ctx))
+	tx, err := router.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Commit())
+	assert.Equal(t, []string{"SELECT a FROM t", "BEGIN READ ONLY", "COMMIT"},
+		reader.takeQueries())
+	assert.Equal(t, 0, len(writer.takeQueries()))
+
+	// The lagging replica is not used
+	reader.setLag("1.5")
+	router.CheckReplicas(ctx)
+	met := sink.metrics[len(sink.metrics)-1]
+	assert.Equal(t, "ReaderReplica", met.OpName)
+	assert.Equal(t, 1.5, met.GetMetricVal(ReplicaLagMetric))
+	assert.Equal(t, 1.0, met.GetMetricVal(ReplicaHealthyMetric))
+	queryOne(t, router, ReadOnly(ctx))
+	assert.Equal(t, 1, len(writer.takeQueries()))
+
+	reader.setLag("0")
+	router.CheckReplicas(ctx)
+	assert.Equal(t, router.Reader(), readerPool.DB)
+
+	// The unknown lag is not reported and the replica is not used
+	for _, lag := range []string{nrsqltest.PgNull, ""} {
+		reader.setLag(lag)
+		router.CheckReplicas(ctx)
+		met = sink.metrics[len(sink.metrics)-1]
+		_, hasLag := met.Metrics[ReplicaLagMetric]
+		assert.False(t, hasLag)
+		assert.Equal(t, 1.0, met.GetMetricVal(ReplicaHealthyMetric))
+		assert.Equal(t, router.Writer(), router.Reader())
+	}
+	reader.setLag("0")
+	router.CheckReplicas(ctx)
+	assert.Equal(t, router.Reader(), readerPool.DB)
+
+	// The dead replica fails over to the writer
+	reader.Close()
+	readerPool.DB.SetMaxIdleConns(0)
+	queryOne(t, router, ReadOnly(ctx))
+	assert.Equal(t, 1, len(writer.takeQueries()))
+	met = sink.metrics[len(sink.metrics)-1]
+	assert.Equal(t, 0.0, met.GetMetricVal(ReplicaHealthyMetric))
+	assert.Equal(t, router.Writer(), router.Reader())
+}
@@ -1,8 +1,10 @@
 package nrsql
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
+	"sync"
 )
 
 const RdsRootCert2015 = `-----BEGIN CERTIFICATE-----
@@ -58,11 +60,30 @@ zPW4CXXvhLmE02TA9/HeCw3KEHIwicNuEfw=
 `
 
 type RdsCaVersion int
+
 const (
 	Rds2015 RdsCaVersion = iota
 	Rds2019
 )
 
+var (
+	caFilesMtx sync.Mutex
+	caFiles    = make(map[RdsCaVersion]*CaBundle)
+	// The bundles with the temporary files, see CaBundle.File
+	caBundleFiles = make(map[*CaBundle]bool)
+)
+
+func trackCaBundleFile(bundle *CaBundle) {
+	caFilesMtx.Lock()
+	defer caFilesMtx.Unlock()
+	caBundleFiles[bundle] = true
+}
+
+// Make the temporary file with the embedded RDS root certificate. The file is
+// created once per version, it's deleted by RemoveCaCertFiles, see
+// StartCaCertFilesCleanup.
+// Both embedded certificates have expired, prefer LoadCaBundle with an
+// up-to-date bundle.
 func MakeCaCertFile(version RdsCaVersion) (string, error) {
 	var certText string
 
@@ -75,17 +96,48 @@ func MakeCaCertFile(version RdsCaVersion) (string, error) {
 		return "", fmt.Errorf("unknown certificate version %v", version)
 	}
 
-	file, err := ioutil.TempFile("", "rds-ca-*.pem")
+	bundle, err := getCaFileBundle(version, certText)
 	if err != nil {
 		return "", err
 	}
-	//noinspection GoUnhandledErrorResult
-	defer file.Close()
+	// Not under the caFilesMtx, the File tracks the bundle with it
+	return bundle.File()
+}
 
-	_, err = file.Write([]byte(certText))
-	if err != nil {
-		return "", err
+func getCaFileBundle(version RdsCaVersion, certText string) (*CaBundle, error) {
+	caFilesMtx.Lock()
+	defer caFilesMtx.Unlock()
+
+	bundle := caFiles[version]
+	if bundle == nil {
+		var err error
+		bundle, err = ParseCaBundle([]byte(certText))
+		if err != nil {
+			return nil, err
+		}
+		caFiles[version] = bundle
 	}
+	return bundle, nil
+}
+
+// Remove the files created by MakeCaCertFile and CaBundle.File
+func RemoveCaCertFiles() {
+	caFilesMtx.Lock()
+	bundles := caBundleFiles
+	caBundleFiles = make(map[*CaBundle]bool)
+	caFilesMtx.Unlock()
+
+	for b := range bundles {
+		_ = b.Close()
+	}
+}
 
-	return file.Name(), nil
+// Remove the CA certificate files when the registry closes
+func StartCaCertFilesCleanup(registry *visibility.ProcessRegistry) {
+	pc := registry.CreateProcessContext("CaCertFilesCleanup")
+	pc.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		RemoveCaCertFiles()
+		return nil
+	})
 }
@@ -3,8 +3,11 @@ package nrsql
 import (
 	"crypto/x509"
 	"encoding/pem"
+	"github.com/aurorasolar/go-service-nr-base/visibility"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
 	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -23,4 +26,31 @@ func TestMakeCaCert(t *testing.T) {
 	assert.NoError(t, err)
 
 	assert.Equal(t, "Amazon RDS Root 2019 CA", certificate.Issuer.CommonName)
+
+	// The file is created only once
+	certFile2, err := MakeCaCertFile(Rds2019)
+	assert.NoError(t, err)
+	assert.Equal(t, certFile, certFile2)
+
+	RemoveCaCertFiles()
+	_, err = os.Stat(certFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestCaCertFilesCleanup(t *testing.T) {
+	registry := visibility.NewProcessRegistryWithTracer("", zap.NewNop(), visibility.NoopTracer,
+		visibility.NullSink)
+	StartCaCertFilesCleanup(registry)
+
+	certFile, err := MakeCaCertFile(Rds2015)
+	assert.NoError(t, err)
+	bundleFile, err := makeLegacyCaBundle().File()
+	assert.NoError(t, err)
+
+	// The files are removed on shutdown
+	registry.Close()
+	_, err = os.Stat(certFile)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(bundleFile)
+	assert.True(t, os.IsNotExist(err))
 }
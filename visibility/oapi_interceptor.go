@@ -9,7 +9,6 @@ import (
 	"encoding/json"
 	"fmt"
 	. "github.com/aurorasolar/go-service-nr-base/utils"
-	newrelic "github.com/newrelic/go-agent"
 	"go.uber.org/zap"
 	"io/ioutil"
 	"net/http"
@@ -120,14 +119,17 @@ func (r *requestValidationAndMetrics) validateAndRunWithMetrics(ctx echo.Context
 	opId = strings.ToUpper(opId[0:1]) + opId[1:]
 
 	// Upload metrics from the segment at the end of the request
-	trans := newrelic.FromContext(req.Context())
-	_ = trans.SetName(opId) // TODO: add as an attribute?
+	trans := SpanFromContext(req.Context())
+	if trans != nil {
+		trans.SetName(opId) // TODO: add as an attribute?
+	}
 
 	// Now that we have the opname, we can create the metric context
 	metCtx := MakeMetricContext(ctx.Request().Context(), opId)
 	met := GetMetricsFromContext(metCtx)
+	met.KeepSketches = wantsSketches(r.sink)
 	ctx.SetRequest(ctx.Request().WithContext(metCtx))
-	defer met.CopyToTransaction(trans)
+	defer met.CopyToSpan(trans)
 	defer r.sink.SubmitSegmentMetrics(met)
 
 	// We set the service fault counter immediately to 1
@@ -0,0 +1,432 @@
+package visibility
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OTLP/HTTP paths, relative to the endpoint
+const (
+	OtlpTracesPath  = "/v1/traces"
+	OtlpMetricsPath = "/v1/metrics"
+)
+
+const (
+	DefaultOtlpFlushInterval  = 5 * time.Second
+	DefaultOtlpMaxQueuedSpans = 2048
+	DefaultOtlpTimeout        = 10 * time.Second
+
+	otlpScopeName = "github.com/aurorasolar/go-service-nr-base/visibility"
+)
+
+// The OTLP JSON encoding of the protobuf messages, the 64-bit integers are
+// the strings and the trace and the span IDs are the hex strings
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano string         `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue      `json:"attributes,omitempty"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	TimeUnixNano      string              `json:"timeUnixNano"`
+	Count             string              `json:"count"`
+	Sum               float64             `json:"sum"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues,omitempty"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name    string       `json:"name"`
+	Unit    string       `json:"unit,omitempty"`
+	Sum     *otlpSum     `json:"sum,omitempty"`
+	Summary *otlpSummary `json:"summary,omitempty"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// AGGREGATION_TEMPORALITY_DELTA
+const otlpTemporalityDelta = 1
+
+// The UCUM units of the normalized units
+var otlpUnits = map[cloudwatch.StandardUnit]string{
+	cloudwatch.StandardUnitMicroseconds: "us",
+	cloudwatch.StandardUnitBytes:        "By",
+	cloudwatch.StandardUnitBits:         "bit",
+	cloudwatch.StandardUnitBytesSecond:  "By/s",
+	cloudwatch.StandardUnitBitsSecond:   "bit/s",
+	cloudwatch.StandardUnitCount:        "1",
+	cloudwatch.StandardUnitCountSecond:  "1/s",
+	cloudwatch.StandardUnitPercent:      "%",
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func makeOtlpValue(v interface{}) otlpAnyValue {
+	switch val := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &val}
+	case bool:
+		return otlpAnyValue{BoolValue: &val}
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		str := strconv.FormatInt(rv.Int(), 10)
+		return otlpAnyValue{IntValue: &str}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		str := strconv.FormatUint(rv.Uint(), 10)
+		return otlpAnyValue{IntValue: &str}
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		return otlpAnyValue{DoubleValue: &f}
+	}
+	str := fmt.Sprintf("%v", v)
+	return otlpAnyValue{StringValue: &str}
+}
+
+// Convert the attributes sorted by the key
+func makeOtlpAttributes(attrs map[string]interface{}) []otlpKeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]otlpKeyValue, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, otlpKeyValue{Key: k, Value: makeOtlpValue(attrs[k])})
+	}
+	return res
+}
+
+// Exports the spans of the OtlpTracer and the metrics to an OpenTelemetry
+// collector (or any other receiver) using the OTLP/HTTP with the JSON
+// encoding. The metrics are aggregated the same way as in the
+// AggregatingSink, and everything is sent by Flush. The spans over the
+// MaxQueuedSpans limit are dropped until the next flush.
+type OtlpExporter struct {
+	// The base URL of the receiver, like http://localhost:4318
+	Endpoint string
+	Client   *http.Client
+	// Sent with every request, for the authentication
+	Headers map[string]string
+	// The resource attributes, the service.name is set by NewOtlpExporter
+	ResourceAttributes map[string]interface{}
+	FlushInterval      time.Duration
+	MaxQueuedSpans     int
+	// Keep the quantile sketches and report these percentiles (0..1) in the
+	// summaries, the min and the max are always reported
+	Percentiles []float64
+
+	mtx          sync.Mutex
+	spans        []otlpSpan
+	droppedSpans int64
+	start        time.Time
+	series       map[string]*aggregatedSeries
+}
+
+var _ FlushingSink = &OtlpExporter{}
+var _ SketchingSink = &OtlpExporter{}
+
+func NewOtlpExporter(endpoint, serviceName string) *OtlpExporter {
+	return &OtlpExporter{
+		Endpoint: endpoint,
+		Client:   &http.Client{Timeout: DefaultOtlpTimeout},
+		ResourceAttributes: map[string]interface{}{
+			"service.name": serviceName,
+		},
+		FlushInterval:  DefaultOtlpFlushInterval,
+		MaxQueuedSpans: DefaultOtlpMaxQueuedSpans,
+		start:          time.Now(),
+		series:         make(map[string]*aggregatedSeries),
+	}
+}
+
+func (e *OtlpExporter) WantsSketches() bool {
+	return len(e.Percentiles) != 0
+}
+
+func (e *OtlpExporter) SubmitSegmentMetrics(met *MetricsContext) {
+	met.Lock.Lock()
+	defer met.Lock.Unlock()
+
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	aggregateMetrics(e.series, met, e.WantsSketches())
+}
+
+func (e *OtlpExporter) enqueueSpan(span otlpSpan) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if len(e.spans) >= e.MaxQueuedSpans {
+		e.droppedSpans++
+		return
+	}
+	e.spans = append(e.spans, span)
+}
+
+// The number of the spans dropped because the queue was full
+func (e *OtlpExporter) DroppedSpans() int64 {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	return e.droppedSpans
+}
+
+func (e *OtlpExporter) makeResource() otlpResource {
+	return otlpResource{Attributes: makeOtlpAttributes(e.ResourceAttributes)}
+}
+
+// Send the queued spans and the metrics aggregated since the last flush,
+// returns the first error. The data from the failed requests is not retried.
+func (e *OtlpExporter) Flush(ctx context.Context) error {
+	e.mtx.Lock()
+	spans := e.spans
+	series := e.series
+	start := e.start
+	e.spans = nil
+	e.series = make(map[string]*aggregatedSeries)
+	e.start = time.Now()
+	e.mtx.Unlock()
+
+	var firstErr error
+	if len(spans) != 0 {
+		firstErr = e.post(ctx, OtlpTracesPath, otlpTracesRequest{
+			ResourceSpans: []otlpResourceSpans{{
+				Resource: e.makeResource(),
+				ScopeSpans: []otlpScopeSpans{{
+					Scope: otlpScope{Name: otlpScopeName},
+					Spans: spans,
+				}},
+			}},
+		})
+	}
+
+	if len(series) != 0 {
+		err := e.post(ctx, OtlpMetricsPath, otlpMetricsRequest{
+			ResourceMetrics: []otlpResourceMetrics{{
+				Resource: e.makeResource(),
+				ScopeMetrics: []otlpScopeMetrics{{
+					Scope:   otlpScope{Name: otlpScopeName},
+					Metrics: e.makeMetrics(series, start, time.Now()),
+				}},
+			}},
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (e *OtlpExporter) post(ctx context.Context, path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(e.Endpoint, "/") + path
+	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the OTLP export to %s has failed with the status %d",
+			url, resp.StatusCode)
+	}
+	return nil
+}
+
+// The counts become the delta sums, everything else becomes the summaries,
+// in the normalized units
+func (e *OtlpExporter) makeMetrics(series map[string]*aggregatedSeries,
+	start, now time.Time) []otlpMetric {
+
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]otlpMetric, 0, len(keys))
+	for _, k := range keys {
+		s := series[k]
+		entry := MetricEntry{Val: s.sum, Unit: s.unit}
+		normVal, normUnit := entry.Normalize()
+		attrs := makeOtlpAttributes(makeMetricAttributes(s.dims, &entry, normUnit))
+		metric := otlpMetric{
+			Name: s.opName + "_" + s.name,
+			Unit: otlpUnits[normUnit],
+		}
+
+		if s.dist == nil {
+			metric.Sum = &otlpSum{
+				DataPoints: []otlpNumberDataPoint{{
+					Attributes:        attrs,
+					StartTimeUnixNano: otlpTime(start),
+					TimeUnixNano:      otlpTime(now),
+					AsDouble:          normVal,
+				}},
+				AggregationTemporality: otlpTemporalityDelta,
+				IsMonotonic:            true,
+			}
+			res = append(res, metric)
+			continue
+		}
+
+		factor := entry.normalizeFactor()
+		quantiles := []otlpQuantileValue{{Quantile: 0, Value: s.dist.Min * factor}}
+		for _, p := range e.Percentiles {
+			if val, ok := s.dist.Quantile(p); ok {
+				quantiles = append(quantiles, otlpQuantileValue{Quantile: p, Value: val * factor})
+			}
+		}
+		quantiles = append(quantiles, otlpQuantileValue{Quantile: 1, Value: s.dist.Max * factor})
+
+		metric.Summary = &otlpSummary{
+			DataPoints: []otlpSummaryDataPoint{{
+				Attributes:        attrs,
+				StartTimeUnixNano: otlpTime(start),
+				TimeUnixNano:      otlpTime(now),
+				Count:             strconv.FormatInt(s.dist.Count, 10),
+				Sum:               s.dist.Sum * factor,
+				QuantileValues:    quantiles,
+			}},
+		}
+		res = append(res, metric)
+	}
+	return res
+}
+
+// Export periodically, and once more when the registry closes
+func (e *OtlpExporter) Start(registry *ProcessRegistry) {
+	flushCtx := registry.CreateProcessContext("OtlpExport")
+	flushCtx.RunPeriodicProcess(e.FlushInterval, func(ctx context.Context) error {
+		// Closing the registry must not cancel the export in flight, the
+		// client has its own timeout
+		return e.Flush(context.Background())
+	})
+
+	finalCtx := registry.CreateProcessContext("OtlpFinalExport")
+	finalCtx.Run(func(ctx context.Context) error {
+		<-ctx.Done()
+		return e.Flush(context.Background())
+	})
+}
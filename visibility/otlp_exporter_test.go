@@ -0,0 +1,205 @@
+package visibility
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The stand-in for the OTLP/HTTP receiver of the collector
+type otlpReceiver struct {
+	*httptest.Server
+	Status int
+
+	mtx     sync.Mutex
+	traces  []otlpTracesRequest
+	metrics []otlpMetricsRequest
+	headers []http.Header
+}
+
+func newOtlpReceiver() *otlpReceiver {
+	res := &otlpReceiver{Status: http.StatusOK}
+	res.Server = httptest.NewServer(http.HandlerFunc(res.handle))
+	return res
+}
+
+func (o *otlpReceiver) handle(w http.ResponseWriter, r *http.Request) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	o.headers = append(o.headers, r.Header)
+	var err error
+	switch r.URL.Path {
+	case OtlpTracesPath:
+		var req otlpTracesRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		o.traces = append(o.traces, req)
+	case OtlpMetricsPath:
+		var req otlpMetricsRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		o.metrics = append(o.metrics, req)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(o.Status)
+}
+
+func (o *otlpReceiver) spans() []otlpSpan {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	var res []otlpSpan
+	for _, req := range o.traces {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				res = append(res, ss.Spans...)
+			}
+		}
+	}
+	return res
+}
+
+func (o *otlpReceiver) findMetric(name string) *otlpMetric {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	for _, req := range o.metrics {
+		for _, rm := range req.ResourceMetrics {
+			for _, sm := range rm.ScopeMetrics {
+				for i := range sm.Metrics {
+					if sm.Metrics[i].Name == name {
+						return &sm.Metrics[i]
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func getOtlpAttribute(attrs []otlpKeyValue, key string) interface{} {
+	for _, a := range attrs {
+		if a.Key != key {
+			continue
+		}
+		switch {
+		case a.Value.StringValue != nil:
+			return *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			return *a.Value.IntValue
+		case a.Value.DoubleValue != nil:
+			return *a.Value.DoubleValue
+		case a.Value.BoolValue != nil:
+			return *a.Value.BoolValue
+		}
+	}
+	return nil
+}
+
+func TestOtlpExporterMetrics(t *testing.T) {
+	receiver := newOtlpReceiver()
+	defer receiver.Close()
+
+	exporter := NewOtlpExporter(receiver.URL, "test-service")
+	exporter.Headers = map[string]string{"api-key": "secret"}
+	exporter.Percentiles = []float64{0.5}
+	assert.True(t, wantsSketches(exporter))
+
+	// Nothing to send yet
+	assert.NoError(t, exporter.Flush(context.Background()))
+	assert.Empty(t, receiver.headers)
+
+	for i := 1; i <= 10; i++ {
+		ctx := MakeMetricContext(context.Background(), "Op")
+		met := GetMetricsFromContext(ctx)
+		met.KeepSketches = true
+		met.AddCount("calls", 2)
+		met.SetMetric("size", float64(i), cloudwatch.StandardUnitKilobytes)
+		exporter.SubmitSegmentMetrics(met)
+	}
+	assert.NoError(t, exporter.Flush(context.Background()))
+
+	assert.Equal(t, 1, len(receiver.metrics))
+	assert.Equal(t, "secret", receiver.headers[0].Get("api-key"))
+	resource := receiver.metrics[0].ResourceMetrics[0].Resource
+	assert.Equal(t, "test-service", getOtlpAttribute(resource.Attributes, "service.name"))
+
+	calls := receiver.findMetric("Op_calls")
+	assert.Equal(t, "1", calls.Unit)
+	assert.Equal(t, otlpTemporalityDelta, calls.Sum.AggregationTemporality)
+	assert.True(t, calls.Sum.IsMonotonic)
+	assert.Equal(t, 20.0, calls.Sum.DataPoints[0].AsDouble)
+
+	// The kilobytes are normalized to the bytes
+	size := receiver.findMetric("Op_size")
+	assert.Equal(t, "By", size.Unit)
+	point := size.Summary.DataPoints[0]
+	assert.Equal(t, "10", point.Count)
+	assert.Equal(t, 55*1024.0, point.Sum)
+	assert.Equal(t, "Kilobytes", getOtlpAttribute(point.Attributes, "OrigUnit"))
+	assert.Equal(t, 3, len(point.QuantileValues))
+	assert.Equal(t, otlpQuantileValue{Quantile: 0, Value: 1024}, point.QuantileValues[0])
+	assert.InDelta(t, 5*1024.0, point.QuantileValues[1].Value, 0.02*5*1024)
+	assert.Equal(t, otlpQuantileValue{Quantile: 1, Value: 10 * 1024}, point.QuantileValues[2])
+
+	// The aggregates are reset by the flush
+	assert.NoError(t, exporter.Flush(context.Background()))
+	assert.Equal(t, 1, len(receiver.metrics))
+}
+
+func TestOtlpExporterErrors(t *testing.T) {
+	receiver := newOtlpReceiver()
+	defer receiver.Close()
+	receiver.Status = http.StatusServiceUnavailable
+
+	exporter := NewOtlpExporter(receiver.URL, "test-service")
+	exporter.MaxQueuedSpans = 1
+	tracer := NewOtlpTracer(exporter)
+	tracer.StartTransaction("One").End()
+	tracer.StartTransaction("Two").End()
+	assert.Equal(t, int64(1), exporter.DroppedSpans())
+
+	err := exporter.Flush(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "status 503")
+	// The failed requests are not retried
+	receiver.Status = http.StatusOK
+	assert.NoError(t, exporter.Flush(context.Background()))
+	assert.Equal(t, 1, len(receiver.spans()))
+}
+
+func TestOtlpExporterProcesses(t *testing.T) {
+	receiver := newOtlpReceiver()
+	defer receiver.Close()
+
+	exporter := NewOtlpExporter(receiver.URL, "test-service")
+	exporter.FlushInterval = time.Hour
+	tracer := NewOtlpTracer(exporter)
+	registry := NewProcessRegistryWithTracer("test", zap.NewNop(), tracer, exporter)
+	exporter.Start(registry)
+
+	err := RunInstrumentedWithTracer(context.Background(), "Job", tracer, exporter, zap.NewNop(),
+		func(ctx context.Context) error {
+			GetMetricsFromContext(ctx).AddCount("items", 3)
+			return nil
+		})
+	assert.NoError(t, err)
+
+	// The final export sends everything
+	registry.Close()
+	assert.Equal(t, 1, len(receiver.spans()))
+	assert.Equal(t, "Job", receiver.spans()[0].Name)
+	assert.Equal(t, 3.0, receiver.findMetric("Job_items").Sum.DataPoints[0].AsDouble)
+}
@@ -13,7 +13,7 @@ import (
 
 type ProcessRegistry struct {
 	xraySuffix string
-	app        newrelic.Application
+	tracer     Tracer
 	metrics    MetricsSink
 
 	logger     *zap.Logger
@@ -36,10 +36,17 @@ type ProcessContext struct {
 func NewProcessRegistry(xraySuffix string, logger *zap.Logger, app newrelic.Application,
 	metrics MetricsSink) *ProcessRegistry {
 
+	return NewProcessRegistryWithTracer(xraySuffix, logger, tracerForApp(app), metrics)
+}
+
+// Create the registry that traces the processes using the tracer
+func NewProcessRegistryWithTracer(xraySuffix string, logger *zap.Logger, tracer Tracer,
+	metrics MetricsSink) *ProcessRegistry {
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &ProcessRegistry{
 		xraySuffix: xraySuffix,
-		app:        app,
+		tracer:     tracer,
 		metrics:    metrics,
 		logger:     logger,
 		rootCtx:    ctx,
@@ -109,8 +116,8 @@ func (pc *ProcessContext) Run(proc func(ctx context.Context) error) {
 		xrayName := pc.Name + pc.Parent.xraySuffix
 
 		// Run the process with XRay instrumentation
-		_ = RunInstrumented(pc.Parent.rootCtx, xrayName, pc.Parent.app, pc.Parent.metrics,
-			pc.Parent.logger, func(xc context.Context) error {
+		_ = RunInstrumentedWithTracer(pc.Parent.rootCtx, xrayName, pc.Parent.tracer,
+			pc.Parent.metrics, pc.Parent.logger, func(xc context.Context) error {
 
 				err := proc(xc)
 				if err != nil {
@@ -147,7 +154,7 @@ func (pc *ProcessContext) RunPeriodicProcess(period time.Duration,
 			xrayName := pc.Name + pc.Parent.xraySuffix
 
 			// Run the process with XRay instrumentation
-			_ = RunInstrumented(pc.Parent.rootCtx, xrayName, pc.Parent.app,
+			_ = RunInstrumentedWithTracer(pc.Parent.rootCtx, xrayName, pc.Parent.tracer,
 				pc.Parent.metrics, pc.Parent.logger, func(xc context.Context) error {
 
 					err := proc(xc)
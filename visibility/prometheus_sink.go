@@ -0,0 +1,286 @@
+package visibility
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/labstack/echo/v4"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const PrometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// The label with the MetricsContext.OpName
+const PrometheusOpLabel = "op"
+
+// The exponential buckets: start, start*factor, start*factor^2, ...
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	res := make([]float64, count)
+	for i := range res {
+		res[i] = start
+		start *= factor
+	}
+	return res
+}
+
+// From 1 to about 6.7e7, that is from 1us to 67 seconds for the durations
+var DefaultPrometheusBuckets = ExponentialBuckets(1, 4, 14)
+
+type promSeries struct {
+	labels string
+
+	// For the counters
+	value float64
+	// For the histograms, the non-cumulative counts per bucket
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+type promFamily struct {
+	name      string
+	histogram bool
+	series    map[string]*promSeries
+}
+
+// Accumulates the metrics as Prometheus counters (the Count metrics) and
+// histograms (everything else), labeled by the operation name and the
+// dimensions. The values are in the units from MetricEntry.Normalize, and
+// the unit is a part of the metric name: DbTime becomes
+// db_time_microseconds.
+type PrometheusSink struct {
+	// The prefix for the metric names
+	Namespace string
+	// The histogram bucket upper bounds, in the normalized units
+	Buckets []float64
+
+	mtx      sync.Mutex
+	families map[string]*promFamily
+}
+
+var _ SketchingSink = &PrometheusSink{}
+
+func NewPrometheusSink(namespace string) *PrometheusSink {
+	return &PrometheusSink{
+		Namespace: namespace,
+		Buckets:   DefaultPrometheusBuckets,
+		families:  make(map[string]*promFamily),
+	}
+}
+
+// The distributions are converted to the histograms using their sketches
+func (p *PrometheusSink) WantsSketches() bool {
+	return true
+}
+
+func (p *PrometheusSink) SubmitSegmentMetrics(met *MetricsContext) {
+	met.Lock.Lock()
+	defer met.Lock.Unlock()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	for key, val := range met.Metrics {
+		name, dims := met.exportedMetric(key, val)
+		_, normUnit := val.Normalize()
+		isCounter := val.Unit == cloudwatch.StandardUnitCount && val.Dist == nil
+
+		series := p.getSeries(p.familyName(name, normUnit, isCounter), !isCounter,
+			makePromLabels(met.OpName, dims))
+		if isCounter {
+			series.value += val.Val
+			continue
+		}
+
+		factor := val.normalizeFactor()
+		switch {
+		case val.Dist == nil:
+			p.observe(series, val.Val*factor, 1)
+		case val.Dist.Sketch != nil:
+			// The sketch values are approximate, but the sum is exact
+			sum := series.sum
+			val.Dist.Sketch.ForEach(func(v float64, count int64) {
+				p.observe(series, v*factor, count)
+			})
+			series.sum = sum + val.Dist.Sum*factor
+		default:
+			// No sketch, the best we can do is to use the mean
+			p.observe(series, val.Dist.Mean()*factor, val.Dist.Count)
+		}
+	}
+}
+
+func (p *PrometheusSink) familyName(name string, unit cloudwatch.StandardUnit,
+	isCounter bool) string {
+
+	res := sanitizePromName(toSnakeCase(name))
+	if p.Namespace != "" {
+		res = sanitizePromName(p.Namespace) + "_" + res
+	}
+	if unit != cloudwatch.StandardUnitCount && unit != cloudwatch.StandardUnitNone {
+		res += "_" + strings.Replace(strings.ToLower(string(unit)), "/", "_per_", -1)
+	}
+	if isCounter {
+		res += "_total"
+	}
+	return res
+}
+
+// Must be called with the lock held
+func (p *PrometheusSink) getSeries(familyName string, histogram bool,
+	labels string) *promSeries {
+
+	family := p.families[familyName]
+	if family == nil {
+		family = &promFamily{
+			name:      familyName,
+			histogram: histogram,
+			series:    make(map[string]*promSeries),
+		}
+		p.families[familyName] = family
+	}
+
+	series := family.series[labels]
+	if series == nil {
+		series = &promSeries{labels: labels}
+		if histogram {
+			series.buckets = make([]int64, len(p.Buckets)+1)
+		}
+		family.series[labels] = series
+	}
+	return series
+}
+
+func (p *PrometheusSink) observe(series *promSeries, val float64, count int64) {
+	idx := sort.SearchFloat64s(p.Buckets, val)
+	series.buckets[idx] += count
+	series.count += count
+	series.sum += val * float64(count)
+}
+
+// Write the metrics in the Prometheus text exposition format
+func (p *PrometheusSink) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	p.mtx.Lock()
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p.writeFamily(&buf, p.families[name])
+	}
+	p.mtx.Unlock()
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func (p *PrometheusSink) writeFamily(buf *bytes.Buffer, family *promFamily) {
+	labels := make([]string, 0, len(family.series))
+	for l := range family.series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	if !family.histogram {
+		buf.WriteString("# TYPE " + family.name + " counter\n")
+		for _, l := range labels {
+			buf.WriteString(family.name + "{" + l + "} " +
+				formatPromValue(family.series[l].value) + "\n")
+		}
+		return
+	}
+
+	buf.WriteString("# TYPE " + family.name + " histogram\n")
+	for _, l := range labels {
+		series := family.series[l]
+		var cumulative int64
+		for i, bound := range p.Buckets {
+			cumulative += series.buckets[i]
+			buf.WriteString(family.name + "_bucket{" + l + `,le="` +
+				formatPromValue(bound) + `"} ` + strconv.FormatInt(cumulative, 10) + "\n")
+		}
+		buf.WriteString(family.name + "_bucket{" + l + `,le="+Inf"} ` +
+			strconv.FormatInt(series.count, 10) + "\n")
+		buf.WriteString(family.name + "_sum{" + l + "} " +
+			formatPromValue(series.sum) + "\n")
+		buf.WriteString(family.name + "_count{" + l + "} " +
+			strconv.FormatInt(series.count, 10) + "\n")
+	}
+}
+
+// The Echo handler for the /metrics endpoint
+func (p *PrometheusSink) EchoHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, PrometheusContentType)
+		c.Response().WriteHeader(http.StatusOK)
+		_, err := p.WriteTo(c.Response())
+		return err
+	}
+}
+
+func makePromLabels(opName string, dims Dimensions) string {
+	var sb strings.Builder
+	sb.WriteString(PrometheusOpLabel + `="` + escapePromLabel(opName) + `"`)
+	for _, k := range dims.sortedKeys() {
+		name := sanitizePromName(k)
+		if name == PrometheusOpLabel {
+			continue
+		}
+		sb.WriteString("," + name + `="` + escapePromLabel(dims[k]) + `"`)
+	}
+	return sb.String()
+}
+
+func escapePromLabel(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `"`, `\"`, -1)
+	return strings.Replace(val, "\n", `\n`, -1)
+}
+
+func formatPromValue(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// Replace the characters that are not allowed in the metric and label names
+func sanitizePromName(name string) string {
+	res := []rune(name)
+	for i, r := range res {
+		if !(r == '_' || r < unicode.MaxASCII && (unicode.IsLetter(r) ||
+			i > 0 && unicode.IsDigit(r))) {
+			res[i] = '_'
+		}
+	}
+	return string(res)
+}
+
+// DbTime -> db_time, HTTPCode -> http_code
+func toSnakeCase(name string) string {
+	runes := []rune(name)
+	var sb strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) ||
+			unicode.IsDigit(runes[i-1]) ||
+			i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1])) {
+			sb.WriteByte('_')
+		}
+		sb.WriteRune(unicode.ToLower(r))
+	}
+	return sb.String()
+}
@@ -0,0 +1,67 @@
+package visibility
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	sink := NewPrometheusSink("svc")
+	sink.Buckets = []float64{1000, 100000}
+
+	for i := 0; i < 2; i++ {
+		met := &MetricsContext{OpName: "GetUser", Metrics: map[string]*MetricEntry{},
+			KeepSketches: true}
+		met.AddCount("DbQueries", 2)
+		met.AddMetricWithDims("DbQueries", Dimensions{"table": `a"b`}, 1,
+			cloudwatch.StandardUnitCount)
+		met.SetDuration("Time", 50*time.Millisecond)
+		met.ObserveMetric("Size", 10, cloudwatch.StandardUnitKilobytes)
+		met.ObserveMetric("Size", 200, cloudwatch.StandardUnitKilobytes)
+		sink.SubmitSegmentMetrics(met)
+	}
+
+	e := echo.New()
+	e.GET("/metrics", sink.EchoHandler())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, PrometheusContentType, rec.Header().Get(echo.HeaderContentType))
+
+	lines := strings.Split(rec.Body.String(), "\n")
+	assert.Contains(t, lines, "# TYPE svc_db_queries_total counter")
+	assert.Contains(t, lines, `svc_db_queries_total{op="GetUser"} 4`)
+	assert.Contains(t, lines, `svc_db_queries_total{op="GetUser",table="a\"b"} 2`)
+
+	_, timeUnit := MetricEntry{Unit: cloudwatch.StandardUnitSeconds}.Normalize()
+	timeName := "svc_time_" + strings.ToLower(string(timeUnit))
+	assert.Contains(t, lines, "# TYPE "+timeName+" histogram")
+	assert.Contains(t, lines, timeName+`_count{op="GetUser"} 2`)
+	assert.Contains(t, lines, timeName+`_bucket{op="GetUser",le="+Inf"} 2`)
+
+	// 10Kb and 200Kb
+	assert.Contains(t, lines, `svc_size_bytes_bucket{op="GetUser",le="1000"} 0`)
+	assert.Contains(t, lines, `svc_size_bytes_bucket{op="GetUser",le="100000"} 2`)
+	assert.Contains(t, lines, `svc_size_bytes_bucket{op="GetUser",le="+Inf"} 4`)
+	assert.Contains(t, lines, `svc_size_bytes_sum{op="GetUser"} 430080`)
+}
+
+func TestPrometheusNames(t *testing.T) {
+	assert.Equal(t, "db_time", toSnakeCase("DbTime"))
+	assert.Equal(t, "http_code", toSnakeCase("HTTPCode"))
+	assert.Equal(t, "fault", toSnakeCase("Fault"))
+	assert.Equal(t, "a_b_c_1", sanitizePromName("a.b-c 1"))
+	assert.Equal(t, "_1", sanitizePromName("11"))
+
+	sink := NewPrometheusSink("")
+	assert.Equal(t, "rate_bytes_per_second", sink.familyName("Rate",
+		cloudwatch.StandardUnitBytesSecond, false))
+	assert.Equal(t, "calls_total", sink.familyName("Calls",
+		cloudwatch.StandardUnitCount, true))
+}
@@ -0,0 +1,232 @@
+package visibility
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	. "github.com/aurorasolar/go-service-nr-base/utils"
+	newrelic "github.com/newrelic/go-agent"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+)
+
+type RedactionAction int
+
+const (
+	// Keep the value as is
+	RedactNone RedactionAction = iota
+	// Replace the value with RedactedValue
+	RedactMask
+	// Replace the value with its hash, so the requests can still be matched
+	RedactHash
+	// Drop the attribute altogether
+	RedactDrop
+)
+
+const RedactedValue = "[REDACTED]"
+
+// Decides what happens to the sensitive request attributes, the keys are
+// matched case-insensitively
+type RedactionPolicy struct {
+	// The actions for the exact (lower-case) keys
+	Keys map[string]RedactionAction
+	// The actions for the keys containing these (lower-case) substrings
+	Substrings map[string]RedactionAction
+}
+
+// Used when the RequestAttributes have no policy of their own
+var DefaultRedactionPolicy = &RedactionPolicy{
+	Substrings: map[string]RedactionAction{
+		"password":      RedactDrop,
+		"secret":        RedactDrop,
+		"token":         RedactDrop,
+		"authorization": RedactDrop,
+		"cookie":        RedactDrop,
+		"email":         RedactHash,
+	},
+}
+
+// Get the action for the key, the exact keys take precedence over the
+// substrings, and the strictest of the matching substrings wins
+func (p *RedactionPolicy) GetAction(key string) RedactionAction {
+	key = strings.ToLower(key)
+	if action, ok := p.Keys[key]; ok {
+		return action
+	}
+	res := RedactNone
+	for sub, action := range p.Substrings {
+		if action > res && strings.Contains(key, sub) {
+			res = action
+		}
+	}
+	return res
+}
+
+// Get the redacted value, false if the attribute is dropped
+func (p *RedactionPolicy) Apply(key string, value interface{}) (interface{}, bool) {
+	switch p.GetAction(key) {
+	case RedactMask:
+		return RedactedValue, true
+	case RedactHash:
+		sum := sha256.Sum256([]byte(fmt.Sprint(value)))
+		return "sha256:" + hex.EncodeToString(sum[:8]), true
+	case RedactDrop:
+		return nil, false
+	}
+	return value, true
+}
+
+type requestAttributesKey struct {
+}
+
+var requestAttributesKeyVal = &requestAttributesKey{}
+
+// The facts about the request (the customer ID, the feature flags and so
+// on) added by the handlers. They are added to the New Relic transaction,
+// to the loggers returned by CL and CLS, and to the metric dimensions. The
+// values are redacted according to the policy.
+type RequestAttributes struct {
+	Policy *RedactionPolicy
+
+	mtx    sync.Mutex
+	keys   []string
+	values map[string]interface{}
+	// The base logger -> the logger with the attributes
+	loggers map[*zap.Logger]*zap.Logger
+}
+
+// Attach the attributes bag to the context, the nested calls share the bag
+// that is already there
+func MakeRequestAttributesContext(ctx context.Context) context.Context {
+	if GetRequestAttributes(ctx) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestAttributesKeyVal, &RequestAttributes{
+		values:  make(map[string]interface{}),
+		loggers: make(map[*zap.Logger]*zap.Logger),
+	})
+}
+
+// Get the attributes bag from the context, nil if there's none
+func GetRequestAttributes(ctx context.Context) *RequestAttributes {
+	res, _ := ctx.Value(requestAttributesKeyVal).(*RequestAttributes)
+	return res
+}
+
+func checkAttributeValue(value interface{}) bool {
+	switch value.(type) {
+	case string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32,
+		uint64, float32, float64:
+		return true
+	}
+	return false
+}
+
+// Add the fact about the request, the value must be a string, a bool or a
+// number. The later values replace the earlier ones.
+func AddRequestAttribute(ctx context.Context, key string, value interface{}) {
+	PanicIfF(!checkAttributeValue(value), "unsupported attribute type %T", value)
+	attrs := GetRequestAttributes(ctx)
+	PanicIfF(attrs == nil, "No request attributes attached")
+
+	value, ok := attrs.policy().Apply(key, value)
+	if !ok {
+		return
+	}
+	attrs.set(key, value)
+
+	if span := SpanFromContext(ctx); span != nil {
+		span.AddAttribute(key, value)
+	}
+}
+
+func (a *RequestAttributes) policy() *RedactionPolicy {
+	if a.Policy != nil {
+		return a.Policy
+	}
+	return DefaultRedactionPolicy
+}
+
+func (a *RequestAttributes) set(key string, value interface{}) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if _, ok := a.values[key]; !ok {
+		a.keys = append(a.keys, key)
+	}
+	a.values[key] = value
+	// The loggers have to be decorated again
+	a.loggers = make(map[*zap.Logger]*zap.Logger)
+}
+
+// Get the (redacted) value of the attribute
+func (a *RequestAttributes) Get(key string) (interface{}, bool) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	val, ok := a.values[key]
+	return val, ok
+}
+
+// Get the attributes as the log fields, in the order they were added
+func (a *RequestAttributes) Fields() []zap.Field {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.fields()
+}
+
+func (a *RequestAttributes) fields() []zap.Field {
+	res := make([]zap.Field, 0, len(a.keys))
+	for _, k := range a.keys {
+		res = append(res, zap.Any(k, a.values[k]))
+	}
+	return res
+}
+
+// Get the attributes as the metric dimensions
+func (a *RequestAttributes) Dimensions() Dimensions {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	res := make(Dimensions, len(a.values))
+	for k, v := range a.values {
+		res[k] = fmt.Sprint(v)
+	}
+	return res
+}
+
+// Add the attributes to the transaction, for the transactions started after
+// the attributes were added
+func (a *RequestAttributes) CopyToTransaction(trans newrelic.Transaction) {
+	a.CopyToSpan(&newRelicSpan{txn: trans})
+}
+
+// Add the attributes to the span, see CopyToTransaction
+func (a *RequestAttributes) CopyToSpan(trans Span) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for _, k := range a.keys {
+		trans.AddAttribute(k, a.values[k])
+	}
+}
+
+// Get the logger with the attributes as the fields, the loggers are cached
+// until the next attribute is added
+func (a *RequestAttributes) decorate(logger *zap.Logger) *zap.Logger {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if len(a.keys) == 0 {
+		return logger
+	}
+	if res := a.loggers[logger]; res != nil {
+		return res
+	}
+
+	res := logger.With(a.fields()...)
+	a.loggers[logger] = res
+	return res
+}
@@ -0,0 +1,89 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func TestRedactionPolicy(t *testing.T) {
+	policy := &RedactionPolicy{
+		Keys:       map[string]RedactionAction{"user.email": RedactMask},
+		Substrings: DefaultRedactionPolicy.Substrings,
+	}
+
+	tests := []struct {
+		key   string
+		value interface{}
+		res   interface{}
+		kept  bool
+	}{
+		{"customer.id", 123, 123, true},
+		{"User.Email", "a@b.c", RedactedValue, true},
+		{"contact.email", "a@b.c", "sha256:d648b243a3e817ea", true},
+		{"DB_PASSWORD", "hunter2", nil, false},
+		{"api.token", "abc", nil, false},
+		// The strictest of the substrings wins
+		{"email.token", "abc", nil, false},
+	}
+	for _, tt := range tests {
+		res, kept := policy.Apply(tt.key, tt.value)
+		assert.Equal(t, tt.kept, kept, tt.key)
+		if tt.kept {
+			assert.Equal(t, tt.res, res, tt.key)
+		}
+	}
+}
+
+func TestRequestAttributes(t *testing.T) {
+	app := makeTestApp()
+	sink := &fakeSink{}
+	logSink, logger := utils.NewMemorySinkLogger()
+
+	err := RunInstrumented(context.Background(), "test1", app, sink, logger,
+		func(c context.Context) error {
+			CL(c).Info("Before")
+			AddRequestAttribute(c, "customer.id", "cust1")
+			AddRequestAttribute(c, "beta", true)
+			AddRequestAttribute(c, "session.token", "secret")
+			CL(c).Info("After")
+			assert.Panics(t, func() { AddRequestAttribute(c, "bad", []int{1}) })
+
+			met := GetMetricsFromContext(c)
+			met.AddCount("calls", 1)
+			_, dims := met.exportedMetric("calls", met.Metrics["calls"])
+			assert.Equal(t, Dimensions{"customer.id": "cust1", "beta": "true"}, dims)
+
+			// The nested calls share the attributes
+			return RunInstrumented(c, "nested", app, sink, logger,
+				func(c context.Context) error {
+					AddRequestAttribute(c, "project.id", 42)
+					CL(c).Info("Nested")
+					return nil
+				})
+		})
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(logSink.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.False(t, strings.Contains(lines[0], "cust1"))
+	assert.True(t, strings.Contains(lines[1], `"customer.id":"cust1","beta":true`))
+	assert.True(t, strings.Contains(lines[2], `"project.id":42`))
+	assert.False(t, strings.Contains(logSink.String(), "secret"))
+
+	evt := getEvt(getMetrics(app), 1)
+	assert.Equal(t, "cust1", evt["customer.id"])
+	assert.Equal(t, true, evt["beta"])
+	assert.Equal(t, 42.0, evt["project.id"])
+	assert.Nil(t, evt["session.token"])
+}
+
+func TestRequestAttributesWithoutBag(t *testing.T) {
+	ctx := ImbueContext(context.Background(), zap.NewNop())
+	assert.Nil(t, GetRequestAttributes(ctx))
+	assert.NotNil(t, CL(ctx))
+	assert.Panics(t, func() { AddRequestAttribute(ctx, "customer.id", "cust1") })
+}
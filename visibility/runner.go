@@ -9,8 +9,8 @@ import (
 	"runtime"
 )
 
-func getLogLinkingMetadata(trans newrelic.Transaction) []zap.Field {
-	md := trans.GetLinkingMetadata()
+func getLogLinkingMetadata(span Span) []zap.Field {
+	md := span.LinkingMetadata()
 
 	fields := []zap.Field{
 		zap.String(logcontext.KeyTraceID, md.TraceID),
@@ -19,33 +19,49 @@ func getLogLinkingMetadata(trans newrelic.Transaction) []zap.Field {
 		zap.String(logcontext.KeyEntityType, md.EntityType),
 		zap.String(logcontext.KeyEntityGUID, md.EntityGUID),
 		zap.String(logcontext.KeyHostname, md.Hostname),
+		// For the OpenTelemetry log correlation
+		zap.String(OtelTraceIDKey, md.TraceID),
+		zap.String(OtelSpanIDKey, md.SpanID),
 	}
 	return fields
 }
 
 // RunInstrumented() traces the provided synchronous function by
 // beginning and closing a new subsegment around its execution.
-// If the parent segment doesn't exist yet then a new top-level segment is created
+// If the parent segment doesn't exist yet then a new top-level segment is created.
+// The nested calls get the child metric scopes, see MakeChildMetricContext.
 func RunInstrumented(ctx context.Context, name string, app newrelic.Application,
 	sink MetricsSink, logger *zap.Logger, fn func(context.Context) error) error {
 
-	curTrans := newrelic.FromContext(ctx)
-	var newTrans newrelic.Transaction
-	if curTrans == nil {
-		newTrans = app.StartTransaction(name, nil, nil)
+	return RunInstrumentedWithTracer(ctx, name, tracerForApp(app), sink, logger, fn)
+}
+
+// The same as RunInstrumented, but the top-level segment is created using
+// the tracer (the NoopTracer if it's nil).
+func RunInstrumentedWithTracer(ctx context.Context, name string, tracer Tracer,
+	sink MetricsSink, logger *zap.Logger, fn func(context.Context) error) error {
+
+	curSpan := SpanFromContext(ctx)
+	var span Span
+	if curSpan == nil {
+		if tracer == nil {
+			tracer = NoopTracer
+		}
+		span = tracer.StartTransaction(name)
 	} else {
-		newTrans = curTrans.NewGoroutine()
+		// The nested call is a segment of the parent transaction, it must
+		// not rename or end it
+		span = curSpan.StartSegment(name)
 	}
-	_ = newTrans.SetName(name)
 
 	var err error
 	defer func() {
 		// (1) Close with the supplied error, either from the function
 		// return or from the panic handler below.
 		if err != nil {
-			_ = newTrans.NoticeError(err)
+			span.NoticeError(err)
 		}
-		_ = newTrans.End()
+		span.End()
 	}()
 
 	defer func() {
@@ -57,7 +73,7 @@ func RunInstrumented(ctx context.Context, name string, app newrelic.Application,
 			// Create an error with a nice stack trace
 			stack := make([]uintptr, 40)
 			n := runtime.Callers(3, stack)
-			err = newrelic.Error{
+			err = &PanicError{
 				Message: fmt.Sprintf("%v", p),
 				Class:   "gopanic",
 				Stack:   stack[:n],
@@ -66,14 +82,20 @@ func RunInstrumented(ctx context.Context, name string, app newrelic.Application,
 		}
 	}()
 
-	logger = logger.Named(name).With(getLogLinkingMetadata(newTrans)...)
-	c := newrelic.NewContext(ctx, newTrans) // Create context with tracing attached
-	c = ImbueContext(c, logger)             // Save logger into the context
-	c = MakeMetricContext(c, name)          // Save metrics into the context
+	logger = logger.Named(name).With(getLogLinkingMetadata(span)...)
+	c := ContextWithSpan(ctx, span)     // Create context with tracing attached
+	c = ImbueContext(c, logger)         // Save logger into the context
+	c = MakeRequestAttributesContext(c) // Share the attributes with the parent
+	if curSpan == nil {
+		GetRequestAttributes(c).CopyToSpan(span)
+	}
+	c = MakeChildMetricContext(c, name) // Save metrics into the context
 
 	met := GetMetricsFromContext(c)
+	met.KeepSketches = met.KeepSketches || wantsSketches(sink)
 	defer sink.SubmitSegmentMetrics(met)
-	defer met.CopyToTransaction(newTrans)
+	defer met.RollUpToParent()
+	defer met.CopyToSpan(span)
 
 	err = fn(c)
 
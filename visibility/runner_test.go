@@ -167,7 +167,8 @@ func TestSegmentWithMetrics(t *testing.T) {
 	assert.Equal(t, float64(1), evt["hellocount"])
 	assert.Equal(t, "Count", evt["hellocountUnit"])
 
-	assert.Equal(t, float64(12*1024*1024*1024), evt["gigametric"])
+	assert.Equal(t, float64(12e9), evt["gigametric"])
+	assert.Equal(t, float64(UnitNormalizationVersion), evt[UnitVersionAttribute])
 	assert.Equal(t, "Bits", evt["gigametricUnit"])
 	assert.Equal(t, "Gigabits", evt["gigametricOrigUnit"])
 }
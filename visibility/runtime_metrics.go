@@ -0,0 +1,178 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const RuntimeMetricsOpName = "Runtime"
+
+const DefaultRuntimeMetricsInterval = time.Minute
+
+// The clock ticks per second of the /proc CPU times, it's 100 on all the
+// mainstream Linux platforms
+const procClockTicks = 100
+
+// Samples the Go runtime and the process stats and submits them to the sink
+// under the RuntimeMetricsOpName op name. The GC and the cgo counts and the
+// CPU times are the deltas since the previous sample, the GC pause quantiles
+// are over the recent pauses. The levels like the goroutines and the open
+// files have no unit, so the sinks don't sum them up like the counts. The
+// process stats are read from /proc, and are skipped if it's not there.
+type RuntimeMetricsCollector struct {
+	// The registry's sink is used if it's nil
+	Sink     MetricsSink
+	Interval time.Duration
+	// The /proc directory of the process
+	ProcDir string
+
+	// The first sample has nothing to compare to, so it has no deltas. The
+	// CPU times are compared to the last successful read.
+	sampled     bool
+	lastNumGC   int64
+	lastCgo     int64
+	cpuSampled  bool
+	lastCpuUser float64
+	lastCpuSys  float64
+}
+
+// The DefaultRuntimeMetricsInterval is used if the interval is 0
+func NewRuntimeMetricsCollector(interval time.Duration) *RuntimeMetricsCollector {
+	if interval <= 0 {
+		interval = DefaultRuntimeMetricsInterval
+	}
+	return &RuntimeMetricsCollector{
+		Interval: interval,
+		ProcDir:  "/proc/self",
+	}
+}
+
+// Take the sample and submit it to the sink
+func (r *RuntimeMetricsCollector) Collect(ctx context.Context) error {
+	if r.Sink == nil {
+		return fmt.Errorf("the runtime metrics sink is not set")
+	}
+	met := &MetricsContext{
+		OpName:       RuntimeMetricsOpName,
+		Metrics:      map[string]*MetricEntry{},
+		KeepSketches: wantsSketches(r.Sink),
+	}
+	r.collectRuntime(met)
+	err := r.collectProcess(met)
+	r.Sink.SubmitSegmentMetrics(met)
+	return err
+}
+
+func (r *RuntimeMetricsCollector) collectRuntime(met *MetricsContext) {
+	met.SetMetric("Goroutines", float64(runtime.NumGoroutine()),
+		cloudwatch.StandardUnitNone)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	met.SetMetric("HeapInUse", float64(mem.HeapInuse), cloudwatch.StandardUnitBytes)
+	met.SetMetric("HeapObjects", float64(mem.HeapObjects), cloudwatch.StandardUnitNone)
+
+	stats := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(&stats)
+	if stats.NumGC != 0 {
+		for i, name := range []string{"GCPauseMin", "GCPauseP25", "GCPauseP50",
+			"GCPauseP75", "GCPauseMax"} {
+			met.SetMetric(name, float64(stats.PauseQuantiles[i].Microseconds()),
+				cloudwatch.StandardUnitMicroseconds)
+		}
+	}
+	cgo := runtime.NumCgoCall()
+	if r.sampled {
+		met.SetCount("GCCount", float64(stats.NumGC-r.lastNumGC))
+		met.SetCount("CgoCalls", float64(cgo-r.lastCgo))
+	}
+	r.lastNumGC, r.lastCgo = stats.NumGC, cgo
+	r.sampled = true
+}
+
+func (r *RuntimeMetricsCollector) collectProcess(met *MetricsContext) error {
+	if _, err := os.Stat(r.ProcDir); err != nil {
+		return nil
+	}
+
+	fds, err := ioutil.ReadDir(filepath.Join(r.ProcDir, "fd"))
+	if err != nil {
+		return err
+	}
+	met.SetMetric("OpenFDs", float64(len(fds)), cloudwatch.StandardUnitNone)
+
+	statm, err := ioutil.ReadFile(filepath.Join(r.ProcDir, "statm"))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return fmt.Errorf("malformed statm: %s", statm)
+	}
+	rssPages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	met.SetMetric("RSS", float64(rssPages*int64(os.Getpagesize())),
+		cloudwatch.StandardUnitBytes)
+
+	user, sys, err := r.readCpuTimes()
+	if err != nil {
+		return err
+	}
+	if r.cpuSampled {
+		met.SetMetric("CPUUser", user-r.lastCpuUser, cloudwatch.StandardUnitSeconds)
+		met.SetMetric("CPUSystem", sys-r.lastCpuSys, cloudwatch.StandardUnitSeconds)
+	}
+	r.lastCpuUser, r.lastCpuSys = user, sys
+	r.cpuSampled = true
+	return nil
+}
+
+// Read the user and the system CPU times in seconds from the stat file
+func (r *RuntimeMetricsCollector) readCpuTimes() (float64, float64, error) {
+	stat, err := ioutil.ReadFile(filepath.Join(r.ProcDir, "stat"))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name can have spaces, the fields start after it
+	nameEnd := strings.LastIndexByte(string(stat), ')')
+	if nameEnd < 0 {
+		return 0, 0, fmt.Errorf("malformed stat: %s", stat)
+	}
+	// The utime and the stime are the fields 14 and 15, the state is the 3rd
+	fields := strings.Fields(string(stat[nameEnd+1:]))
+	if len(fields) < 13 {
+		return 0, 0, fmt.Errorf("malformed stat: %s", stat)
+	}
+	user, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	sys, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return float64(user) / procClockTicks, float64(sys) / procClockTicks, nil
+}
+
+// Sample the stats periodically
+func (r *RuntimeMetricsCollector) Start(registry *ProcessRegistry) {
+	if r.Sink == nil {
+		r.Sink = registry.metrics
+	}
+	if r.Interval <= 0 {
+		r.Interval = DefaultRuntimeMetricsInterval
+	}
+	pc := registry.CreateProcessContext("RuntimeMetrics")
+	pc.RunPeriodicProcess(r.Interval, r.Collect)
+}
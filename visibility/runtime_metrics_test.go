@@ -0,0 +1,135 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func makeFakeProcDir(t *testing.T, utime, stime string) string {
+	dir, err := ioutil.TempDir("", "proc")
+	assert.NoError(t, err)
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "fd"), 0755))
+	for _, fd := range []string{"0", "1", "2"} {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "fd", fd), nil, 0644))
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "statm"),
+		[]byte("660 356 330 5 0 123 0\n"), 0644))
+	// The command name has spaces and parentheses
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stat"),
+		[]byte("42 (my (bad) cmd) R 1 42 42 0 -1 4194304 82 0 0 0 "+utime+" "+
+			stime+" 0 0 20 0 1 0 332404 2703360 283\n"), 0644))
+	return dir
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	sink := &fakeSink{}
+	collector := NewRuntimeMetricsCollector(time.Minute)
+	collector.Sink = sink
+	collector.ProcDir = makeFakeProcDir(t, "150", "50")
+	defer os.RemoveAll(collector.ProcDir)
+
+	assert.NoError(t, collector.Collect(context.Background()))
+	assert.True(t, sink.data["Goroutines"].Val >= 1)
+	assert.Equal(t, cloudwatch.StandardUnitBytes, sink.data["HeapInUse"].Unit)
+	assert.True(t, sink.data["HeapInUse"].Val > 0)
+	assert.Equal(t, 3.0, sink.data["OpenFDs"].Val)
+	assert.Equal(t, float64(356*os.Getpagesize()), sink.data["RSS"].Val)
+	// No deltas in the first sample
+	_, hasCpu := sink.data["CPUUser"]
+	assert.False(t, hasCpu)
+	_, hasGc := sink.data["GCCount"]
+	assert.False(t, hasGc)
+
+	runtime.GC()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(collector.ProcDir, "stat"),
+		[]byte("42 (cmd) R 1 42 42 0 -1 4194304 82 0 0 0 250 75 0 0 20 0 1\n"), 0644))
+	assert.NoError(t, collector.Collect(context.Background()))
+	assert.True(t, sink.data["GCCount"].Val >= 1)
+	assert.True(t, sink.data["GCPauseMax"].Val >= sink.data["GCPauseMin"].Val)
+	assert.Equal(t, cloudwatch.StandardUnitMicroseconds, sink.data["GCPauseP50"].Unit)
+	assert.InDelta(t, 1.0, sink.data["CPUUser"].Val, 1e-9)
+	assert.InDelta(t, 0.25, sink.data["CPUSystem"].Val, 1e-9)
+	assert.Equal(t, cloudwatch.StandardUnitSeconds, sink.data["CPUUser"].Unit)
+
+	// Malformed stat
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(collector.ProcDir, "stat"),
+		[]byte("42 (cmd) R 1"), 0644))
+	assert.Error(t, collector.Collect(context.Background()))
+
+	// No /proc, no process stats
+	sink.data = nil
+	collector.ProcDir = filepath.Join(collector.ProcDir, "nope")
+	assert.NoError(t, collector.Collect(context.Background()))
+	_, hasFds := sink.data["OpenFDs"]
+	assert.False(t, hasFds)
+}
+
+func TestRuntimeMetricsFailedRead(t *testing.T) {
+	sink := &fakeSink{}
+	collector := NewRuntimeMetricsCollector(0)
+	assert.Equal(t, DefaultRuntimeMetricsInterval, collector.Interval)
+	assert.Error(t, collector.Collect(context.Background()))
+
+	collector.Sink = sink
+	collector.ProcDir = makeFakeProcDir(t, "150", "50")
+	defer os.RemoveAll(collector.ProcDir)
+	statPath := filepath.Join(collector.ProcDir, "stat")
+	stat, err := ioutil.ReadFile(statPath)
+	assert.NoError(t, err)
+
+	// The failed read is not a baseline for the CPU times
+	assert.NoError(t, ioutil.WriteFile(statPath, []byte("42 (cmd) R 1"), 0644))
+	assert.Error(t, collector.Collect(context.Background()))
+	assert.NoError(t, ioutil.WriteFile(statPath, stat, 0644))
+	assert.NoError(t, collector.Collect(context.Background()))
+	_, hasCpu := sink.data["CPUUser"]
+	assert.False(t, hasCpu)
+	assert.NoError(t, collector.Collect(context.Background()))
+	assert.Equal(t, 0.0, sink.data["CPUUser"].Val)
+}
+
+func TestRuntimeMetricsAggregation(t *testing.T) {
+	fc := &fakeClient{}
+	sink := NewAggregatingSink(makeTestHarvester(fc), time.Minute)
+	collector := NewRuntimeMetricsCollector(time.Minute)
+	collector.Sink = sink
+	collector.ProcDir = makeFakeProcDir(t, "150", "50")
+	defer os.RemoveAll(collector.ProcDir)
+
+	assert.NoError(t, collector.Collect(context.Background()))
+	assert.NoError(t, collector.Collect(context.Background()))
+	assert.NoError(t, sink.Flush(context.Background()))
+
+	// The levels are summarized, not summed up
+	fds := findMetric(fc, "Runtime_OpenFDs", nil)
+	assert.Equal(t, "summary", fds["type"])
+	assert.Equal(t, map[string]interface{}{"count": 2.0, "sum": 6.0,
+		"min": 3.0, "max": 3.0}, fds["value"])
+	for _, name := range []string{"Runtime_Goroutines", "Runtime_HeapObjects"} {
+		met := findMetric(fc, name, nil)
+		assert.Equal(t, "summary", met["type"], name)
+		assert.Equal(t, 2.0, met["value"].(map[string]interface{})["count"], name)
+	}
+	// The deltas are counts
+	assert.Equal(t, "count", findMetric(fc, "Runtime_GCCount", nil)["type"])
+}
+
+func TestRuntimeMetricsProcess(t *testing.T) {
+	sink := &recordingSink{}
+	reg := NewProcessRegistry("", zap.NewNop(), makeTestApp(), sink)
+	collector := NewRuntimeMetricsCollector(time.Hour)
+	collector.Start(reg)
+	assert.True(t, reg.HasProcess("RuntimeMetrics"))
+	reg.Close()
+
+	// The first sample is taken right away, with the registry's sink
+	assert.Contains(t, sink.getOps(), RuntimeMetricsOpName)
+}
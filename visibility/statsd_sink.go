@@ -0,0 +1,203 @@
+package visibility
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type StatsdFormat int
+
+const (
+	// The plain StatsD has no tags, so the op name and the dimension values
+	// are a part of the metric name
+	StatsdPlain StatsdFormat = iota
+	// The DogStatsD with the op name and the dimensions as tags
+	DogStatsd
+)
+
+const (
+	// Fits into the Ethernet MTU with the IP and UDP headers
+	DefaultStatsdMtu           = 1432
+	DefaultStatsdQueueSize     = 10000
+	DefaultStatsdFlushInterval = 100 * time.Millisecond
+)
+
+// Sends the metrics over UDP to a local StatsD (or DogStatsD) agent. The
+// counts become the "c" metrics, the durations become the "ms" timers and
+// the rest become the "g" gauges. The lines are queued and packed into the
+// MTU-sized packets by the background process, the metrics are dropped
+// if the queue is full, so the requests are never blocked.
+type StatsdSink struct {
+	Prefix        string
+	Format        StatsdFormat
+	Mtu           int
+	FlushInterval time.Duration
+
+	conn    net.Conn
+	queue   chan string
+	dropped int64
+}
+
+func NewStatsdSink(addr string, prefix string, format StatsdFormat) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StatsdSink{
+		Prefix:        prefix,
+		Format:        format,
+		Mtu:           DefaultStatsdMtu,
+		FlushInterval: DefaultStatsdFlushInterval,
+		conn:          conn,
+		queue:         make(chan string, DefaultStatsdQueueSize),
+	}, nil
+}
+
+// The number of the metrics dropped because the queue was full
+func (s *StatsdSink) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+func isDurationUnit(unit cloudwatch.StandardUnit) bool {
+	return unit == cloudwatch.StandardUnitSeconds ||
+		unit == cloudwatch.StandardUnitMilliseconds ||
+		unit == cloudwatch.StandardUnitMicroseconds
+}
+
+// The multiplier to convert the duration to milliseconds
+func millisFactor(unit cloudwatch.StandardUnit) float64 {
+	switch unit {
+	case cloudwatch.StandardUnitSeconds:
+		return 1000
+	case cloudwatch.StandardUnitMicroseconds:
+		return 0.001
+	}
+	return 1
+}
+
+var statsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_",
+	"#", "_", ",", "_", "\n", "_", " ", "_")
+
+func (s *StatsdSink) SubmitSegmentMetrics(met *MetricsContext) {
+	met.Lock.Lock()
+	defer met.Lock.Unlock()
+
+	for key, val := range met.Metrics {
+		name, dims := met.exportedMetric(key, val)
+		s.enqueue(s.formatLine(met.OpName, name, dims, val))
+	}
+}
+
+func (s *StatsdSink) enqueue(line string) {
+	select {
+	case s.queue <- line:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+func (s *StatsdSink) formatLine(opName, name string, dims Dimensions,
+	val *MetricEntry) string {
+
+	var sb strings.Builder
+	if s.Prefix != "" {
+		sb.WriteString(statsdNameReplacer.Replace(s.Prefix) + ".")
+	}
+	if s.Format == StatsdPlain {
+		sb.WriteString(statsdNameReplacer.Replace(opName) + ".")
+	}
+	sb.WriteString(statsdNameReplacer.Replace(name))
+	if s.Format == StatsdPlain {
+		// No tags, the dimension values go to the name
+		for _, k := range dims.sortedKeys() {
+			sb.WriteString("." + statsdNameReplacer.Replace(dims[k]))
+		}
+	}
+	sb.WriteByte(':')
+
+	value, sampleRate := val.Val, 1.0
+	if val.Dist != nil && val.Dist.Count != 0 {
+		// The mean of the distribution stands for all of its observations
+		value, sampleRate = val.Dist.Mean(), 1/float64(val.Dist.Count)
+	}
+
+	switch {
+	case val.Unit == cloudwatch.StandardUnitCount && val.Dist == nil:
+		sb.WriteString(strconv.FormatFloat(value, 'f', -1, 64) + "|c")
+	case isDurationUnit(val.Unit):
+		sb.WriteString(strconv.FormatFloat(value*millisFactor(val.Unit), 'f', -1, 64) + "|ms")
+		if sampleRate != 1 {
+			sb.WriteString("|@" + strconv.FormatFloat(sampleRate, 'f', -1, 64))
+		}
+	default:
+		sb.WriteString(strconv.FormatFloat(value, 'f', -1, 64) + "|g")
+	}
+
+	if s.Format == DogStatsd {
+		sb.WriteString("|#op:" + statsdNameReplacer.Replace(opName))
+		for _, k := range dims.sortedKeys() {
+			sb.WriteString("," + statsdNameReplacer.Replace(k) + ":" +
+				statsdNameReplacer.Replace(dims[k]))
+		}
+	}
+	return sb.String()
+}
+
+// Append the line to the packet, sending the packet first if the line
+// doesn't fit into it
+func (s *StatsdSink) appendLine(packet []byte, line string) []byte {
+	if len(packet) != 0 && len(packet)+1+len(line) > s.Mtu {
+		packet = s.send(packet)
+	}
+	if len(packet) != 0 {
+		packet = append(packet, '\n')
+	}
+	return append(packet, line...)
+}
+
+func (s *StatsdSink) send(packet []byte) []byte {
+	if len(packet) != 0 {
+		// Nobody might be listening, the UDP errors are ignored
+		_, _ = s.conn.Write(packet)
+	}
+	return packet[:0]
+}
+
+func (s *StatsdSink) run(ctx context.Context) error {
+	ticker := time.NewTicker(s.FlushInterval)
+	defer ticker.Stop()
+
+	var packet []byte
+	for {
+		select {
+		case line := <-s.queue:
+			packet = s.appendLine(packet, line)
+		case <-ticker.C:
+			packet = s.send(packet)
+		case <-ctx.Done():
+			// Send the rest of the queue
+			for {
+				select {
+				case line := <-s.queue:
+					packet = s.appendLine(packet, line)
+				default:
+					s.send(packet)
+					return s.conn.Close()
+				}
+			}
+		}
+	}
+}
+
+// Start sending the metrics, the queue is flushed and the connection is
+// closed when the registry closes
+func (s *StatsdSink) Start(registry *ProcessRegistry) {
+	pc := registry.CreateProcessContext("StatsdSender")
+	pc.Run(s.run)
+}
@@ -0,0 +1,92 @@
+package visibility
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdFormat(t *testing.T) {
+	sink := &StatsdSink{Prefix: "svc", Format: DogStatsd}
+	count := &MetricEntry{Val: 2, Unit: cloudwatch.StandardUnitCount}
+	assert.Equal(t, "svc.Calls:2|c|#op:GetUser,table:us_ers",
+		sink.formatLine("GetUser", "Calls", Dimensions{"table": "us|ers"}, count))
+
+	duration := &MetricEntry{Val: 0.25, Unit: cloudwatch.StandardUnitSeconds}
+	assert.Equal(t, "svc.Time:250|ms|#op:GetUser",
+		sink.formatLine("GetUser", "Time", nil, duration))
+
+	gauge := &MetricEntry{Val: 1.5, Unit: cloudwatch.StandardUnitBytes}
+	assert.Equal(t, "svc.Size:1.5|g|#op:GetUser",
+		sink.formatLine("GetUser", "Size", nil, gauge))
+
+	dist := &MetricEntry{Unit: cloudwatch.StandardUnitMilliseconds,
+		Dist: NewDistribution(false)}
+	for _, v := range []float64{10, 20, 30, 40} {
+		dist.Dist.Observe(v)
+	}
+	assert.Equal(t, "svc.Call:25|ms|@0.25|#op:Op",
+		sink.formatLine("Op", "Call", nil, dist))
+
+	plain := &StatsdSink{Format: StatsdPlain}
+	assert.Equal(t, "GetUser.Calls.users:2|c",
+		plain.formatLine("GetUser", "Calls", Dimensions{"table": "users"}, count))
+}
+
+func TestStatsdSink(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	//noinspection GoUnhandledErrorResult
+	defer listener.Close()
+
+	sink, err := NewStatsdSink(listener.LocalAddr().String(), "", StatsdPlain)
+	assert.NoError(t, err)
+	sink.Mtu = 40
+
+	met := &MetricsContext{OpName: "Op", Metrics: map[string]*MetricEntry{}}
+	met.AddCount("first", 1)
+	met.AddCount("second", 2)
+	met.AddCount("third", 3)
+	met.SetMetric("a_very_long_metric_name_that_does_not_fit", 1,
+		cloudwatch.StandardUnitNone)
+	// Not started yet, but the submission doesn't block
+	sink.SubmitSegmentMetrics(met)
+
+	reg := NewProcessRegistry("", zap.NewNop(), makeTestApp(), NullSink)
+	sink.Start(reg)
+
+	var lines []string
+	buf := make([]byte, 1500)
+	for len(lines) < 4 {
+		assert.NoError(t, listener.SetReadDeadline(time.Now().Add(5*time.Second)))
+		n, _, err := listener.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			break
+		}
+		packet := string(buf[:n])
+		assert.True(t, n <= sink.Mtu || !strings.Contains(packet, "\n"), packet)
+		lines = append(lines, strings.Split(packet, "\n")...)
+	}
+	reg.Close()
+
+	sort.Strings(lines)
+	assert.Equal(t, []string{"Op.a_very_long_metric_name_that_does_not_fit:1|g",
+		"Op.first:1|c", "Op.second:2|c", "Op.third:3|c"}, lines)
+}
+
+func TestStatsdSinkDoesNotBlock(t *testing.T) {
+	sink, err := NewStatsdSink("127.0.0.1:9", "", DogStatsd)
+	assert.NoError(t, err)
+	sink.queue = make(chan string, 1)
+
+	met := &MetricsContext{OpName: "Op", Metrics: map[string]*MetricEntry{}}
+	met.AddCount("first", 1)
+	met.AddCount("second", 1)
+	sink.SubmitSegmentMetrics(met)
+	assert.Equal(t, int64(1), sink.Dropped())
+}
@@ -0,0 +1,154 @@
+package visibility
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// The W3C Trace Context headers
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// The log correlation fields, named as in the OpenTelemetry log data model
+const (
+	OtelTraceIDKey = "trace_id"
+	OtelSpanIDKey  = "span_id"
+)
+
+// The W3C Trace Context of a span, see https://www.w3.org/TR/trace-context/
+type TraceContext struct {
+	// 32 and 16 lowercase hex digits
+	TraceID string
+	SpanID  string
+	Sampled bool
+	// The vendor-specific tracestate, passed through as is
+	State string
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isValidTraceID(id string, length int) bool {
+	return len(id) == length && isLowerHex(id) && strings.Trim(id, "0") != ""
+}
+
+// Parse the traceparent header, false if it's invalid. The future versions
+// are parsed as the version 00, as the spec requires.
+func ParseTraceParent(header string) (TraceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return TraceContext{}, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || !isLowerHex(version) || version == "ff" ||
+		(version == "00" && len(parts) != 4) {
+		return TraceContext{}, false
+	}
+	if !isValidTraceID(traceID, 32) || !isValidTraceID(spanID, 16) ||
+		len(flags) != 2 || !isLowerHex(flags) {
+		return TraceContext{}, false
+	}
+
+	flagBits, _ := hex.DecodeString(flags)
+	return TraceContext{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Sampled: flagBits[0]&1 == 1,
+	}, true
+}
+
+// Get the trace context from the traceparent and the tracestate headers,
+// false if there's none or it's invalid
+func ExtractTraceContext(headers http.Header) (TraceContext, bool) {
+	tc, ok := ParseTraceParent(headers.Get(TraceParentHeader))
+	if !ok {
+		return TraceContext{}, false
+	}
+	// The multiple tracestate headers are combined
+	tc.State = strings.Join(headers[http.CanonicalHeaderKey(TraceStateHeader)], ",")
+	return tc, true
+}
+
+func (t TraceContext) TraceFlags() string {
+	if t.Sampled {
+		return "01"
+	}
+	return "00"
+}
+
+func (t TraceContext) TraceParent() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.TraceFlags()
+}
+
+// Set the traceparent and the tracestate headers
+func (t TraceContext) Inject(headers http.Header) {
+	headers.Set(TraceParentHeader, t.TraceParent())
+	if t.State != "" {
+		headers.Set(TraceStateHeader, t.State)
+	} else {
+		headers.Del(TraceStateHeader)
+	}
+}
+
+func randomHexID(bytes int) string {
+	buf := make([]byte, bytes)
+	for {
+		_, err := rand.Read(buf)
+		if err != nil {
+			panic(err.Error())
+		}
+		// The all-zero IDs are invalid
+		id := hex.EncodeToString(buf)
+		if strings.Trim(id, "0") != "" {
+			return id
+		}
+	}
+}
+
+func NewTraceID() string {
+	return randomHexID(16)
+}
+
+func NewSpanID() string {
+	return randomHexID(8)
+}
+
+// Adds the distributed tracing headers of the span from the request
+// context to the outgoing requests, see Span.DistributedTraceHeaders
+type TracingTransport struct {
+	// The http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+func NewTracingTransport(base http.RoundTripper) *TracingTransport {
+	return &TracingTransport{Base: base}
+}
+
+func (t *TracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	span := SpanFromContext(req.Context())
+	if span == nil {
+		return base.RoundTrip(req)
+	}
+
+	// The RoundTripper must not modify the original request
+	req = req.Clone(req.Context())
+	for k, v := range span.DistributedTraceHeaders() {
+		req.Header[k] = v
+	}
+	return base.RoundTrip(req)
+}
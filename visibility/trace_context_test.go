@@ -0,0 +1,99 @@
+package visibility
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	tc, ok := ParseTraceParent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext{TraceID: "0af7651916cd43dd8448eb211c80319c",
+		SpanID: "b7ad6b7169203331", Sampled: true}, tc)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		tc.TraceParent())
+
+	tc, ok = ParseTraceParent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	assert.True(t, ok)
+	assert.False(t, tc.Sampled)
+
+	// The future versions can have more fields
+	_, ok = ParseTraceParent("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-more")
+	assert.True(t, ok)
+
+	for _, invalid := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-more",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1",
+	} {
+		_, ok = ParseTraceParent(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestExtractAndInjectTraceContext(t *testing.T) {
+	headers := http.Header{}
+	_, ok := ExtractTraceContext(headers)
+	assert.False(t, ok)
+
+	headers.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	headers.Add(TraceStateHeader, "congo=t61rcWkgMzE")
+	headers.Add(TraceStateHeader, "rojo=00f067aa0ba902b7")
+	tc, ok := ExtractTraceContext(headers)
+	assert.True(t, ok)
+	assert.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", tc.State)
+
+	out := http.Header{}
+	tc.SpanID = "00f067aa0ba902b7"
+	tc.Inject(out)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-00f067aa0ba902b7-01",
+		out.Get(TraceParentHeader))
+	assert.Equal(t, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7", out.Get(TraceStateHeader))
+
+	// The stale tracestate is removed
+	tc.State = ""
+	tc.Inject(out)
+	assert.Empty(t, out.Get(TraceStateHeader))
+}
+
+func TestNewTraceIDs(t *testing.T) {
+	assert.True(t, isValidTraceID(NewTraceID(), 32))
+	assert.True(t, isValidTraceID(NewSpanID(), 16))
+	assert.NotEqual(t, NewSpanID(), NewSpanID())
+}
+
+func TestTracingTransport(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewTracingTransport(nil)}
+
+	// Nothing to propagate without a span
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Empty(t, received.Get(TraceParentHeader))
+
+	span := NewRecordingTracer().StartTransaction("Op")
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req = req.WithContext(ContextWithSpan(context.Background(), span))
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+
+	md := span.LinkingMetadata()
+	assert.Equal(t, "00-"+md.TraceID+"-"+md.SpanID+"-01", received.Get(TraceParentHeader))
+	// The original request is not modified
+	assert.Empty(t, req.Header.Get(TraceParentHeader))
+}
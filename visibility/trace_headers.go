@@ -0,0 +1,229 @@
+package visibility
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The trace header formats that the middleware accepts and emits
+type TraceHeaderFormat int
+
+const (
+	// The W3C traceparent and tracestate
+	TraceHeaderW3C TraceHeaderFormat = 1 << iota
+	// The B3 single header: b3: {TraceId}-{SpanId}-{Sampled}-{ParentSpanId}
+	TraceHeaderB3Single
+	// The X-B3-TraceId, X-B3-SpanId and X-B3-Sampled headers
+	TraceHeaderB3Multi
+	// The AWS X-Ray header, used by the API Gateway and the ALB:
+	// X-Amzn-Trace-Id: Root=1-{time}-{id};Parent={SpanId};Sampled=1
+	TraceHeaderXRay
+
+	AllTraceHeaderFormats = TraceHeaderW3C | TraceHeaderB3Single |
+		TraceHeaderB3Multi | TraceHeaderXRay
+)
+
+const (
+	B3SingleHeader       = "b3"
+	B3TraceIDHeader      = "X-B3-TraceId"
+	B3SpanIDHeader       = "X-B3-SpanId"
+	B3ParentSpanIDHeader = "X-B3-ParentSpanId"
+	B3SampledHeader      = "X-B3-Sampled"
+	B3FlagsHeader        = "X-B3-Flags"
+	XRayTraceHeader      = "X-Amzn-Trace-Id"
+)
+
+// The formats in the order they are tried by ExtractTraceHeaders
+var traceHeaderFormats = []TraceHeaderFormat{TraceHeaderW3C, TraceHeaderB3Single,
+	TraceHeaderB3Multi, TraceHeaderXRay}
+
+func (f TraceHeaderFormat) String() string {
+	switch f {
+	case TraceHeaderW3C:
+		return "w3c"
+	case TraceHeaderB3Single:
+		return "b3"
+	case TraceHeaderB3Multi:
+		return "b3multi"
+	case TraceHeaderXRay:
+		return "xray"
+	}
+	return "unknown"
+}
+
+// Get the trace context from the first of the formats found in the
+// headers, in the order: W3C, B3 single, B3 multi, X-Ray. The SpanID of the
+// result is the ID of the upstream span, it's empty if the X-Ray header
+// has no parent (the ALB and the API Gateway don't set it).
+func ExtractTraceHeaders(headers http.Header, formats TraceHeaderFormat) (
+	TraceContext, TraceHeaderFormat, bool) {
+
+	for _, f := range traceHeaderFormats {
+		if formats&f == 0 {
+			continue
+		}
+
+		var tc TraceContext
+		var ok bool
+		switch f {
+		case TraceHeaderW3C:
+			tc, ok = ExtractTraceContext(headers)
+		case TraceHeaderB3Single:
+			tc, ok = parseB3Single(headers.Get(B3SingleHeader))
+		case TraceHeaderB3Multi:
+			tc, ok = parseB3Multi(headers)
+		case TraceHeaderXRay:
+			tc, ok = parseXRay(headers.Get(XRayTraceHeader))
+		}
+		if ok {
+			return tc, f, true
+		}
+	}
+	return TraceContext{}, 0, false
+}
+
+// Set the headers of the formats, the B3 and the X-Ray headers can't pass
+// the tracestate
+func InjectTraceHeaders(headers http.Header, tc TraceContext, formats TraceHeaderFormat) {
+	sampled := "0"
+	if tc.Sampled {
+		sampled = "1"
+	}
+
+	if formats&TraceHeaderW3C != 0 {
+		tc.Inject(headers)
+	}
+	if formats&TraceHeaderB3Single != 0 {
+		headers.Set(B3SingleHeader, tc.TraceID+"-"+tc.SpanID+"-"+sampled)
+	}
+	if formats&TraceHeaderB3Multi != 0 {
+		headers.Set(B3TraceIDHeader, tc.TraceID)
+		headers.Set(B3SpanIDHeader, tc.SpanID)
+		headers.Set(B3SampledHeader, sampled)
+	}
+	if formats&TraceHeaderXRay != 0 {
+		headers.Set(XRayTraceHeader, "Root=1-"+tc.TraceID[:8]+"-"+tc.TraceID[8:]+
+			";Parent="+tc.SpanID+";Sampled="+sampled)
+	}
+}
+
+// The 64-bit trace IDs are left-padded to 128 bits
+func padTraceID(id string) string {
+	if len(id) == 16 {
+		return "0000000000000000" + id
+	}
+	return id
+}
+
+// The B3 sampling state: "1", "0" or "d" for the debug. The missing state
+// defers the decision to us, so it's sampled.
+func isB3Sampled(state string) (bool, bool) {
+	switch state {
+	case "", "1", "d", "true":
+		return true, true
+	case "0", "false":
+		return false, true
+	}
+	return false, false
+}
+
+func parseB3Single(header string) (TraceContext, bool) {
+	// The header with only the sampling state has no trace
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 2 || len(parts) > 4 {
+		return TraceContext{}, false
+	}
+
+	tc := TraceContext{TraceID: padTraceID(parts[0]), SpanID: parts[1], Sampled: true}
+	if len(parts) > 2 {
+		var ok bool
+		if tc.Sampled, ok = isB3Sampled(parts[2]); !ok {
+			return TraceContext{}, false
+		}
+	}
+	if !isValidTraceID(tc.TraceID, 32) || !isValidTraceID(tc.SpanID, 16) {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+func parseB3Multi(headers http.Header) (TraceContext, bool) {
+	tc := TraceContext{
+		TraceID: padTraceID(strings.TrimSpace(headers.Get(B3TraceIDHeader))),
+		SpanID:  strings.TrimSpace(headers.Get(B3SpanIDHeader)),
+	}
+	if !isValidTraceID(tc.TraceID, 32) || !isValidTraceID(tc.SpanID, 16) {
+		return TraceContext{}, false
+	}
+
+	var ok bool
+	if tc.Sampled, ok = isB3Sampled(strings.TrimSpace(headers.Get(B3SampledHeader))); !ok {
+		return TraceContext{}, false
+	}
+	// The debug flag implies the sampling
+	if headers.Get(B3FlagsHeader) == "1" {
+		tc.Sampled = true
+	}
+	return tc, true
+}
+
+// The X-Ray trace ID is 1-{8 hex digits of the time}-{24 hex digits}, which
+// together make the 128-bit W3C trace ID
+func parseXRay(header string) (TraceContext, bool) {
+	tc := TraceContext{Sampled: true}
+	for _, part := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Root":
+			root := strings.Split(kv[1], "-")
+			if len(root) != 3 || root[0] != "1" || len(root[1]) != 8 {
+				return TraceContext{}, false
+			}
+			tc.TraceID = root[1] + root[2]
+		case "Parent":
+			tc.SpanID = kv[1]
+		case "Sampled":
+			// "?" asks us to decide
+			tc.Sampled = kv[1] != "0"
+		}
+	}
+
+	if !isValidTraceID(tc.TraceID, 32) ||
+		(tc.SpanID != "" && !isValidTraceID(tc.SpanID, 16)) {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+// Continue the trace of the span from the trace context, the spans that
+// only understand the headers need the parent span ID
+func acceptTraceContext(span Span, tc TraceContext) {
+	if accepter, ok := span.(traceContextAccepter); ok {
+		accepter.acceptTraceContext(tc)
+		return
+	}
+	if tc.SpanID != "" {
+		headers := http.Header{}
+		tc.Inject(headers)
+		span.AcceptDistributedTraceHeaders(headers)
+	}
+}
+
+// Get the trace context of the span from its W3C headers, or from its
+// linking metadata for the tracers that don't emit them (New Relic). False
+// if the span has no valid trace.
+func spanTraceContext(span Span) (TraceContext, bool) {
+	if tc, ok := ExtractTraceContext(span.DistributedTraceHeaders()); ok {
+		return tc, true
+	}
+
+	md := span.LinkingMetadata()
+	tc := TraceContext{TraceID: padTraceID(md.TraceID), SpanID: md.SpanID, Sampled: true}
+	if !isValidTraceID(tc.TraceID, 32) || !isValidTraceID(tc.SpanID, 16) {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
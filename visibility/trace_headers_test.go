@@ -0,0 +1,221 @@
+package visibility
+
+import (
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtractTraceHeaders(t *testing.T) {
+	check := func(headers map[string]string, formats TraceHeaderFormat,
+		expected TraceContext, expectedFormat TraceHeaderFormat) {
+
+		h := http.Header{}
+		for k, v := range headers {
+			h.Set(k, v)
+		}
+		tc, format, ok := ExtractTraceHeaders(h, formats)
+		assert.Equal(t, expectedFormat != 0, ok, headers)
+		assert.Equal(t, expected, tc, headers)
+		assert.Equal(t, expectedFormat, format, headers)
+	}
+	traceID, spanID := "80f198ee56343ba864fe8b2a57d3eff7", "e457b5a2e4d86bd1"
+
+	check(map[string]string{}, AllTraceHeaderFormats, TraceContext{}, 0)
+	check(map[string]string{B3SingleHeader: traceID + "-" + spanID + "-1-05e3ac9a4f6e3b90"},
+		AllTraceHeaderFormats,
+		TraceContext{TraceID: traceID, SpanID: spanID, Sampled: true}, TraceHeaderB3Single)
+	// The 64-bit trace IDs are padded
+	check(map[string]string{B3SingleHeader: "64fe8b2a57d3eff7-" + spanID + "-0"},
+		AllTraceHeaderFormats,
+		TraceContext{TraceID: "000000000000000064fe8b2a57d3eff7", SpanID: spanID},
+		TraceHeaderB3Single)
+	// Only the sampling decision
+	check(map[string]string{B3SingleHeader: "0"}, AllTraceHeaderFormats, TraceContext{}, 0)
+	check(map[string]string{B3SingleHeader: traceID + "-" + spanID + "-x"},
+		AllTraceHeaderFormats, TraceContext{}, 0)
+
+	check(map[string]string{B3TraceIDHeader: traceID, B3SpanIDHeader: spanID},
+		AllTraceHeaderFormats,
+		TraceContext{TraceID: traceID, SpanID: spanID, Sampled: true}, TraceHeaderB3Multi)
+	check(map[string]string{B3TraceIDHeader: traceID, B3SpanIDHeader: spanID,
+		B3SampledHeader: "0", B3FlagsHeader: "1"}, AllTraceHeaderFormats,
+		TraceContext{TraceID: traceID, SpanID: spanID, Sampled: true}, TraceHeaderB3Multi)
+	check(map[string]string{B3TraceIDHeader: traceID}, AllTraceHeaderFormats,
+		TraceContext{}, 0)
+
+	check(map[string]string{XRayTraceHeader: "Root=1-5759e988-bd862e3fe1be46a994272793;" +
+		"Parent=53995c3f42cd8ad8;Sampled=0"}, AllTraceHeaderFormats,
+		TraceContext{TraceID: "5759e988bd862e3fe1be46a994272793", SpanID: "53995c3f42cd8ad8"},
+		TraceHeaderXRay)
+	// The ALB sets only the root
+	check(map[string]string{XRayTraceHeader: "Self=1-67891234-12456789abcdef012345678;" +
+		"Root=1-67891233-abcdef012345678912345678"}, AllTraceHeaderFormats,
+		TraceContext{TraceID: "67891233abcdef012345678912345678", Sampled: true},
+		TraceHeaderXRay)
+	check(map[string]string{XRayTraceHeader: "Root=2-67891233-abcdef012345678912345678"},
+		AllTraceHeaderFormats, TraceContext{}, 0)
+
+	// The W3C has the priority, the disabled formats are ignored
+	both := map[string]string{
+		TraceParentHeader: "00-" + traceID + "-" + spanID + "-01",
+		B3SingleHeader:    "64fe8b2a57d3eff7-" + spanID,
+	}
+	check(both, AllTraceHeaderFormats,
+		TraceContext{TraceID: traceID, SpanID: spanID, Sampled: true}, TraceHeaderW3C)
+	check(both, TraceHeaderB3Single|TraceHeaderXRay,
+		TraceContext{TraceID: "000000000000000064fe8b2a57d3eff7", SpanID: spanID,
+			Sampled: true}, TraceHeaderB3Single)
+	check(both, TraceHeaderXRay, TraceContext{}, 0)
+}
+
+func TestInjectTraceHeaders(t *testing.T) {
+	tc := TraceContext{TraceID: "5759e988bd862e3fe1be46a994272793",
+		SpanID: "53995c3f42cd8ad8", Sampled: true, State: "congo=t61rcWkgMzE"}
+
+	h := http.Header{}
+	InjectTraceHeaders(h, tc, AllTraceHeaderFormats)
+	assert.Equal(t, "00-5759e988bd862e3fe1be46a994272793-53995c3f42cd8ad8-01",
+		h.Get(TraceParentHeader))
+	assert.Equal(t, "congo=t61rcWkgMzE", h.Get(TraceStateHeader))
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793-53995c3f42cd8ad8-1",
+		h.Get(B3SingleHeader))
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793", h.Get(B3TraceIDHeader))
+	assert.Equal(t, "53995c3f42cd8ad8", h.Get(B3SpanIDHeader))
+	assert.Equal(t, "1", h.Get(B3SampledHeader))
+	assert.Equal(t, "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;"+
+		"Sampled=1", h.Get(XRayTraceHeader))
+
+	// Each format is parsed back into the same trace
+	for _, f := range traceHeaderFormats {
+		parsed, format, ok := ExtractTraceHeaders(h, f)
+		assert.True(t, ok)
+		assert.Equal(t, f, format)
+		assert.Equal(t, tc.TraceID, parsed.TraceID)
+		assert.Equal(t, tc.SpanID, parsed.SpanID)
+	}
+
+	h = http.Header{}
+	tc.Sampled = false
+	InjectTraceHeaders(h, tc, TraceHeaderB3Single)
+	assert.Equal(t, 1, len(h))
+	assert.Equal(t, "5759e988bd862e3fe1be46a994272793-53995c3f42cd8ad8-0",
+		h.Get(B3SingleHeader))
+}
+
+func TestMiddlewareTraceHeaders(t *testing.T) {
+	tracer := NewRecordingTracer()
+	makeServer := func(formats TraceHeaderFormat) *echo.Echo {
+		e := echo.New()
+		e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+			Logger:             zap.NewNop(),
+			Tracer:             tracer,
+			TraceHeaderFormats: formats,
+		}))
+		e.GET("/test", func(c echo.Context) error {
+			return c.String(http.StatusOK, "ok")
+		})
+		return e
+	}
+	serve := func(e *echo.Echo, headers map[string]string) (RecordedSpan, http.Header) {
+		tracer.Reset()
+		req := httptest.NewRequest("GET", "/test", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		span, _ := tracer.FindSpan("/test")
+		return span, rec.Header()
+	}
+	e := makeServer(0)
+
+	// The B3 trace from envoy is continued and emitted in all the formats
+	span, resp := serve(e, map[string]string{
+		B3SingleHeader: "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"})
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7", span.TraceID)
+	assert.Equal(t, "e457b5a2e4d86bd1", span.ParentID)
+	assert.Equal(t, "b3", span.Attributes["InboundTraceFormat"])
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7", span.Attributes["InboundTraceId"])
+	assert.Equal(t, "e457b5a2e4d86bd1", span.Attributes["InboundParentId"])
+	assert.Equal(t, "00-80f198ee56343ba864fe8b2a57d3eff7-"+span.SpanID+"-01",
+		resp.Get(TraceParentHeader))
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7-"+span.SpanID+"-1",
+		resp.Get(B3SingleHeader))
+	assert.Equal(t, span.SpanID, resp.Get(B3SpanIDHeader))
+	assert.Equal(t, "Root=1-80f198ee-56343ba864fe8b2a57d3eff7;Parent="+span.SpanID+
+		";Sampled=1", resp.Get(XRayTraceHeader))
+
+	// The ALB trace has no parent, it's still continued
+	span, _ = serve(e, map[string]string{
+		XRayTraceHeader: "Root=1-67891233-abcdef012345678912345678"})
+	assert.Equal(t, "67891233abcdef012345678912345678", span.TraceID)
+	assert.Empty(t, span.ParentID)
+	assert.Equal(t, "Root=1-67891233-abcdef012345678912345678", span.Attributes["AmznTraceId"])
+	assert.Nil(t, span.Attributes["InboundParentId"])
+
+	// The tracestate is passed back
+	_, resp = serve(e, map[string]string{
+		TraceParentHeader: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		TraceStateHeader:  "congo=t61rcWkgMzE",
+	})
+	assert.Equal(t, "congo=t61rcWkgMzE", resp.Get(TraceStateHeader))
+
+	// A new trace without the inbound headers
+	span, resp = serve(e, nil)
+	assert.Empty(t, span.ParentID)
+	assert.Nil(t, span.Attributes["InboundTraceId"])
+	assert.Equal(t, "00-"+span.TraceID+"-"+span.SpanID+"-01", resp.Get(TraceParentHeader))
+	assert.Empty(t, resp.Get(TraceStateHeader))
+
+	// Only the enabled formats are accepted and emitted
+	e = makeServer(TraceHeaderW3C)
+	span, resp = serve(e, map[string]string{
+		B3SingleHeader: "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"})
+	assert.NotEqual(t, "80f198ee56343ba864fe8b2a57d3eff7", span.TraceID)
+	assert.NotEmpty(t, resp.Get(TraceParentHeader))
+	assert.Empty(t, resp.Get(B3SingleHeader))
+	assert.Empty(t, resp.Get(XRayTraceHeader))
+
+	// New Relic can't continue the foreign traces
+	e = echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Logger: zap.NewNop(),
+		Tracer: NewNewRelicTracer(makeTestApp()),
+	}))
+	var md LinkingMetadata
+	e.GET("/test", func(c echo.Context) error {
+		md = SpanFromContext(c.Request().Context()).LinkingMetadata()
+		return c.String(http.StatusOK, "ok")
+	})
+	serveNr := func(headers map[string]string) http.Header {
+		req := httptest.NewRequest("GET", "/test", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Header()
+	}
+
+	// The foreign trace isn't continued, so no trace headers are emitted,
+	// the inbound IDs are only linked as the attributes
+	resp = serveNr(map[string]string{
+		TraceParentHeader: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		TraceStateHeader:  "congo=t61rcWkgMzE",
+	})
+	assert.NotEmpty(t, md.SpanID)
+	assert.NotEqual(t, "0af7651916cd43dd8448eb211c80319c", padTraceID(md.TraceID))
+	for _, h := range []string{TraceParentHeader, TraceStateHeader, B3SingleHeader,
+		B3TraceIDHeader, XRayTraceHeader} {
+		assert.Empty(t, resp.Get(h), h)
+	}
+
+	// Without the inbound trace, New Relic's own trace is emitted
+	resp = serveNr(nil)
+	assert.Equal(t, "00-"+padTraceID(md.TraceID)+"-"+md.SpanID+"-01",
+		resp.Get(TraceParentHeader))
+}
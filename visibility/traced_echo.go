@@ -20,8 +20,17 @@ import (
 )
 
 type TracingAndMetricsOptions struct {
-	DebugMode  bool
-	NrApp      newrelic.Application
+	DebugMode bool
+	// The tracing backend, the NewRelicTracer for the NrApp is used if it's
+	// nil, or the NoopTracer if there's no NrApp either
+	Tracer Tracer
+	NrApp  newrelic.Application
+	// The accepted and the emitted trace headers, AllTraceHeaderFormats if
+	// it's zero. The NewRelicTracer can't continue the inbound traces, its
+	// span only has the inbound IDs as the InboundTraceId and the
+	// InboundParentId attributes, and no headers of these formats are
+	// emitted for such requests.
+	TraceHeaderFormats TraceHeaderFormat
 
 	HostNameOverride string
 
@@ -47,53 +56,114 @@ func (t *TracingAndMetricsOptions) Validate() {
 	PanicIfF(t.Logger == nil, "logger was not set")
 }
 
+func (t *TracingAndMetricsOptions) getTracer() Tracer {
+	if t.Tracer != nil {
+		return t.Tracer
+	}
+	return tracerForApp(t.NrApp)
+}
+
+func (t *TracingAndMetricsOptions) getTraceHeaderFormats() TraceHeaderFormat {
+	if t.TraceHeaderFormats == 0 {
+		return AllTraceHeaderFormats
+	}
+	return t.TraceHeaderFormats
+}
+
 type traceAndLogMiddleware struct {
-	next echo.HandlerFunc
-	opts TracingAndMetricsOptions
+	next    echo.HandlerFunc
+	opts    TracingAndMetricsOptions
+	tracer  Tracer
+	formats TraceHeaderFormat
 }
 
 // Store the original RequestIDs in annotations
-func (z *traceAndLogMiddleware) moveRegularRequestIdToAnnotations(trans newrelic.Transaction,
+func (z *traceAndLogMiddleware) moveRegularRequestIdToAnnotations(trans Span,
 	r *http.Request) {
 
 	reqIdHeader := r.Header.Get(echo.HeaderXRequestID)
 	if reqIdHeader != "" {
-		_ = trans.AddAttribute("RequestId", reqIdHeader)
+		trans.AddAttribute("RequestId", reqIdHeader)
 	}
 
 	reqIdHeader = r.Header.Get("x-amzn-trace-id")
 	if reqIdHeader != "" {
-		_ = trans.AddAttribute("AmznTraceId", reqIdHeader)
+		trans.AddAttribute("AmznTraceId", reqIdHeader)
+	}
+}
+
+// Continue the trace from the inbound trace headers. The upstream trace and
+// span IDs are kept in the annotations as well, for the tracers that can't
+// continue the foreign traces (New Relic).
+func (z *traceAndLogMiddleware) linkInboundTrace(trans Span,
+	r *http.Request) TraceContext {
+
+	tc, format, ok := ExtractTraceHeaders(r.Header, z.formats)
+	if !ok {
+		return TraceContext{}
+	}
+	acceptTraceContext(trans, tc)
+
+	trans.AddAttribute("InboundTraceFormat", format.String())
+	trans.AddAttribute("InboundTraceId", tc.TraceID)
+	if tc.SpanID != "" {
+		trans.AddAttribute("InboundParentId", tc.SpanID)
+	}
+	return tc
+}
+
+// Add the trace headers of all the formats to the response, the tracestate
+// is passed back if the trace is continued. If the tracer couldn't continue
+// the inbound trace (New Relic), nothing is emitted: the local span is not
+// a part of the caller's trace. The W3C spec has no response header for the
+// traceparent (the draft traceresponse has the same format), the headers
+// are meant for the callers that log them.
+func (z *traceAndLogMiddleware) emitTraceHeaders(c echo.Context, trans Span,
+	inbound TraceContext) {
+
+	tc, ok := spanTraceContext(trans)
+	if !ok {
+		return
+	}
+	if inbound.TraceID != "" && tc.TraceID != inbound.TraceID {
+		return
+	}
+	if tc.State == "" {
+		tc.State = inbound.State
 	}
+	InjectTraceHeaders(c.Response().Header(), tc, z.formats)
 }
 
-func (z *traceAndLogMiddleware) attachXrayTrace(c echo.Context) newrelic.Transaction {
+func (z *traceAndLogMiddleware) attachXrayTrace(c echo.Context) Span {
 	r := c.Request()
 
-	trans := z.opts.NrApp.StartTransaction(transactionName(c),
+	trans, writer := z.tracer.StartWebTransaction(transactionName(c),
 		c.Response().Writer, c.Request())
 	z.moveRegularRequestIdToAnnotations(trans, r)
+	inbound := z.linkInboundTrace(trans, r)
 
-	c.Response().Writer = trans
+	c.Response().Writer = writer
 
-	// Add txn to c.Request().Context()
-	ctx := newrelic.NewContext(c.Request().Context(), trans)
+	// Add txn to c.Request().Context(), along with the request attributes
+	ctx := ContextWithSpan(c.Request().Context(), trans)
+	ctx = MakeRequestAttributesContext(ctx)
 	c.SetRequest(c.Request().WithContext(ctx))
 
 	// Synthesize the X-Request-ID header for anyone else in middleware
 	// while storing the regular one in annotations
-	c.Request().Header.Set(echo.HeaderXRequestID, trans.GetTraceMetadata().TraceID)
+	c.Request().Header.Set(echo.HeaderXRequestID, trans.LinkingMetadata().TraceID)
 
 	// Add the tracing payload to the response headers
-	if p := trans.CreateDistributedTracePayload().HTTPSafe(); "" != p {
-		c.Response().Header().Add(newrelic.DistributedTracePayloadHeader, p)
+	for k, v := range trans.DistributedTraceHeaders() {
+		c.Response().Header()[k] = append(c.Response().Header()[k], v...)
 	}
+	z.emitTraceHeaders(c, trans, inbound)
 
 	return trans
 }
 
 func (z *traceAndLogMiddleware) createLogger(c echo.Context,
-	trans newrelic.Transaction) *zap.Logger {
+	trans Span) *zap.Logger {
 
 	fields := getLogLinkingMetadata(trans)
 
@@ -165,7 +235,7 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 
 	// Create the tracing context and attach it to the request
 	trans := z.attachXrayTrace(c)
-	defer func() { _ = trans.End() }()
+	defer trans.End()
 
 	// Create a logger with this Request ID
 	logger := z.createLogger(c, trans) // Mutates the c.Request().Context
@@ -181,10 +251,10 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 
 		// Register the stack trace inside the XRay segment
 		stack := NewShortenedStackTrace(5, report)
-		_ = trans.NoticeError(newrelic.Error{
-			Message:    fmt.Sprintf("%v", report),
-			Class:      "Panic",
-			Stack:      stack.stack,
+		trans.NoticeError(&PanicError{
+			Message: fmt.Sprintf("%v", report),
+			Class:   "Panic",
+			Stack:   stack.stack,
 		})
 
 		// Send the 500 error along the way...
@@ -208,7 +278,6 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 	// Actually process the request
 	if err := z.next(c); err != nil {
 		// Disable the response augmentation
-		trans.SetWebResponse(nil)
 		c.Response().Writer = origWriter
 
 		// We have an error, process it
@@ -219,10 +288,10 @@ func (z *traceAndLogMiddleware) instrumentRequest(c echo.Context) error {
 			// HTTP errors contain a redundant code field
 			logger.Info("Request error",
 				append(ch, zap.Reflect("error", httpErr.Message))...)
-			trans.WriteHeader(httpErr.Code)
+			trans.SetResponseStatus(httpErr.Code)
 		} else {
 			logger.Info("Request error", append(ch, zap.Error(err))...)
-			trans.WriteHeader(http.StatusInternalServerError)
+			trans.SetResponseStatus(http.StatusInternalServerError)
 		}
 		return nil // Error is not propagated further
 	}
@@ -239,8 +308,10 @@ func TracingAndLoggingMiddlewareHook(opts TracingAndMetricsOptions) echo.Middlew
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		zlm := &traceAndLogMiddleware{
-			opts: opts,
-			next: next,
+			opts:    opts,
+			next:    next,
+			tracer:  opts.getTracer(),
+			formats: opts.getTraceHeaderFormats(),
 		}
 		return zlm.instrumentRequest
 	}
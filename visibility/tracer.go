@@ -0,0 +1,190 @@
+package visibility
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// The metadata that links the log lines to the trace
+type LinkingMetadata struct {
+	TraceID    string
+	SpanID     string
+	EntityName string
+	EntityType string
+	EntityGUID string
+	Hostname   string
+}
+
+// The tracing backend, see NewRelicTracer, OtlpTracer, FanOutTracer,
+// NoopTracer and RecordingTracer
+type Tracer interface {
+	// Start the transaction for the background work
+	StartTransaction(name string) Span
+	// Start the transaction for the HTTP request, the response must be
+	// written to the returned writer
+	StartWebTransaction(name string, w http.ResponseWriter,
+		r *http.Request) (Span, http.ResponseWriter)
+}
+
+// The transaction or one of its segments
+type Span interface {
+	// Start the segment of the same transaction, it can be used from a
+	// different goroutine
+	StartSegment(name string) Span
+	SetName(name string)
+	// The attributes and the errors belong to the transaction
+	AddAttribute(key string, value interface{})
+	NoticeError(err error)
+	// Record the response status of the web transaction without writing it
+	SetResponseStatus(code int)
+	// The headers that continue the trace in the downstream calls
+	DistributedTraceHeaders() http.Header
+	// Continue the trace from the upstream call
+	AcceptDistributedTraceHeaders(headers http.Header)
+	LinkingMetadata() LinkingMetadata
+	End()
+}
+
+// The spans that need to put something else into the context, like the
+// New Relic transaction for the New Relic instrumentation
+type contextAttacher interface {
+	attachToContext(ctx context.Context) context.Context
+}
+
+// The spans that can continue the trace from the trace context without the
+// parent span ID, like the X-Ray header from the ALB
+type traceContextAccepter interface {
+	acceptTraceContext(tc TraceContext)
+}
+
+type spanKey struct {
+}
+
+var spanKeyVal = &spanKey{}
+
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	if attacher, ok := span.(contextAttacher); ok {
+		ctx = attacher.attachToContext(ctx)
+	}
+	return context.WithValue(ctx, spanKeyVal, span)
+}
+
+// Get the span from the context, the New Relic transactions attached
+// directly are wrapped. Nil if there's none.
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKeyVal).(Span); ok {
+		return span
+	}
+	return newRelicSpanFromContext(ctx)
+}
+
+// The error for the recovered panics, the tracers can get its class and
+// its stack trace
+type PanicError struct {
+	Message string
+	Class   string
+	Stack   []uintptr
+}
+
+func (p *PanicError) Error() string {
+	return p.Message
+}
+
+func (p *PanicError) ErrorClass() string {
+	return p.Class
+}
+
+func (p *PanicError) StackTrace() []uintptr {
+	return p.Stack
+}
+
+// Does nothing, for the services and the tests without tracing
+var NoopTracer Tracer = &noopTracer{}
+
+type noopTracer struct {
+}
+
+type noopSpan struct {
+}
+
+func (n *noopTracer) StartTransaction(name string) Span {
+	return &noopSpan{}
+}
+
+func (n *noopTracer) StartWebTransaction(name string, w http.ResponseWriter,
+	r *http.Request) (Span, http.ResponseWriter) {
+	return &noopSpan{}, w
+}
+
+func (n *noopSpan) StartSegment(name string) Span {
+	return n
+}
+
+func (n *noopSpan) SetName(name string) {
+}
+
+func (n *noopSpan) AddAttribute(key string, value interface{}) {
+}
+
+func (n *noopSpan) NoticeError(err error) {
+}
+
+func (n *noopSpan) SetResponseStatus(code int) {
+}
+
+func (n *noopSpan) DistributedTraceHeaders() http.Header {
+	return http.Header{}
+}
+
+func (n *noopSpan) AcceptDistributedTraceHeaders(headers http.Header) {
+}
+
+func (n *noopSpan) LinkingMetadata() LinkingMetadata {
+	return LinkingMetadata{}
+}
+
+func (n *noopSpan) End() {
+}
+
+// Records the response status of the web transaction in its span. The
+// streaming and the protocol upgrades of the wrapped writer still work.
+type statusRecorder struct {
+	http.ResponseWriter
+	span        Span
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.wroteHeader = true
+		s.span.SetResponseStatus(code)
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	return s.ResponseWriter.Write(data)
+}
+
+func (s *statusRecorder) Flush() {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
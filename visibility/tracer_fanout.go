@@ -0,0 +1,131 @@
+package visibility
+
+import (
+	"context"
+	"net/http"
+)
+
+// Traces to all the tracers, like New Relic and OTLP during the migration.
+// Each span starts a span in every tracer. The distributed trace headers
+// of all the tracers are sent, the first tracer wins if they emit the same
+// header. The linking metadata is taken from the first span that has a trace.
+type FanOutTracer struct {
+	Tracers []Tracer
+}
+
+var _ Tracer = &FanOutTracer{}
+
+func NewFanOutTracer(tracers ...Tracer) *FanOutTracer {
+	return &FanOutTracer{Tracers: tracers}
+}
+
+func (f *FanOutTracer) StartTransaction(name string) Span {
+	res := &fanOutSpan{spans: make([]Span, 0, len(f.Tracers))}
+	for _, t := range f.Tracers {
+		res.spans = append(res.spans, t.StartTransaction(name))
+	}
+	return res
+}
+
+// The response writers of the tracers are chained, so that each tracer
+// sees the response
+func (f *FanOutTracer) StartWebTransaction(name string, w http.ResponseWriter,
+	r *http.Request) (Span, http.ResponseWriter) {
+
+	res := &fanOutSpan{spans: make([]Span, 0, len(f.Tracers))}
+	for _, t := range f.Tracers {
+		var span Span
+		span, w = t.StartWebTransaction(name, w, r)
+		res.spans = append(res.spans, span)
+	}
+	return res, w
+}
+
+type fanOutSpan struct {
+	spans []Span
+}
+
+func (f *fanOutSpan) attachToContext(ctx context.Context) context.Context {
+	for _, s := range f.spans {
+		if attacher, ok := s.(contextAttacher); ok {
+			ctx = attacher.attachToContext(ctx)
+		}
+	}
+	return ctx
+}
+
+func (f *fanOutSpan) StartSegment(name string) Span {
+	res := &fanOutSpan{spans: make([]Span, 0, len(f.spans))}
+	for _, s := range f.spans {
+		res.spans = append(res.spans, s.StartSegment(name))
+	}
+	return res
+}
+
+func (f *fanOutSpan) SetName(name string) {
+	for _, s := range f.spans {
+		s.SetName(name)
+	}
+}
+
+func (f *fanOutSpan) AddAttribute(key string, value interface{}) {
+	for _, s := range f.spans {
+		s.AddAttribute(key, value)
+	}
+}
+
+func (f *fanOutSpan) NoticeError(err error) {
+	for _, s := range f.spans {
+		s.NoticeError(err)
+	}
+}
+
+func (f *fanOutSpan) SetResponseStatus(code int) {
+	for _, s := range f.spans {
+		s.SetResponseStatus(code)
+	}
+}
+
+func (f *fanOutSpan) DistributedTraceHeaders() http.Header {
+	res := http.Header{}
+	for _, s := range f.spans {
+		for k, v := range s.DistributedTraceHeaders() {
+			if _, ok := res[k]; !ok {
+				res[k] = v
+			}
+		}
+	}
+	return res
+}
+
+func (f *fanOutSpan) AcceptDistributedTraceHeaders(headers http.Header) {
+	for _, s := range f.spans {
+		s.AcceptDistributedTraceHeaders(headers)
+	}
+}
+
+func (f *fanOutSpan) acceptTraceContext(tc TraceContext) {
+	for _, s := range f.spans {
+		acceptTraceContext(s, tc)
+	}
+}
+
+func (f *fanOutSpan) LinkingMetadata() LinkingMetadata {
+	var res LinkingMetadata
+	for i, s := range f.spans {
+		md := s.LinkingMetadata()
+		if md.TraceID != "" {
+			return md
+		}
+		if i == 0 {
+			res = md
+		}
+	}
+	return res
+}
+
+func (f *fanOutSpan) End() {
+	for _, s := range f.spans {
+		s.End()
+	}
+}
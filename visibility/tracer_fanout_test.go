@@ -0,0 +1,130 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/labstack/echo/v4"
+	newrelic "github.com/newrelic/go-agent"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// The New Relic payloads are created only if the account is known
+func makeTestDtApp() newrelic.Application {
+	cfg := newrelic.NewConfig("AppTest",
+		"ffffffff56f2241ec3b97af491172aba267d1111")
+	cfg.DistributedTracer.Enabled = true
+	cfg.ServerlessMode.Enabled = true
+	cfg.ServerlessMode.AccountID = "123"
+	cfg.ServerlessMode.TrustedAccountKey = "123"
+	cfg.ServerlessMode.PrimaryAppID = "456"
+
+	app, err := newrelic.NewApplication(cfg)
+	utils.PanicIfF(err != nil, "failed to create an app")
+	return app
+}
+
+func TestFanOutTracerRunInstrumented(t *testing.T) {
+	app := makeTestApp()
+	receiver := newOtlpReceiver()
+	defer receiver.Close()
+	exporter := NewOtlpExporter(receiver.URL, "test-service")
+	tracer := NewFanOutTracer(NewNewRelicTracer(app), NewOtlpTracer(exporter))
+
+	var nrTxn newrelic.Transaction
+	err := RunInstrumentedWithTracer(context.Background(), "Outer", tracer, exporter, zap.NewNop(),
+		func(c context.Context) error {
+			// The New Relic instrumentation finds its transaction
+			nrTxn = newrelic.FromContext(c)
+			assert.Equal(t, nrTxn, GetNewRelicTransaction(SpanFromContext(c)))
+			return RunInstrumentedWithTracer(c, "Inner", tracer, exporter, zap.NewNop(),
+				func(c context.Context) error {
+					return fmt.Errorf("inner failed")
+				})
+		})
+	assert.Error(t, err)
+	assert.NotNil(t, nrTxn)
+
+	// Both backends have the trace
+	met := getMetrics(app)
+	assert.Equal(t, "OtherTransaction/Go/Outer", getEvt(met, 0)["name"])
+	assert.Equal(t, "inner failed", getErr(met, 0)["error.message"])
+
+	assert.NoError(t, exporter.Flush(context.Background()))
+	spans := receiver.spans()
+	assert.Equal(t, 2, len(spans))
+	outer := findOtlpSpan(spans, "Outer")
+	inner := findOtlpSpan(spans, "Inner")
+	assert.Equal(t, outer.SpanID, inner.ParentSpanID)
+	assert.Equal(t, otlpStatus{Code: otlpStatusError, Message: "inner failed"},
+		outer.Status)
+}
+
+func TestFanOutTracerHeaders(t *testing.T) {
+	app := makeTestDtApp()
+	exporter := NewOtlpExporter("http://localhost:1", "test-service")
+	span := NewFanOutTracer(NewNewRelicTracer(app),
+		NewOtlpTracer(exporter)).StartTransaction("Op")
+
+	headers := http.Header{}
+	headers.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	span.AcceptDistributedTraceHeaders(headers)
+	segment := span.StartSegment("Call")
+
+	// The headers of both tracers are sent
+	out := segment.DistributedTraceHeaders()
+	assert.NotEmpty(t, out.Get(newrelic.DistributedTracePayloadHeader))
+	assert.True(t, strings.HasPrefix(out.Get(TraceParentHeader),
+		"00-0af7651916cd43dd8448eb211c80319c-"))
+
+	// The linking metadata is New Relic's, it's the first tracer
+	nrMd := GetNewRelicTransaction(segment).GetLinkingMetadata()
+	md := segment.LinkingMetadata()
+	assert.NotEmpty(t, md.TraceID)
+	assert.Equal(t, nrMd.TraceID, md.TraceID)
+	assert.Equal(t, nrMd.EntityName, md.EntityName)
+
+	// Falls back to the spans that have a trace
+	span = NewFanOutTracer(NoopTracer, NewOtlpTracer(exporter)).StartTransaction("Op")
+	span.AcceptDistributedTraceHeaders(headers)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.LinkingMetadata().TraceID)
+
+	segment.End()
+	span.End()
+	assert.Equal(t, 2, len(exporter.spans))
+}
+
+func TestFanOutTracerWebTransactions(t *testing.T) {
+	app := makeTestApp()
+	exporter := NewOtlpExporter("http://localhost:1", "test-service")
+
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Logger: zap.NewNop(),
+		Tracer: NewFanOutTracer(NewNewRelicTracer(app), NewOtlpTracer(exporter)),
+	}))
+	e.GET("/conflict", func(c echo.Context) error {
+		return c.String(http.StatusConflict, "conflict")
+	})
+
+	req := httptest.NewRequest("GET", "/conflict", nil)
+	req.Header.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, "conflict", rec.Body.String())
+
+	// Both tracers see the response status
+	evt := getEvt(getMetrics(app), 0)
+	assert.Equal(t, "WebTransaction/Go/conflict", evt["name"])
+	assert.Equal(t, true, evt["error"])
+	assert.Equal(t, 1, len(exporter.spans))
+	span := exporter.spans[0]
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.TraceID)
+	assert.Equal(t, "409", getOtlpAttribute(span.Attributes, "http.status_code"))
+}
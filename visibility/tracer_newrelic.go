@@ -0,0 +1,129 @@
+package visibility
+
+import (
+	"context"
+	newrelic "github.com/newrelic/go-agent"
+	"net/http"
+)
+
+// Sends the traces to New Relic
+type NewRelicTracer struct {
+	App newrelic.Application
+}
+
+func NewNewRelicTracer(app newrelic.Application) *NewRelicTracer {
+	return &NewRelicTracer{App: app}
+}
+
+func (n *NewRelicTracer) StartTransaction(name string) Span {
+	return &newRelicSpan{txn: n.App.StartTransaction(name, nil, nil)}
+}
+
+func (n *NewRelicTracer) StartWebTransaction(name string, w http.ResponseWriter,
+	r *http.Request) (Span, http.ResponseWriter) {
+
+	txn := n.App.StartTransaction(name, w, r)
+	return &newRelicSpan{txn: txn}, txn
+}
+
+// The NoopTracer is used if there's no app
+func tracerForApp(app newrelic.Application) Tracer {
+	if app == nil {
+		return NoopTracer
+	}
+	return NewNewRelicTracer(app)
+}
+
+// The transaction, or its segment if the segment is set
+type newRelicSpan struct {
+	txn     newrelic.Transaction
+	segment *newrelic.Segment
+}
+
+func newRelicSpanFromContext(ctx context.Context) Span {
+	txn := newrelic.FromContext(ctx)
+	if txn == nil {
+		return nil
+	}
+	return &newRelicSpan{txn: txn}
+}
+
+// Get the New Relic transaction of the span, nil if it's not a New Relic span
+// or a fan-out span with one
+func GetNewRelicTransaction(span Span) newrelic.Transaction {
+	switch s := span.(type) {
+	case *newRelicSpan:
+		return s.txn
+	case *fanOutSpan:
+		for _, child := range s.spans {
+			if txn := GetNewRelicTransaction(child); txn != nil {
+				return txn
+			}
+		}
+	}
+	return nil
+}
+
+func (n *newRelicSpan) attachToContext(ctx context.Context) context.Context {
+	return newrelic.NewContext(ctx, n.txn)
+}
+
+func (n *newRelicSpan) StartSegment(name string) Span {
+	txn := n.txn.NewGoroutine()
+	return &newRelicSpan{txn: txn, segment: newrelic.StartSegment(txn, name)}
+}
+
+func (n *newRelicSpan) SetName(name string) {
+	if n.segment != nil {
+		n.segment.Name = name
+		return
+	}
+	_ = n.txn.SetName(name)
+}
+
+func (n *newRelicSpan) AddAttribute(key string, value interface{}) {
+	_ = n.txn.AddAttribute(key, value)
+}
+
+func (n *newRelicSpan) NoticeError(err error) {
+	_ = n.txn.NoticeError(err)
+}
+
+func (n *newRelicSpan) SetResponseStatus(code int) {
+	n.txn.SetWebResponse(nil)
+	n.txn.WriteHeader(code)
+}
+
+func (n *newRelicSpan) DistributedTraceHeaders() http.Header {
+	res := http.Header{}
+	if p := n.txn.CreateDistributedTracePayload().HTTPSafe(); p != "" {
+		res.Set(newrelic.DistributedTracePayloadHeader, p)
+	}
+	return res
+}
+
+func (n *newRelicSpan) AcceptDistributedTraceHeaders(headers http.Header) {
+	if p := headers.Get(newrelic.DistributedTracePayloadHeader); p != "" {
+		_ = n.txn.AcceptDistributedTracePayload(newrelic.TransportHTTP, p)
+	}
+}
+
+func (n *newRelicSpan) LinkingMetadata() LinkingMetadata {
+	md := n.txn.GetLinkingMetadata()
+	return LinkingMetadata{
+		TraceID:    md.TraceID,
+		SpanID:     md.SpanID,
+		EntityName: md.EntityName,
+		EntityType: md.EntityType,
+		EntityGUID: md.EntityGUID,
+		Hostname:   md.Hostname,
+	}
+}
+
+func (n *newRelicSpan) End() {
+	if n.segment != nil {
+		_ = n.segment.End()
+		return
+	}
+	_ = n.txn.End()
+}
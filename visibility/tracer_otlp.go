@@ -0,0 +1,244 @@
+package visibility
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The OTLP span kinds and status codes
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpStatusError      = 2
+)
+
+// Traces to the OtlpExporter, the trace context is propagated with the W3C
+// traceparent and tracestate headers. The segments are the child spans of
+// the spans they are started from, the attributes, the errors and the
+// response status are recorded in the transaction (the root span). The
+// spans that are not sampled upstream are not exported.
+type OtlpTracer struct {
+	Exporter *OtlpExporter
+}
+
+var _ Tracer = &OtlpTracer{}
+
+func NewOtlpTracer(exporter *OtlpExporter) *OtlpTracer {
+	return &OtlpTracer{Exporter: exporter}
+}
+
+func (t *OtlpTracer) StartTransaction(name string) Span {
+	return t.start(name, otlpSpanKindInternal)
+}
+
+func (t *OtlpTracer) StartWebTransaction(name string, w http.ResponseWriter,
+	r *http.Request) (Span, http.ResponseWriter) {
+
+	span := t.start(name, otlpSpanKindServer)
+	span.AcceptDistributedTraceHeaders(r.Header)
+	span.attributes["http.method"] = r.Method
+	span.attributes["http.target"] = r.URL.Path
+	return span, &statusRecorder{ResponseWriter: w, span: span}
+}
+
+func (t *OtlpTracer) start(name string, kind int) *otlpActiveSpan {
+	span := &otlpActiveSpan{
+		tracer: t,
+		mtx:    &sync.Mutex{},
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+		tc: TraceContext{
+			TraceID: NewTraceID(),
+			SpanID:  NewSpanID(),
+			Sampled: true,
+		},
+		attributes: make(map[string]interface{}),
+	}
+	span.txn = span
+	return span
+}
+
+type otlpActiveSpan struct {
+	tracer *OtlpTracer
+	// The transaction span, the span itself for the transactions
+	txn *otlpActiveSpan
+	// Shared by all the spans of the transaction
+	mtx *sync.Mutex
+
+	name     string
+	kind     int
+	start    time.Time
+	tc       TraceContext
+	parentID string
+	ended    bool
+
+	// The transaction only
+	attributes map[string]interface{}
+	errors     []error
+	status     int
+}
+
+func (o *otlpActiveSpan) StartSegment(name string) Span {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	tc := o.tc
+	tc.SpanID = NewSpanID()
+	return &otlpActiveSpan{
+		tracer:   o.tracer,
+		txn:      o.txn,
+		mtx:      o.mtx,
+		name:     name,
+		kind:     otlpSpanKindInternal,
+		start:    time.Now(),
+		tc:       tc,
+		parentID: o.tc.SpanID,
+	}
+}
+
+func (o *otlpActiveSpan) SetName(name string) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.name = name
+}
+
+func (o *otlpActiveSpan) AddAttribute(key string, value interface{}) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.txn.attributes[key] = value
+}
+
+func (o *otlpActiveSpan) NoticeError(err error) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.txn.errors = append(o.txn.errors, err)
+}
+
+func (o *otlpActiveSpan) SetResponseStatus(code int) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.txn.status = code
+}
+
+func (o *otlpActiveSpan) DistributedTraceHeaders() http.Header {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	res := http.Header{}
+	o.tc.Inject(res)
+	return res
+}
+
+// Continue the trace from the W3C headers, must be called before the
+// segments are started
+func (o *otlpActiveSpan) AcceptDistributedTraceHeaders(headers http.Header) {
+	if tc, ok := ExtractTraceContext(headers); ok {
+		o.acceptTraceContext(tc)
+	}
+}
+
+func (o *otlpActiveSpan) acceptTraceContext(tc TraceContext) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	o.parentID = tc.SpanID
+	tc.SpanID = o.tc.SpanID
+	o.tc = tc
+}
+
+func (o *otlpActiveSpan) LinkingMetadata() LinkingMetadata {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return LinkingMetadata{TraceID: o.tc.TraceID, SpanID: o.tc.SpanID}
+}
+
+func (o *otlpActiveSpan) End() {
+	o.mtx.Lock()
+	if o.ended || !o.tc.Sampled {
+		o.ended = true
+		o.mtx.Unlock()
+		return
+	}
+	o.ended = true
+	span := o.makeOtlpSpan(time.Now())
+	o.mtx.Unlock()
+
+	o.tracer.Exporter.enqueueSpan(span)
+}
+
+func (o *otlpActiveSpan) makeOtlpSpan(end time.Time) otlpSpan {
+	res := otlpSpan{
+		TraceID:           o.tc.TraceID,
+		SpanID:            o.tc.SpanID,
+		TraceState:        o.tc.State,
+		ParentSpanID:      o.parentID,
+		Name:              o.name,
+		Kind:              o.kind,
+		StartTimeUnixNano: otlpTime(o.start),
+		EndTimeUnixNano:   otlpTime(end),
+	}
+	if o.txn != o {
+		return res
+	}
+
+	attrs := o.attributes
+	if o.status != 0 {
+		attrs = make(map[string]interface{}, len(o.attributes)+1)
+		for k, v := range o.attributes {
+			attrs[k] = v
+		}
+		attrs["http.status_code"] = o.status
+	}
+	res.Attributes = makeOtlpAttributes(attrs)
+
+	for _, err := range o.errors {
+		res.Events = append(res.Events, makeOtlpExceptionEvent(err, end))
+	}
+	if len(o.errors) != 0 {
+		res.Status = otlpStatus{Code: otlpStatusError, Message: o.errors[0].Error()}
+	} else if o.kind == otlpSpanKindServer && o.status >= 500 {
+		res.Status = otlpStatus{Code: otlpStatusError,
+			Message: "HTTP " + strconv.Itoa(o.status)}
+	}
+	return res
+}
+
+// The OpenTelemetry exception event, the error class and the stack trace
+// are taken from the errors that have them, like the PanicError
+func makeOtlpExceptionEvent(err error, now time.Time) otlpEvent {
+	class := fmt.Sprintf("%T", err)
+	if classer, ok := err.(interface{ ErrorClass() string }); ok {
+		class = classer.ErrorClass()
+	}
+	attrs := map[string]interface{}{
+		"exception.type":    class,
+		"exception.message": err.Error(),
+	}
+
+	if tracer, ok := err.(interface{ StackTrace() []uintptr }); ok {
+		var sb strings.Builder
+		frames := runtime.CallersFrames(tracer.StackTrace())
+		for {
+			frame, more := frames.Next()
+			if frame.Function != "" {
+				sb.WriteString(fmt.Sprintf("%s\n\t%s:%d\n", frame.Function,
+					frame.File, frame.Line))
+			}
+			if !more {
+				break
+			}
+		}
+		attrs["exception.stacktrace"] = sb.String()
+	}
+
+	return otlpEvent{
+		TimeUnixNano: otlpTime(now),
+		Name:         "exception",
+		Attributes:   makeOtlpAttributes(attrs),
+	}
+}
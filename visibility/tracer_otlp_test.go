@@ -0,0 +1,173 @@
+package visibility
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aurorasolar/go-service-nr-base/utils"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func findOtlpSpan(spans []otlpSpan, name string) otlpSpan {
+	for _, s := range spans {
+		if s.Name == name {
+			return s
+		}
+	}
+	return otlpSpan{}
+}
+
+func TestOtlpTracerRunInstrumented(t *testing.T) {
+	receiver := newOtlpReceiver()
+	defer receiver.Close()
+	exporter := NewOtlpExporter(receiver.URL, "test-service")
+	tracer := NewOtlpTracer(exporter)
+	logSink, logger := utils.NewMemorySinkLogger()
+
+	err := RunInstrumentedWithTracer(context.Background(), "Outer", tracer, exporter, logger,
+		func(c context.Context) error {
+			AddRequestAttribute(c, "customer.id", "cust1")
+			return RunInstrumentedWithTracer(c, "Inner", tracer, exporter, logger,
+				func(c context.Context) error {
+					CL(c).Info("Inner")
+					return RunInstrumentedWithTracer(c, "Innermost", tracer, exporter, logger,
+						func(c context.Context) error {
+							return fmt.Errorf("innermost failed")
+						})
+				})
+		})
+	assert.Error(t, err)
+
+	assert.Panics(t, func() {
+		_ = RunInstrumentedWithTracer(context.Background(), "Panicky", tracer, exporter, logger,
+			func(c context.Context) error {
+				panic("oops")
+			})
+	})
+	assert.NoError(t, exporter.Flush(context.Background()))
+
+	spans := receiver.spans()
+	assert.Equal(t, 4, len(spans))
+	outer := findOtlpSpan(spans, "Outer")
+	inner := findOtlpSpan(spans, "Inner")
+	innermost := findOtlpSpan(spans, "Innermost")
+
+	// The segments are nested
+	assert.Empty(t, outer.ParentSpanID)
+	assert.Equal(t, otlpSpanKindInternal, outer.Kind)
+	assert.Equal(t, outer.TraceID, inner.TraceID)
+	assert.Equal(t, outer.SpanID, inner.ParentSpanID)
+	assert.Equal(t, inner.SpanID, innermost.ParentSpanID)
+	assert.Equal(t, outer.TraceID, innermost.TraceID)
+
+	// The attributes and the errors go to the transaction
+	assert.Equal(t, "cust1", getOtlpAttribute(outer.Attributes, "customer.id"))
+	assert.Empty(t, inner.Attributes)
+	assert.Equal(t, otlpStatus{Code: otlpStatusError, Message: "innermost failed"},
+		outer.Status)
+	assert.Equal(t, 3, len(outer.Events))
+	assert.Equal(t, "exception", outer.Events[0].Name)
+	assert.Equal(t, "*errors.errorString",
+		getOtlpAttribute(outer.Events[0].Attributes, "exception.type"))
+
+	panicky := findOtlpSpan(spans, "Panicky")
+	assert.Equal(t, "oops", panicky.Status.Message)
+	assert.Equal(t, "gopanic", getOtlpAttribute(panicky.Events[0].Attributes, "exception.type"))
+	assert.Contains(t, getOtlpAttribute(panicky.Events[0].Attributes,
+		"exception.stacktrace"), "TestOtlpTracerRunInstrumented")
+
+	// The log lines have the OpenTelemetry correlation fields
+	var line map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(logSink.String())), &line))
+	assert.Equal(t, outer.TraceID, line[OtelTraceIDKey])
+	assert.Equal(t, inner.SpanID, line[OtelSpanIDKey])
+}
+
+func TestOtlpTracerWebTransactions(t *testing.T) {
+	receiver := newOtlpReceiver()
+	defer receiver.Close()
+	exporter := NewOtlpExporter(receiver.URL, "test-service")
+
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Logger: zap.NewNop(),
+		Tracer: NewOtlpTracer(exporter),
+	}))
+	e.GET("/ok", func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return fmt.Errorf("failed")
+	})
+
+	req := httptest.NewRequest("GET", "/ok", nil)
+	req.Header.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set(TraceStateHeader, "congo=t61rcWkgMzE")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/fail", nil))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	// The spans that are not sampled upstream are not exported
+	req = httptest.NewRequest("GET", "/ok", nil)
+	req.Header.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319d-b7ad6b7169203331-00")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.True(t, strings.HasSuffix(rec.Header().Get(TraceParentHeader), "-00"))
+
+	assert.NoError(t, exporter.Flush(context.Background()))
+	spans := receiver.spans()
+	assert.Equal(t, 2, len(spans))
+
+	ok := spans[0]
+	assert.Equal(t, "/ok", ok.Name)
+	assert.Equal(t, otlpSpanKindServer, ok.Kind)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", ok.TraceID)
+	assert.Equal(t, "b7ad6b7169203331", ok.ParentSpanID)
+	assert.Equal(t, "congo=t61rcWkgMzE", ok.TraceState)
+	assert.Equal(t, "200", getOtlpAttribute(ok.Attributes, "http.status_code"))
+	assert.Equal(t, "GET", getOtlpAttribute(ok.Attributes, "http.method"))
+	assert.Equal(t, otlpStatus{}, ok.Status)
+
+	fail := spans[1]
+	assert.Equal(t, "500", getOtlpAttribute(fail.Attributes, "http.status_code"))
+	assert.Equal(t, otlpStatusError, fail.Status.Code)
+	assert.Equal(t, 32, len(fail.TraceID))
+	assert.Empty(t, fail.ParentSpanID)
+}
+
+func TestOtlpTracerPropagation(t *testing.T) {
+	exporter := NewOtlpExporter("http://localhost:1", "test-service")
+	span := NewOtlpTracer(exporter).StartTransaction("Op")
+
+	headers := http.Header{}
+	headers.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	headers.Set(TraceStateHeader, "congo=t61rcWkgMzE")
+	span.AcceptDistributedTraceHeaders(headers)
+	segment := span.StartSegment("Call")
+
+	out := segment.DistributedTraceHeaders()
+	md := segment.LinkingMetadata()
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", md.TraceID)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-"+md.SpanID+"-01",
+		out.Get(TraceParentHeader))
+	assert.Equal(t, "congo=t61rcWkgMzE", out.Get(TraceStateHeader))
+
+	// The invalid headers are ignored
+	span.AcceptDistributedTraceHeaders(http.Header{TraceParentHeader: {"garbage"}})
+	assert.Equal(t, md.TraceID, span.LinkingMetadata().TraceID)
+
+	// Ending twice exports once
+	segment.End()
+	segment.End()
+	assert.Equal(t, 1, len(exporter.spans))
+}
@@ -0,0 +1,182 @@
+package visibility
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// The span recorded by the RecordingTracer
+type RecordedSpan struct {
+	Name     string
+	TraceID  string
+	SpanID   string
+	ParentID string
+	// The transaction is the root span, the segments share its attributes,
+	// its errors and its status
+	IsTransaction bool
+	Attributes    map[string]interface{}
+	Errors        []error
+	Status        int
+	Ended         bool
+}
+
+// Records the spans in memory, for the test assertions
+type RecordingTracer struct {
+	mtx    sync.Mutex
+	spans  []*RecordedSpan
+	lastID uint64
+}
+
+func NewRecordingTracer() *RecordingTracer {
+	return &RecordingTracer{}
+}
+
+func (t *RecordingTracer) nextID() uint64 {
+	t.lastID++
+	return t.lastID
+}
+
+func (t *RecordingTracer) start(name string, txn *recordingSpan) *recordingSpan {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	span := &RecordedSpan{
+		Name:   name,
+		SpanID: fmt.Sprintf("%016x", t.nextID()),
+	}
+	if txn == nil {
+		span.IsTransaction = true
+		span.TraceID = fmt.Sprintf("%032x", t.nextID())
+		span.Attributes = make(map[string]interface{})
+	} else {
+		span.TraceID = txn.rec.TraceID
+		span.ParentID = txn.rec.SpanID
+	}
+	t.spans = append(t.spans, span)
+
+	res := &recordingSpan{tracer: t, rec: span, txn: txn}
+	if txn == nil {
+		res.txn = res
+	}
+	return res
+}
+
+func (t *RecordingTracer) StartTransaction(name string) Span {
+	return t.start(name, nil)
+}
+
+func (t *RecordingTracer) StartWebTransaction(name string, w http.ResponseWriter,
+	r *http.Request) (Span, http.ResponseWriter) {
+
+	span := t.start(name, nil)
+	span.AcceptDistributedTraceHeaders(r.Header)
+	return span, &statusRecorder{ResponseWriter: w, span: span}
+}
+
+// Get the copies of the recorded spans in the order they were started
+func (t *RecordingTracer) Spans() []RecordedSpan {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	res := make([]RecordedSpan, 0, len(t.spans))
+	for _, s := range t.spans {
+		copied := *s
+		if s.Attributes != nil {
+			copied.Attributes = make(map[string]interface{}, len(s.Attributes))
+			for k, v := range s.Attributes {
+				copied.Attributes[k] = v
+			}
+		}
+		copied.Errors = append([]error{}, s.Errors...)
+		res = append(res, copied)
+	}
+	return res
+}
+
+// Get the copy of the first span with the name, false if there's none
+func (t *RecordingTracer) FindSpan(name string) (RecordedSpan, bool) {
+	for _, s := range t.Spans() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return RecordedSpan{}, false
+}
+
+func (t *RecordingTracer) Reset() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.spans = nil
+}
+
+type recordingSpan struct {
+	tracer *RecordingTracer
+	rec    *RecordedSpan
+	// The transaction span, the span itself for the transactions
+	txn *recordingSpan
+}
+
+func (r *recordingSpan) StartSegment(name string) Span {
+	return r.tracer.start(name, r.txn)
+}
+
+func (r *recordingSpan) SetName(name string) {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+	r.rec.Name = name
+}
+
+func (r *recordingSpan) AddAttribute(key string, value interface{}) {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+	r.txn.rec.Attributes[key] = value
+}
+
+func (r *recordingSpan) NoticeError(err error) {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+	r.txn.rec.Errors = append(r.txn.rec.Errors, err)
+}
+
+func (r *recordingSpan) SetResponseStatus(code int) {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+	r.txn.rec.Status = code
+}
+
+// The W3C traceparent header
+func (r *recordingSpan) DistributedTraceHeaders() http.Header {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+
+	res := http.Header{}
+	TraceContext{TraceID: r.rec.TraceID, SpanID: r.rec.SpanID, Sampled: true}.Inject(res)
+	return res
+}
+
+// Continue the trace from the W3C traceparent header
+func (r *recordingSpan) AcceptDistributedTraceHeaders(headers http.Header) {
+	if tc, ok := ExtractTraceContext(headers); ok {
+		r.acceptTraceContext(tc)
+	}
+}
+
+func (r *recordingSpan) acceptTraceContext(tc TraceContext) {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+	r.rec.TraceID = tc.TraceID
+	r.rec.ParentID = tc.SpanID
+}
+
+func (r *recordingSpan) LinkingMetadata() LinkingMetadata {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+	return LinkingMetadata{TraceID: r.rec.TraceID, SpanID: r.rec.SpanID}
+}
+
+func (r *recordingSpan) End() {
+	r.tracer.mtx.Lock()
+	defer r.tracer.mtx.Unlock()
+	r.rec.Ended = true
+}
@@ -0,0 +1,186 @@
+package visibility
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	newrelic "github.com/newrelic/go-agent"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordingTracer(t *testing.T) {
+	tracer := NewRecordingTracer()
+
+	err := RunInstrumentedWithTracer(context.Background(), "Outer", tracer, NullSink, zap.NewNop(),
+		func(c context.Context) error {
+			SpanFromContext(c).AddAttribute("outer", 1)
+			GetMetricsFromContext(c).AddCount("calls", 2)
+			return RunInstrumentedWithTracer(c, "Inner", tracer, NullSink, zap.NewNop(),
+				func(c context.Context) error {
+					SpanFromContext(c).AddAttribute("inner", 2)
+					return fmt.Errorf("inner failed")
+				})
+		})
+	assert.Error(t, err)
+
+	assert.Panics(t, func() {
+		_ = RunInstrumentedWithTracer(context.Background(), "Panicky", tracer, NullSink, zap.NewNop(),
+			func(c context.Context) error {
+				panic("oops")
+			})
+	})
+
+	spans := tracer.Spans()
+	assert.Equal(t, 3, len(spans))
+	outer, inner, panicky := spans[0], spans[1], spans[2]
+
+	assert.Equal(t, "Outer", outer.Name)
+	assert.True(t, outer.IsTransaction)
+	assert.True(t, outer.Ended)
+	// The segments share the transaction's attributes and errors
+	assert.Equal(t, map[string]interface{}{"outer": 1, "inner": 2, "calls": 2.0,
+		"callsUnit": "Count", "callsOrigUnit": "Count", UnitVersionAttribute: 2},
+		outer.Attributes)
+	assert.Equal(t, 2, len(outer.Errors))
+	assert.Equal(t, "inner failed", outer.Errors[0].Error())
+
+	assert.Equal(t, "Inner", inner.Name)
+	assert.False(t, inner.IsTransaction)
+	assert.True(t, inner.Ended)
+	assert.Equal(t, outer.TraceID, inner.TraceID)
+	assert.Equal(t, outer.SpanID, inner.ParentID)
+
+	assert.Equal(t, 1, len(panicky.Errors))
+	panicErr := panicky.Errors[0].(*PanicError)
+	assert.Equal(t, "oops", panicErr.Error())
+	assert.Equal(t, "gopanic", panicErr.ErrorClass())
+	assert.NotEmpty(t, panicErr.StackTrace())
+
+	_, ok := tracer.FindSpan("Inner")
+	assert.True(t, ok)
+	tracer.Reset()
+	assert.Empty(t, tracer.Spans())
+}
+
+func TestNoopTracer(t *testing.T) {
+	err := RunInstrumentedWithTracer(context.Background(), "Op", nil, NullSink, zap.NewNop(),
+		func(c context.Context) error {
+			span := SpanFromContext(c)
+			assert.NotNil(t, span)
+			assert.Empty(t, span.DistributedTraceHeaders())
+			assert.Equal(t, LinkingMetadata{}, span.LinkingMetadata())
+			return nil
+		})
+	assert.NoError(t, err)
+}
+
+func TestNewRelicSpanFromContext(t *testing.T) {
+	app := makeTestApp()
+	assert.Nil(t, SpanFromContext(context.Background()))
+
+	// The transactions attached by the New Relic integrations are picked up
+	txn := app.StartTransaction("Raw", nil, nil)
+	ctx := newrelic.NewContext(context.Background(), txn)
+	assert.Equal(t, txn, GetNewRelicTransaction(SpanFromContext(ctx)))
+
+	// And the spans attach the transactions for them
+	span := NewNewRelicTracer(app).StartTransaction("Wrapped")
+	ctx = ContextWithSpan(context.Background(), span)
+	assert.Equal(t, GetNewRelicTransaction(span), newrelic.FromContext(ctx))
+	assert.Nil(t, GetNewRelicTransaction(NoopTracer.StartTransaction("Noop")))
+}
+
+func TestEchoWithRecordingTracer(t *testing.T) {
+	tracer := NewRecordingTracer()
+
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Logger: zap.NewNop(),
+		Tracer: tracer,
+	}))
+	e.GET("/ok", func(c echo.Context) error {
+		AddRequestAttribute(c.Request().Context(), "customer.id", "cust1")
+		return c.String(http.StatusOK, "ok")
+	})
+	e.GET("/error", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusConflict, "An error")
+	})
+
+	req := httptest.NewRequest("GET", "/ok", nil)
+	req.Header.Set("traceparent",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	span, ok := tracer.FindSpan("/ok")
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusOK, span.Status)
+	assert.Equal(t, "cust1", span.Attributes["customer.id"])
+	// The trace is continued and propagated
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.TraceID)
+	assert.Equal(t, "b7ad6b7169203331", span.ParentID)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-"+span.SpanID+"-01",
+		rec.Header().Get("traceparent"))
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/error", nil))
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	span, _ = tracer.FindSpan("/error")
+	assert.Equal(t, http.StatusConflict, span.Status)
+	assert.True(t, span.Ended)
+}
+
+func TestStatusRecorderStreaming(t *testing.T) {
+	tracer := NewRecordingTracer()
+
+	e := echo.New()
+	e.Use(TracingAndLoggingMiddlewareHook(TracingAndMetricsOptions{
+		Logger: zap.NewNop(),
+		Tracer: tracer,
+	}))
+	e.GET("/stream", func(c echo.Context) error {
+		_, _ = c.Response().Write([]byte("chunk"))
+		c.Response().Flush()
+		return nil
+	})
+	e.GET("/hijack", func(c echo.Context) error {
+		conn, buf, err := c.Response().Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\n" +
+			"Connection: close\r\n\r\nhijacked")
+		return buf.Flush()
+	})
+
+	// The flushes reach the underlying writer
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/stream", nil))
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, "chunk", rec.Body.String())
+	span, _ := tracer.FindSpan("/stream")
+	assert.Equal(t, http.StatusOK, span.Status)
+
+	// The connection can be taken over
+	server := httptest.NewServer(e)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/hijack")
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "hijacked", string(body))
+
+	// The writers that can't be hijacked report an error
+	recorder := &statusRecorder{ResponseWriter: httptest.NewRecorder(),
+		span: NoopTracer.StartTransaction("Op")}
+	_, _, err = recorder.Hijack()
+	assert.Error(t, err)
+}
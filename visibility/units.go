@@ -0,0 +1,138 @@
+package visibility
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+)
+
+// The version of the unit normalization, exported with the metrics so the
+// dashboards can tell the values apart. The version 1 had the durations 10
+// times too large and used 1024 for the bit units.
+const UnitNormalizationVersion = 2
+
+// The attribute with the UnitNormalizationVersion
+const UnitVersionAttribute = "UnitVersion"
+
+// The units of the same dimension can be converted to each other
+type UnitDimension string
+
+const (
+	DimensionTime     UnitDimension = "Time"
+	DimensionData     UnitDimension = "Data"
+	DimensionDataRate UnitDimension = "DataRate"
+	DimensionCount    UnitDimension = "Count"
+	DimensionRate     UnitDimension = "Rate"
+	DimensionPercent  UnitDimension = "Percent"
+	DimensionNone     UnitDimension = "None"
+)
+
+// The unit that all the units of the dimension are expressed in
+var dimensionBaseUnits = map[UnitDimension]cloudwatch.StandardUnit{
+	DimensionTime:     cloudwatch.StandardUnitMicroseconds,
+	DimensionData:     cloudwatch.StandardUnitBits,
+	DimensionDataRate: cloudwatch.StandardUnitBitsSecond,
+	DimensionCount:    cloudwatch.StandardUnitCount,
+	DimensionRate:     cloudwatch.StandardUnitCountSecond,
+	DimensionPercent:  cloudwatch.StandardUnitPercent,
+	DimensionNone:     cloudwatch.StandardUnitNone,
+}
+
+type unitInfo struct {
+	dimension UnitDimension
+	// The number of the base units in this unit
+	factor float64
+	// The unit that Normalize converts to: the bytes stay the bytes and the
+	// bits stay the bits
+	normalized cloudwatch.StandardUnit
+}
+
+// The byte units are binary (a kilobyte is 1024 bytes), the bit units are
+// SI (a kilobit is 1000 bits), the same as in CloudWatch.
+const (
+	kibi = 1024
+	kilo = 1000
+)
+
+var unitInfos = map[cloudwatch.StandardUnit]unitInfo{
+	cloudwatch.StandardUnitSeconds:      {DimensionTime, 1e6, cloudwatch.StandardUnitMicroseconds},
+	cloudwatch.StandardUnitMilliseconds: {DimensionTime, 1e3, cloudwatch.StandardUnitMicroseconds},
+	cloudwatch.StandardUnitMicroseconds: {DimensionTime, 1, cloudwatch.StandardUnitMicroseconds},
+
+	cloudwatch.StandardUnitBytes:     {DimensionData, 8, cloudwatch.StandardUnitBytes},
+	cloudwatch.StandardUnitKilobytes: {DimensionData, 8 * kibi, cloudwatch.StandardUnitBytes},
+	cloudwatch.StandardUnitMegabytes: {DimensionData, 8 * kibi * kibi, cloudwatch.StandardUnitBytes},
+	cloudwatch.StandardUnitGigabytes: {DimensionData, 8 * kibi * kibi * kibi, cloudwatch.StandardUnitBytes},
+	cloudwatch.StandardUnitTerabytes: {DimensionData, 8 * kibi * kibi * kibi * kibi, cloudwatch.StandardUnitBytes},
+	cloudwatch.StandardUnitBits:      {DimensionData, 1, cloudwatch.StandardUnitBits},
+	cloudwatch.StandardUnitKilobits:  {DimensionData, kilo, cloudwatch.StandardUnitBits},
+	cloudwatch.StandardUnitMegabits:  {DimensionData, kilo * kilo, cloudwatch.StandardUnitBits},
+	cloudwatch.StandardUnitGigabits:  {DimensionData, kilo * kilo * kilo, cloudwatch.StandardUnitBits},
+	cloudwatch.StandardUnitTerabits:  {DimensionData, kilo * kilo * kilo * kilo, cloudwatch.StandardUnitBits},
+
+	cloudwatch.StandardUnitBytesSecond:     {DimensionDataRate, 8, cloudwatch.StandardUnitBytesSecond},
+	cloudwatch.StandardUnitKilobytesSecond: {DimensionDataRate, 8 * kibi, cloudwatch.StandardUnitBytesSecond},
+	cloudwatch.StandardUnitMegabytesSecond: {DimensionDataRate, 8 * kibi * kibi, cloudwatch.StandardUnitBytesSecond},
+	cloudwatch.StandardUnitGigabytesSecond: {DimensionDataRate, 8 * kibi * kibi * kibi, cloudwatch.StandardUnitBytesSecond},
+	cloudwatch.StandardUnitTerabytesSecond: {DimensionDataRate, 8 * kibi * kibi * kibi * kibi, cloudwatch.StandardUnitBytesSecond},
+	cloudwatch.StandardUnitBitsSecond:      {DimensionDataRate, 1, cloudwatch.StandardUnitBitsSecond},
+	cloudwatch.StandardUnitKilobitsSecond:  {DimensionDataRate, kilo, cloudwatch.StandardUnitBitsSecond},
+	cloudwatch.StandardUnitMegabitsSecond:  {DimensionDataRate, kilo * kilo, cloudwatch.StandardUnitBitsSecond},
+	cloudwatch.StandardUnitGigabitsSecond:  {DimensionDataRate, kilo * kilo * kilo, cloudwatch.StandardUnitBitsSecond},
+	cloudwatch.StandardUnitTerabitsSecond:  {DimensionDataRate, kilo * kilo * kilo * kilo, cloudwatch.StandardUnitBitsSecond},
+
+	cloudwatch.StandardUnitCount:       {DimensionCount, 1, cloudwatch.StandardUnitCount},
+	cloudwatch.StandardUnitCountSecond: {DimensionRate, 1, cloudwatch.StandardUnitCountSecond},
+	cloudwatch.StandardUnitPercent:     {DimensionPercent, 1, cloudwatch.StandardUnitPercent},
+	cloudwatch.StandardUnitNone:        {DimensionNone, 1, cloudwatch.StandardUnitNone},
+}
+
+// Get the dimension of the unit, the unknown units are DimensionNone
+func GetUnitDimension(unit cloudwatch.StandardUnit) UnitDimension {
+	info, ok := unitInfos[unit]
+	if !ok {
+		return DimensionNone
+	}
+	return info.dimension
+}
+
+// Get the unit that all the units of the dimension are expressed in
+func GetBaseUnit(dim UnitDimension) cloudwatch.StandardUnit {
+	return dimensionBaseUnits[dim]
+}
+
+// Get the multiplier to convert the values from one unit to the other, the
+// units must have the same dimension
+func GetConversionFactor(from, to cloudwatch.StandardUnit) (float64, error) {
+	fromInfo, ok := unitInfos[from]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s", from)
+	}
+	toInfo, ok := unitInfos[to]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s", to)
+	}
+	if fromInfo.dimension != toInfo.dimension {
+		return 0, fmt.Errorf("can't convert %s to %s", from, to)
+	}
+	return fromInfo.factor / toInfo.factor, nil
+}
+
+// Convert the value from one unit to the other, the units must have the
+// same dimension
+func ConvertUnit(val float64, from, to cloudwatch.StandardUnit) (float64, error) {
+	factor, err := GetConversionFactor(from, to)
+	if err != nil {
+		return 0, err
+	}
+	return val * factor, nil
+}
+
+// Get the unit that the values are normalized to, the unknown units become
+// StandardUnitNone
+func getNormalizedUnit(unit cloudwatch.StandardUnit) cloudwatch.StandardUnit {
+	info, ok := unitInfos[unit]
+	if !ok {
+		return cloudwatch.StandardUnitNone
+	}
+	return info.normalized
+}
@@ -0,0 +1,102 @@
+package visibility
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		val      float64
+		unit     cloudwatch.StandardUnit
+		normVal  float64
+		normUnit cloudwatch.StandardUnit
+	}{
+		{2, cloudwatch.StandardUnitSeconds, 2e6, cloudwatch.StandardUnitMicroseconds},
+		{2, cloudwatch.StandardUnitMilliseconds, 2e3, cloudwatch.StandardUnitMicroseconds},
+		{2, cloudwatch.StandardUnitMicroseconds, 2, cloudwatch.StandardUnitMicroseconds},
+		{2, cloudwatch.StandardUnitBytes, 2, cloudwatch.StandardUnitBytes},
+		{2, cloudwatch.StandardUnitKilobytes, 2048, cloudwatch.StandardUnitBytes},
+		{2, cloudwatch.StandardUnitMegabytes, 2 << 20, cloudwatch.StandardUnitBytes},
+		{2, cloudwatch.StandardUnitGigabytes, 2 << 30, cloudwatch.StandardUnitBytes},
+		{2, cloudwatch.StandardUnitTerabytes, 2 << 40, cloudwatch.StandardUnitBytes},
+		{2, cloudwatch.StandardUnitBits, 2, cloudwatch.StandardUnitBits},
+		{2, cloudwatch.StandardUnitKilobits, 2e3, cloudwatch.StandardUnitBits},
+		{2, cloudwatch.StandardUnitMegabits, 2e6, cloudwatch.StandardUnitBits},
+		{2, cloudwatch.StandardUnitGigabits, 2e9, cloudwatch.StandardUnitBits},
+		{2, cloudwatch.StandardUnitTerabits, 2e12, cloudwatch.StandardUnitBits},
+		{2, cloudwatch.StandardUnitKilobytesSecond, 2048, cloudwatch.StandardUnitBytesSecond},
+		{2, cloudwatch.StandardUnitTerabytesSecond, 2 << 40, cloudwatch.StandardUnitBytesSecond},
+		{2, cloudwatch.StandardUnitKilobitsSecond, 2e3, cloudwatch.StandardUnitBitsSecond},
+		{2, cloudwatch.StandardUnitGigabitsSecond, 2e9, cloudwatch.StandardUnitBitsSecond},
+		{2, cloudwatch.StandardUnitCount, 2, cloudwatch.StandardUnitCount},
+		{2, cloudwatch.StandardUnitCountSecond, 2, cloudwatch.StandardUnitCountSecond},
+		{2, cloudwatch.StandardUnitPercent, 2, cloudwatch.StandardUnitPercent},
+		{2, cloudwatch.StandardUnitNone, 2, cloudwatch.StandardUnitNone},
+		{2, "Furlongs", 2, cloudwatch.StandardUnitNone},
+	}
+
+	for _, tt := range tests {
+		val, unit := MetricEntry{Val: tt.val, Unit: tt.unit}.Normalize()
+		assert.Equal(t, tt.normVal, val, string(tt.unit))
+		assert.Equal(t, tt.normUnit, unit, string(tt.unit))
+	}
+}
+
+func TestConvertUnit(t *testing.T) {
+	tests := []struct {
+		val  float64
+		from cloudwatch.StandardUnit
+		to   cloudwatch.StandardUnit
+		res  float64
+		err  bool
+	}{
+		{1500, cloudwatch.StandardUnitMilliseconds, cloudwatch.StandardUnitSeconds, 1.5, false},
+		{3, cloudwatch.StandardUnitSeconds, cloudwatch.StandardUnitMilliseconds, 3000, false},
+		{1, cloudwatch.StandardUnitBytes, cloudwatch.StandardUnitBits, 8, false},
+		{1, cloudwatch.StandardUnitKilobytes, cloudwatch.StandardUnitKilobits, 8.192, false},
+		{1, cloudwatch.StandardUnitGigabytes, cloudwatch.StandardUnitMegabytes, 1024, false},
+		{5, cloudwatch.StandardUnitMegabitsSecond, cloudwatch.StandardUnitKilobitsSecond, 5000, false},
+		{1, cloudwatch.StandardUnitBytes, cloudwatch.StandardUnitBytesSecond, 0, true},
+		{1, cloudwatch.StandardUnitSeconds, cloudwatch.StandardUnitCount, 0, true},
+		{1, cloudwatch.StandardUnitCount, cloudwatch.StandardUnitCountSecond, 0, true},
+		{1, "Furlongs", cloudwatch.StandardUnitCount, 0, true},
+		{1, cloudwatch.StandardUnitCount, "Furlongs", 0, true},
+	}
+
+	for _, tt := range tests {
+		res, err := ConvertUnit(tt.val, tt.from, tt.to)
+		if tt.err {
+			assert.Error(t, err, string(tt.from)+"->"+string(tt.to))
+			continue
+		}
+		assert.NoError(t, err)
+		assert.InDelta(t, tt.res, res, 1e-9, string(tt.from)+"->"+string(tt.to))
+	}
+}
+
+func TestUnitDimensions(t *testing.T) {
+	tests := []struct {
+		unit cloudwatch.StandardUnit
+		dim  UnitDimension
+		base cloudwatch.StandardUnit
+	}{
+		{cloudwatch.StandardUnitMilliseconds, DimensionTime, cloudwatch.StandardUnitMicroseconds},
+		{cloudwatch.StandardUnitKilobytes, DimensionData, cloudwatch.StandardUnitBits},
+		{cloudwatch.StandardUnitTerabits, DimensionData, cloudwatch.StandardUnitBits},
+		{cloudwatch.StandardUnitBytesSecond, DimensionDataRate, cloudwatch.StandardUnitBitsSecond},
+		{cloudwatch.StandardUnitCount, DimensionCount, cloudwatch.StandardUnitCount},
+		{cloudwatch.StandardUnitCountSecond, DimensionRate, cloudwatch.StandardUnitCountSecond},
+		{cloudwatch.StandardUnitPercent, DimensionPercent, cloudwatch.StandardUnitPercent},
+		{"Furlongs", DimensionNone, cloudwatch.StandardUnitNone},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.dim, GetUnitDimension(tt.unit), string(tt.unit))
+		assert.Equal(t, tt.base, GetBaseUnit(tt.dim), string(tt.unit))
+	}
+
+	// All the 27 CloudWatch units are known
+	assert.Equal(t, 27, len(unitInfos))
+}